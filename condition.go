@@ -0,0 +1,456 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+
+	gojmespath "github.com/jmespath/go-jmespath"
+	"gopkg.in/yaml.v3"
+)
+
+// Condition は if: / when: の条件。
+//
+//	if:
+//	  all:
+//	    - { expr: Status, op: in, value: [CREATE_COMPLETE, UPDATE_COMPLETE] }
+//	    - { expr: "length(Changes)", op: gt, value: 0 }
+//	    - not: { var: ENV, op: eq, value: prd }
+//
+// 葉は expr（LAST_JSON への JMESPath）か var（ctx 変数。文字列のまま、配列 / オブジェクトの JSON は型付きで比較）のどちらか。
+//
+// op:
+//   - eq(default) / ne: JSON の型で比較（数値は数値として 100 == 1e+02、"100" と 100 も等しい）
+//   - gt / ge / lt / le: 数値比較
+//   - contains: 文字列の部分一致 / 配列の要素
+//   - in: value（YAML の配列、またはカンマ区切り文字列）のどれかと等しい
+//   - matches: 正規表現（RE2）
+//   - exists: expr は null 以外、var は定義済みかつ空文字以外
+//   - empty: null / "" / [] / {}（var は未定義も空）
+//   - length_eq: 文字列・配列・オブジェクトの長さ
+//
+// value の文字列はテンプレート展開される（配列の要素も）。
+// value を省略した eq / ne は null との比較になる（従来の if は "" と比較していたので、
+// { expr: X } は「X が空文字」ではなく「X が null / 無い」で true。空文字は op: empty を使う）。
+// var が未定義のときは exists / empty 以外の op はエラー。
+type Condition struct {
+	All []Condition `yaml:"all,omitempty"`
+	Any []Condition `yaml:"any,omitempty"`
+	Not *Condition  `yaml:"not,omitempty"`
+
+	Expr  string `yaml:"expr,omitempty"`
+	Var   string `yaml:"var,omitempty"`
+	Op    string `yaml:"op,omitempty"`
+	Value any    `yaml:"value,omitempty"`
+}
+
+// IfBlock は if: の条件（JMESPath against LAST_JSON / ctx 変数）。
+type IfBlock = Condition
+
+func (c *Condition) UnmarshalYAML(n *yaml.Node) error {
+	type plain Condition
+	if err := n.Decode((*plain)(c)); err != nil {
+		return err
+	}
+
+	forms := 0
+	if c.All != nil {
+		forms++
+	}
+	if c.Any != nil {
+		forms++
+	}
+	if c.Not != nil {
+		forms++
+	}
+	leaf := c.Expr != "" || c.Var != ""
+	if leaf {
+		forms++
+	}
+	if forms != 1 {
+		return fmt.Errorf("line %d: condition must have exactly one of all / any / not / expr / var", n.Line)
+	}
+	if c.Expr != "" && c.Var != "" {
+		return fmt.Errorf("line %d: condition: use either expr or var", n.Line)
+	}
+	if !leaf && (c.Op != "" || c.Value != nil) {
+		return fmt.Errorf("line %d: condition: op / value require expr or var", n.Line)
+	}
+	if leaf {
+		if _, ok := conditionOps[c.op()]; !ok {
+			return fmt.Errorf("line %d: condition: unsupported op: %s", n.Line, c.Op)
+		}
+	}
+	return nil
+}
+
+var conditionOps = map[string]bool{
+	"eq": true, "ne": true, "gt": true, "ge": true, "lt": true, "le": true,
+	"contains": true, "in": true, "matches": true,
+	"exists": true, "empty": true, "length_eq": true,
+}
+
+func (c *Condition) op() string {
+	op := strings.ToLower(strings.TrimSpace(c.Op))
+	if op == "" {
+		return "eq"
+	}
+	return op
+}
+
+// String はログ / SKIP 理由用の表示。
+func (c *Condition) String() string {
+	join := func(name string, cs []Condition) string {
+		parts := make([]string, len(cs))
+		for i := range cs {
+			parts[i] = cs[i].String()
+		}
+		return name + "(" + strings.Join(parts, ", ") + ")"
+	}
+	switch {
+	case c.All != nil:
+		return join("all", c.All)
+	case c.Any != nil:
+		return join("any", c.Any)
+	case c.Not != nil:
+		return "not(" + c.Not.String() + ")"
+	}
+
+	s := "expr " + c.Expr
+	if c.Var != "" {
+		s = "var " + c.Var
+	}
+	s += " " + c.op()
+	if c.Value != nil {
+		b, err := json.Marshal(c.Value)
+		if err != nil {
+			s += " " + fmt.Sprint(c.Value)
+		} else {
+			s += " " + string(b)
+		}
+	}
+	return s
+}
+
+// evalCondition は条件を評価する。label はエラー表示用（if / when）。
+func evalCondition(label string, c *Condition, ctx map[string]string, last any) (bool, error) {
+	switch {
+	case c.All != nil:
+		for i := range c.All {
+			ok, err := evalCondition(label, &c.All[i], ctx, last)
+			if err != nil || !ok {
+				return false, err
+			}
+		}
+		return true, nil
+
+	case c.Any != nil:
+		for i := range c.Any {
+			ok, err := evalCondition(label, &c.Any[i], ctx, last)
+			if err != nil {
+				return false, err
+			}
+			if ok {
+				return true, nil
+			}
+		}
+		return false, nil
+
+	case c.Not != nil:
+		ok, err := evalCondition(label, c.Not, ctx, last)
+		return !ok, err
+	}
+
+	op := c.op()
+
+	// 左辺: LAST_JSON の JMESPath、または ctx 変数
+	var got any
+	if c.Var != "" {
+		raw, defined := ctx[c.Var]
+		if op == "exists" {
+			return defined && raw != "", nil
+		}
+		if !defined {
+			// 未定義は typo の可能性が高いのでエラー（switch と同じ）。有無は exists / empty で判定する
+			if op == "empty" {
+				return true, nil
+			}
+			return false, fmt.Errorf("%s: undefined variable: %s (use op: exists / empty to test whether it is set)", label, c.Var)
+		}
+		// 値は文字列のまま（"007" / "1e3" を数値にしない: matches / contains / length が元の文字列で動く）。
+		// capture した配列 / オブジェクトだけ JSON として扱う（profilesJSON と同じ）。
+		got = raw
+		if v, ok := parseJSONOrNil([]byte(raw)); ok {
+			switch v.(type) {
+			case map[string]any, []any:
+				got = v
+			}
+		}
+	} else {
+		if last == nil {
+			return false, fmt.Errorf("%s requires JSON stdout, but LAST_JSON is nil", label)
+		}
+		var err error
+		got, err = gojmespath.Search(c.Expr, last)
+		if err != nil {
+			return false, fmt.Errorf("%s: invalid expr %q: %w", label, c.Expr, err)
+		}
+	}
+
+	// 右辺: 文字列はテンプレート展開
+	want, err := renderConditionValue(c.Value, ctx)
+	if err != nil {
+		return false, fmt.Errorf("%s: value render failed: %w", label, err)
+	}
+
+	switch op {
+	case "exists":
+		return got != nil, nil
+
+	case "empty":
+		return isEmptyValue(got), nil
+
+	case "eq":
+		return jsonEqual(got, want), nil
+
+	case "ne":
+		return !jsonEqual(got, want), nil
+
+	case "gt", "ge", "lt", "le":
+		g, ok1 := toNumber(got)
+		w, ok2 := toNumber(want)
+		if !ok1 || !ok2 {
+			return false, fmt.Errorf("%s %s: not a number: %s %v / %v", label, op, c.subject(), got, want)
+		}
+		switch op {
+		case "gt":
+			return g > w, nil
+		case "ge":
+			return g >= w, nil
+		case "lt":
+			return g < w, nil
+		default:
+			return g <= w, nil
+		}
+
+	case "contains":
+		switch v := got.(type) {
+		case string:
+			return strings.Contains(v, textValue(want)), nil
+		case []any:
+			for _, it := range v {
+				if jsonEqual(it, want) {
+					return true, nil
+				}
+			}
+			return false, nil
+		default:
+			return false, fmt.Errorf("%s contains: unsupported type %T", label, got)
+		}
+
+	case "in":
+		var list []any
+		switch v := want.(type) {
+		case []any:
+			list = v
+		case string:
+			// 互換: カンマ区切り
+			for _, p := range strings.Split(v, ",") {
+				list = append(list, strings.TrimSpace(p))
+			}
+		default:
+			list = []any{v}
+		}
+		for _, it := range list {
+			if jsonEqual(got, it) {
+				return true, nil
+			}
+		}
+		return false, nil
+
+	case "matches":
+		pattern := textValue(want)
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return false, fmt.Errorf("%s matches: invalid regexp %q: %w", label, pattern, err)
+		}
+		return re.MatchString(textValue(got)), nil
+
+	case "length_eq":
+		n, ok := toNumber(want)
+		if !ok {
+			return false, fmt.Errorf("%s length_eq: value is not a number: %v", label, want)
+		}
+		l, ok := lengthOf(got)
+		if !ok {
+			return false, fmt.Errorf("%s length_eq: unsupported type %T", label, got)
+		}
+		return float64(l) == n, nil
+
+	default:
+		return false, fmt.Errorf("%s: unsupported op: %s", label, op)
+	}
+}
+
+// usesExpr は条件のどこかに expr（LAST_JSON）の葉があるかを返す。
+func (c *Condition) usesExpr() bool {
+	for i := range c.All {
+		if c.All[i].usesExpr() {
+			return true
+		}
+	}
+	for i := range c.Any {
+		if c.Any[i].usesExpr() {
+			return true
+		}
+	}
+	if c.Not != nil {
+		return c.Not.usesExpr()
+	}
+	return c.Expr != ""
+}
+
+func (c *Condition) subject() string {
+	if c.Var != "" {
+		return c.Var
+	}
+	return c.Expr
+}
+
+// renderConditionValue は value の文字列（配列・オブジェクト内も）をテンプレート展開する。
+func renderConditionValue(v any, ctx map[string]string) (any, error) {
+	switch t := v.(type) {
+	case string:
+		s, _, err := renderTemplateString(t, ctx)
+		return s, err
+	case []any:
+		out := make([]any, len(t))
+		for i, it := range t {
+			r, err := renderConditionValue(it, ctx)
+			if err != nil {
+				return nil, err
+			}
+			out[i] = r
+		}
+		return out, nil
+	case map[string]any:
+		out := make(map[string]any, len(t))
+		for k, it := range t {
+			r, err := renderConditionValue(it, ctx)
+			if err != nil {
+				return nil, err
+			}
+			out[k] = r
+		}
+		return out, nil
+	default:
+		return v, nil
+	}
+}
+
+// normalizeJSON は YAML 由来の値（int など）を JSON と同じ型（float64 など）にそろえる。
+func normalizeJSON(v any) any {
+	switch t := v.(type) {
+	case int:
+		return float64(t)
+	case int64:
+		return float64(t)
+	case uint64:
+		return float64(t)
+	case float32:
+		return float64(t)
+	case []any:
+		out := make([]any, len(t))
+		for i, it := range t {
+			out[i] = normalizeJSON(it)
+		}
+		return out
+	case map[string]any:
+		out := make(map[string]any, len(t))
+		for k, it := range t {
+			out[k] = normalizeJSON(it)
+		}
+		return out
+	default:
+		return v
+	}
+}
+
+// jsonEqual は JSON の型で比較する。数値と数値文字列、bool と "true"/"false" は同じ値として扱う。
+func jsonEqual(a, b any) bool {
+	a, b = normalizeJSON(a), normalizeJSON(b)
+
+	switch x := a.(type) {
+	case float64:
+		if y, ok := toNumber(b); ok {
+			return x == y
+		}
+		return false
+	case bool:
+		switch y := b.(type) {
+		case bool:
+			return x == y
+		case string:
+			pb, err := strconv.ParseBool(strings.TrimSpace(y))
+			return err == nil && pb == x
+		}
+		return false
+	case string:
+		switch y := b.(type) {
+		case string:
+			return x == y
+		case float64, bool:
+			return jsonEqual(b, a)
+		}
+		return false
+	case nil:
+		return b == nil
+	default:
+		return reflect.DeepEqual(a, b)
+	}
+}
+
+func toNumber(v any) (float64, bool) {
+	switch t := normalizeJSON(v).(type) {
+	case float64:
+		return t, true
+	case string:
+		f, err := strconv.ParseFloat(strings.TrimSpace(t), 64)
+		return f, err == nil
+	default:
+		return 0, false
+	}
+}
+
+func isEmptyValue(v any) bool {
+	switch t := v.(type) {
+	case nil:
+		return true
+	case string:
+		return t == ""
+	case []any:
+		return len(t) == 0
+	case map[string]any:
+		return len(t) == 0
+	default:
+		return false
+	}
+}
+
+func lengthOf(v any) (int, bool) {
+	switch t := v.(type) {
+	case string:
+		return len([]rune(t)), true
+	case []any:
+		return len(t), true
+	case map[string]any:
+		return len(t), true
+	case nil:
+		return 0, true
+	default:
+		return 0, false
+	}
+}
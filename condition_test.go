@@ -0,0 +1,121 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+func TestEvalCondition(t *testing.T) {
+	ctx := map[string]string{
+		"ZIP":    "007",
+		"SCI":    "1e3",
+		"NUM":    "12345",
+		"FLAG":   "true",
+		"EMPTY":  "",
+		"LIST":   `["a","b"]`,
+		"OBJ":    `{"k":1}`,
+		"ENV":    "prd",
+		"STRNUM": `"42"`,
+	}
+	last := map[string]any{"Status": "FAILED", "Changes": []any{"x"}, "Count": float64(3), "Empty": ""}
+
+	tests := []struct {
+		name    string
+		cond    string
+		last    any
+		want    bool
+		wantErr string
+	}{
+		// 数値のような文字列は文字列のまま（matches / contains / length）
+		{name: "matches keeps leading zeros", cond: `{ var: ZIP, op: matches, value: "^0[0-9]+$" }`, want: true},
+		{name: "length of numeric string", cond: `{ var: ZIP, op: length_eq, value: 3 }`, want: true},
+		{name: "length of exponent string", cond: `{ var: SCI, op: length_eq, value: 3 }`, want: true},
+		{name: "contains in numeric string", cond: `{ var: NUM, op: contains, value: "234" }`, want: true},
+		{name: "matches exponent string", cond: `{ var: SCI, op: matches, value: "e" }`, want: true},
+		{name: "quoted JSON string is not unquoted", cond: `{ var: STRNUM, op: length_eq, value: 4 }`, want: true},
+		// 比較は従来通り数値 / bool として等しい
+		{name: "eq numeric string and number", cond: `{ var: ZIP, op: eq, value: 7 }`, want: true},
+		{name: "eq exponent string", cond: `{ var: SCI, op: eq, value: 1000 }`, want: true},
+		{name: "gt numeric string", cond: `{ var: NUM, op: gt, value: 100 }`, want: true},
+		{name: "eq bool string", cond: `{ var: FLAG, op: eq, value: true }`, want: true},
+		{name: "in list", cond: `{ var: ENV, op: in, value: [stg, prd] }`, want: true},
+		{name: "in comma string", cond: `{ var: ENV, op: in, value: "dev, stg" }`, want: false},
+		// 配列 / オブジェクトは JSON として扱う
+		{name: "array contains", cond: `{ var: LIST, op: contains, value: b }`, want: true},
+		{name: "array length", cond: `{ var: LIST, op: length_eq, value: 2 }`, want: true},
+		{name: "object length", cond: `{ var: OBJ, op: length_eq, value: 1 }`, want: true},
+		// 未定義 / 空
+		{name: "exists undefined", cond: `{ var: NOPE, op: exists }`, want: false},
+		{name: "exists empty", cond: `{ var: EMPTY, op: exists }`, want: false},
+		{name: "empty undefined", cond: `{ var: NOPE, op: empty }`, want: true},
+		{name: "not exists undefined", cond: `{ not: { var: NOPE, op: exists } }`, want: true},
+		// 未定義の var は exists / empty 以外エラー（switch と同じ）
+		{name: "eq undefined", cond: `{ var: NOPE, op: eq, value: x }`, wantErr: "if: undefined variable: NOPE"},
+		{name: "ne undefined", cond: `{ var: NOPE, op: ne, value: x }`, wantErr: "if: undefined variable: NOPE"},
+		{name: "gt undefined", cond: `{ var: NOPE, op: gt, value: 1 }`, wantErr: "if: undefined variable: NOPE"},
+		{name: "not undefined", cond: `{ not: { var: NOPE, op: eq, value: x } }`, wantErr: "if: undefined variable: NOPE"},
+		{name: "any stops at undefined", cond: `{ any: [{ var: ENV, op: eq, value: dev }, { var: NOPE, op: eq, value: x }] }`, wantErr: "if: undefined variable: NOPE"},
+		{name: "any true before undefined", cond: `{ any: [{ var: ENV, op: eq, value: prd }, { var: NOPE, op: eq, value: x }] }`, want: true},
+		// value 省略の eq は null との比較（空文字とは等しくない）
+		{name: "eq omitted value on null", cond: `{ expr: Missing }`, last: last, want: true},
+		{name: "eq omitted value on empty string", cond: `{ expr: Empty }`, last: last, want: false},
+		{name: "empty on empty string", cond: `{ expr: Empty, op: empty }`, last: last, want: true},
+		{name: "ne omitted value", cond: `{ expr: Status, op: ne }`, last: last, want: true},
+		{name: "eq omitted value on empty var", cond: `{ var: EMPTY }`, want: false},
+		// expr（LAST_JSON）
+		{name: "expr eq", cond: `{ expr: Status, op: eq, value: FAILED }`, last: last, want: true},
+		{name: "expr length gt", cond: `{ expr: "length(Changes)", op: gt, value: 0 }`, last: last, want: true},
+		{name: "expr value template", cond: `{ expr: Count, op: lt, value: "{{ len .ENV }}" }`, last: last, want: false},
+		{name: "expr without last", cond: `{ expr: Status }`, wantErr: "LAST_JSON is nil"},
+		// all / any / not
+		{name: "all", cond: `{ all: [{ var: ENV, op: eq, value: prd }, { var: ZIP, op: matches, value: "^00" }] }`, want: true},
+		{name: "any", cond: `{ any: [{ var: ENV, op: eq, value: dev }, { var: NOPE, op: exists }] }`, want: false},
+		{name: "not", cond: `{ not: { var: ENV, op: eq, value: dev } }`, want: true},
+		// エラー
+		{name: "gt not a number", cond: `{ var: ENV, op: gt, value: 1 }`, wantErr: "not a number"},
+		{name: "invalid regexp", cond: `{ var: ENV, op: matches, value: "(" }`, wantErr: "invalid regexp"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var c Condition
+			if err := yaml.Unmarshal([]byte(tt.cond), &c); err != nil {
+				t.Fatalf("unmarshal: %v", err)
+			}
+			got, err := evalCondition("if", &c, ctx, tt.last)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("evalCondition(%s) = %v, want %v", tt.cond, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestConditionUnmarshalErrors(t *testing.T) {
+	tests := []struct {
+		cond    string
+		wantErr string
+	}{
+		{`{ expr: a, var: b }`, "use either expr or var"},
+		{`{ all: [], expr: a }`, "exactly one of"},
+		{`{ var: a, op: between }`, "unsupported op"},
+		{`{ not: { var: a }, op: eq }`, "op / value require expr or var"},
+	}
+	for _, tt := range tests {
+		var c Condition
+		err := yaml.Unmarshal([]byte(tt.cond), &c)
+		if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("%s: err = %v, want %q", tt.cond, err, tt.wantErr)
+		}
+	}
+}
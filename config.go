@@ -0,0 +1,539 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// 設定ファイルの合成（include / import）
+//
+//	include: [../../common.yml]   # 共通の defaults / targets / vars を取り込む
+//	cmd:
+//	  - import: changeset-update.yml
+//	    with: { STACK_NAME: stack-necro }
+//
+// パスはどちらも書いたファイルからの相対パス。
+//
+// include のマージ規則（後に書いたものが優先、自ファイルが最後）:
+//   - version / defaults.region / shell / vars.template-resolve-limit: 空でなければ上書き
+//   - targets.profiles: 空でなければ置き換え
+//   - targets.exclude / protect: 和集合
+//   - rollout: 指定があれば置き換え
+//   - vars.defaults / vars.secrets: キー単位で上書き
+//   - vars.profiles: profile ごと・キー単位で上書き
+//   - macros: 名前単位で上書き
+//   - setup / cmd / on_failure / finally: include した順に連結し、自ファイルのものはその後ろ
+//
+// import はステップの配列（または cmd: を持つファイル）をその位置に展開する。
+// with: の値は展開したステップの実行中だけ ctx に入る（テンプレート可）。
+
+// loadConfig は path を読み、include / import を解決した Config を返す。
+// use（マクロ）は include を全てマージした後に展開する（共通ファイルのマクロを使えるように）。
+func loadConfig(path string) (Config, error) {
+	cfg, err := loadConfigFile(path, nil)
+	if err != nil {
+		return cfg, err
+	}
+	if cfg.Setup, err = expandMacros(cfg.Setup, cfg.Macros, nil); err != nil {
+		return cfg, err
+	}
+	if cfg.Cmd, err = expandMacros(cfg.Cmd, cfg.Macros, nil); err != nil {
+		return cfg, err
+	}
+	if cfg.OnFailure, err = expandMacros(cfg.OnFailure, cfg.Macros, nil); err != nil {
+		return cfg, err
+	}
+	if cfg.Finally, err = expandMacros(cfg.Finally, cfg.Macros, nil); err != nil {
+		return cfg, err
+	}
+	// setup はもともと1回だけ実行するので scope: global は書けない（top-level の hook も profile ごと）
+	for _, cmds := range [][]Cmd{cfg.Setup, cfg.OnFailure, cfg.Finally} {
+		if err := validateScopes(cmds, true); err != nil {
+			return cfg, err
+		}
+	}
+	if err := validateScopes(cfg.Cmd, false); err != nil {
+		return cfg, err
+	}
+	for _, cmds := range [][]Cmd{cfg.Setup, cfg.Cmd, cfg.OnFailure, cfg.Finally} {
+		if err := validateSteps(cmds); err != nil {
+			return cfg, err
+		}
+	}
+	if err := validateProtect(cfg.Protect); err != nil {
+		return cfg, err
+	}
+	// rollout は wave ごとに全 cmd を実行するので、全 profile を集約する global ステップとは両立しない
+	if cfg.Rollout != nil {
+		for _, c := range cfg.Cmd {
+			if c.isGlobal() {
+				return cfg, withStepSource(fmt.Errorf("scope: global cannot be used with rollout"), c)
+			}
+		}
+	}
+	cfg.graph, err = buildStepGraph(cfg.Cmd)
+	return cfg, err
+}
+
+func loadConfigFile(path string, stack []string) (Config, error) {
+	var cfg Config
+
+	stack, err := pushLoadStack(stack, path, "include")
+	if err != nil {
+		return cfg, err
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return cfg, err
+	}
+	if err := yaml.Unmarshal(data, &cfg); err != nil {
+		return cfg, fmt.Errorf("%s: %w", path, err)
+	}
+	for name, def := range cfg.Macros {
+		def.file = path
+		cfg.Macros[name] = def
+	}
+
+	if cfg.Setup, err = expandImports(path, cfg.Setup, nil, nil); err != nil {
+		return cfg, err
+	}
+	if cfg.Cmd, err = expandImports(path, cfg.Cmd, nil, nil); err != nil {
+		return cfg, err
+	}
+	if cfg.OnFailure, err = expandImports(path, cfg.OnFailure, nil, nil); err != nil {
+		return cfg, err
+	}
+	if cfg.Finally, err = expandImports(path, cfg.Finally, nil, nil); err != nil {
+		return cfg, err
+	}
+
+	if len(cfg.Include) == 0 {
+		return cfg, nil
+	}
+
+	var merged Config
+	for _, inc := range cfg.Include {
+		sub, err := loadConfigFile(relativeTo(path, inc.Path), stack)
+		if err != nil {
+			return cfg, fmt.Errorf("%s:%d: include %s: %w", path, inc.line, inc.Path, err)
+		}
+		mergeConfig(&merged, &sub)
+	}
+	mergeConfig(&merged, &cfg)
+	merged.Include = nil
+	return merged, nil
+}
+
+// pushLoadStack は循環（a.yml -> b.yml -> a.yml）を検出する。
+func pushLoadStack(stack []string, path, kind string) ([]string, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		abs = filepath.Clean(path)
+	}
+	for i, p := range stack {
+		if p == abs {
+			chain := make([]string, 0, len(stack)-i+1)
+			for _, q := range stack[i:] {
+				chain = append(chain, relPathForDisplay(q))
+			}
+			chain = append(chain, relPathForDisplay(abs))
+			return nil, fmt.Errorf("%s cycle: %s", kind, strings.Join(chain, " -> "))
+		}
+	}
+	return append(stack[:len(stack):len(stack)], abs), nil
+}
+
+func relPathForDisplay(abs string) string {
+	if wd, err := os.Getwd(); err == nil {
+		if rel, err := filepath.Rel(wd, abs); err == nil && !strings.HasPrefix(rel, "..") {
+			return rel
+		}
+	}
+	return abs
+}
+
+// relativeTo は from（ファイル）の場所を基準に p を解決する。
+func relativeTo(from, p string) string {
+	if filepath.IsAbs(p) {
+		return p
+	}
+	return filepath.Join(filepath.Dir(from), p)
+}
+
+// mergeConfig は src を dst に重ねる（src が優先）。
+func mergeConfig(dst, src *Config) {
+	if src.Version != 0 {
+		dst.Version = src.Version
+	}
+	if src.Defaults.Region != "" {
+		dst.Defaults.Region = src.Defaults.Region
+	}
+	if len(src.Targets.Profiles) > 0 {
+		dst.Targets.Profiles = append([]string(nil), src.Targets.Profiles...)
+	}
+	for _, e := range src.Targets.Exclude {
+		if !containsString(dst.Targets.Exclude, e) {
+			dst.Targets.Exclude = append(dst.Targets.Exclude, e)
+		}
+	}
+
+	if src.Vars.TemplateResolveLimit != 0 {
+		dst.Vars.TemplateResolveLimit = src.Vars.TemplateResolveLimit
+	}
+	if len(src.Vars.Defaults) > 0 {
+		dst.Vars.Defaults = mergeVarValues(dst.Vars.Defaults, src.Vars.Defaults)
+	}
+	for p, vals := range src.Vars.Profiles {
+		if dst.Vars.Profiles == nil {
+			dst.Vars.Profiles = map[string]map[string]VarValue{}
+		}
+		dst.Vars.Profiles[p] = mergeVarValues(dst.Vars.Profiles[p], vals)
+	}
+	for k, v := range src.Vars.Secrets {
+		if dst.Vars.Secrets == nil {
+			dst.Vars.Secrets = map[string]SecretSource{}
+		}
+		dst.Vars.Secrets[k] = v
+	}
+
+	for name, def := range src.Macros {
+		if dst.Macros == nil {
+			dst.Macros = map[string]MacroDef{}
+		}
+		dst.Macros[name] = def
+	}
+
+	if src.Shell != "" {
+		dst.Shell = src.Shell
+	}
+	if src.Rollout != nil {
+		dst.Rollout = src.Rollout
+	}
+	dst.Protect = append(dst.Protect, src.Protect...)
+	dst.Setup = append(dst.Setup, src.Setup...)
+	dst.Cmd = append(dst.Cmd, src.Cmd...)
+	dst.OnFailure = append(dst.OnFailure, src.OnFailure...)
+	dst.Finally = append(dst.Finally, src.Finally...)
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// validateSteps は1つのステップに書けない組み合わせを読み込み時にエラーにする（ok / ng / on_failure / switch 内も含む）。
+// 実行時は1つだけが選ばれ、残りは黙って無視されてしまうため。
+func validateSteps(cmds []Cmd) error {
+	for _, c := range cmds {
+		if kinds := c.stepKinds(); len(kinds) > 1 {
+			return withStepSource(fmt.Errorf("only one of aws / sh / transform / render / file can be set (got %s)", strings.Join(kinds, " + ")), c)
+		}
+		if c.If != nil && c.Switch != nil {
+			return withStepSource(fmt.Errorf("if and switch cannot be used on the same step (nest the switch under ok / ng)"), c)
+		}
+		if c.File != nil {
+			if err := checkFileOp(c.File.Op); err != nil {
+				return withStepSource(err, c)
+			}
+		}
+		if err := c.mapChildren(func(steps []Cmd) ([]Cmd, error) {
+			return steps, validateSteps(steps)
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// stepKinds はステップに書かれている実行内容の種類（run は aws の旧書式）。
+func (c Cmd) stepKinds() []string {
+	var kinds []string
+	if len(c.Aws) > 0 {
+		kinds = append(kinds, "aws")
+	}
+	if len(c.Run) > 0 {
+		kinds = append(kinds, "run")
+	}
+	if !c.Sh.IsZero() {
+		kinds = append(kinds, "sh")
+	}
+	if c.Transform != nil {
+		kinds = append(kinds, "transform")
+	}
+	if c.Render != nil {
+		kinds = append(kinds, "render")
+	}
+	if c.File != nil {
+		kinds = append(kinds, "file")
+	}
+	return kinds
+}
+
+// mapChildren は子ステップ列（ok / ng / on_failure / switch の各 case・default）を f の結果で置き換える。
+// import / use の展開や検証など、ステップツリーを辿る処理はここを通す。
+func (c *Cmd) mapChildren(f func([]Cmd) ([]Cmd, error)) error {
+	var err error
+	if c.Ok, err = f(c.Ok); err != nil {
+		return err
+	}
+	if c.Ng, err = f(c.Ng); err != nil {
+		return err
+	}
+	if c.OnFailure, err = f(c.OnFailure); err != nil {
+		return err
+	}
+	if c.Switch != nil {
+		if c.Switch, err = c.Switch.mapSteps(f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// expandImports は cmds（ok / ng / on_failure / switch 内も含む）の import を展開し、各ステップに定義元の file:line を付ける。
+// with は外側の import の値に内側の値を重ねて、展開したステップに引き継ぐ。
+func expandImports(file string, cmds []Cmd, with map[string]string, stack []string) ([]Cmd, error) {
+	if stack == nil {
+		abs, err := filepath.Abs(file)
+		if err != nil {
+			abs = filepath.Clean(file)
+		}
+		stack = []string{abs}
+	}
+
+	out := make([]Cmd, 0, len(cmds))
+	for _, c := range cmds {
+		src := fmt.Sprintf("%s:%d", file, c.line)
+
+		if c.Import != "" {
+			impPath := relativeTo(file, c.Import)
+			subStack, err := pushLoadStack(stack, impPath, "import")
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", src, err)
+			}
+			steps, err := loadImportFile(impPath)
+			if err != nil {
+				return nil, fmt.Errorf("%s: import %s: %w", src, c.Import, err)
+			}
+			expanded, err := expandImports(impPath, steps, mergeWith(with, c.With), subStack)
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, expanded...)
+			continue
+		}
+
+		c.source = src
+		c.With = mergeWith(with, c.With)
+
+		if err := c.mapChildren(func(steps []Cmd) ([]Cmd, error) {
+			return expandImports(file, steps, nil, stack)
+		}); err != nil {
+			return nil, err
+		}
+		out = append(out, c)
+	}
+	return out, nil
+}
+
+// loadImportFile は import 先のステップ配列を読む（配列、または cmd: を持つマッピング）。
+func loadImportFile(path string) ([]Cmd, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if len(doc.Content) == 0 {
+		return nil, fmt.Errorf("%s: empty file", path)
+	}
+	root := doc.Content[0]
+
+	var steps []Cmd
+	switch root.Kind {
+	case yaml.SequenceNode:
+		if err := root.Decode(&steps); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+	case yaml.MappingNode:
+		var f struct {
+			Cmd []Cmd `yaml:"cmd"`
+		}
+		if err := root.Decode(&f); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		steps = f.Cmd
+	default:
+		return nil, fmt.Errorf("%s:%d: import file must be a list of steps or have cmd:", path, root.Line)
+	}
+	if len(steps) == 0 {
+		return nil, fmt.Errorf("%s: no steps", path)
+	}
+	return steps, nil
+}
+
+// mergeWith は outer に inner を重ねた新しい map を返す（inner が優先）。
+func mergeWith(outer, inner map[string]string) map[string]string {
+	if len(outer) == 0 && len(inner) == 0 {
+		return nil
+	}
+	out := make(map[string]string, len(outer)+len(inner))
+	for k, v := range outer {
+		out[k] = v
+	}
+	for k, v := range inner {
+		out[k] = v
+	}
+	return out
+}
+
+// applyWith は with の値を ctx で展開して ctx に入れ、元に戻す関数を返す。
+// ステップ内で capture により書き換えられた値はそのまま残す。
+func applyWith(ctx map[string]string, with map[string]string, setupVars map[string]bool) (restore func(), err error) {
+	keys := make([]string, 0, len(with))
+	for k := range with {
+		if isReadOnlyKey(setupVars, k) {
+			return nil, fmt.Errorf("with: cannot override built-in / setup variable: %s", k)
+		}
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	rendered := make(map[string]string, len(keys))
+	for _, k := range keys {
+		v, _, err := renderTemplateString(with[k], ctx)
+		if err != nil {
+			return nil, fmt.Errorf("with %s: %w", k, err)
+		}
+		rendered[k] = v
+	}
+
+	type saved struct {
+		v  string
+		ok bool
+	}
+	prev := make(map[string]saved, len(keys))
+	for _, k := range keys {
+		v, ok := ctx[k]
+		prev[k] = saved{v, ok}
+		ctx[k] = rendered[k]
+	}
+
+	return func() {
+		for _, k := range keys {
+			if ctx[k] != rendered[k] {
+				continue
+			}
+			if p := prev[k]; p.ok {
+				ctx[k] = p.v
+			} else {
+				delete(ctx, k)
+			}
+		}
+	}, nil
+}
+
+// UnmarshalYAML は定義位置（行）を記録し、import / use の書式を検証する。
+// use の with はマクロのパラメータ（文字列以外の値も可）として読む。
+func (c *Cmd) UnmarshalYAML(n *yaml.Node) error {
+	type plain Cmd
+	if n.Kind == yaml.MappingNode && mappingHasKey(n, "use") {
+		var u struct {
+			Use  string         `yaml:"use"`
+			With map[string]any `yaml:"with"`
+		}
+		if err := n.Decode(&u); err != nil {
+			return err
+		}
+		if err := onlyKeys(n, "use", "use", "with"); err != nil {
+			return err
+		}
+		*c = Cmd{Use: u.Use, useWith: u.With, line: n.Line}
+		return nil
+	}
+
+	if err := n.Decode((*plain)(c)); err != nil {
+		return err
+	}
+	c.line = n.Line
+
+	if c.Import != "" {
+		return onlyKeys(n, "import", "import", "with")
+	}
+	return nil
+}
+
+func mappingHasKey(n *yaml.Node, key string) bool {
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		if n.Content[i].Value == key {
+			return true
+		}
+	}
+	return false
+}
+
+// onlyKeys は kind（import / use）の要素に allowed 以外のキーが無いことを確認する。
+func onlyKeys(n *yaml.Node, kind string, allowed ...string) error {
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		if !containsString(allowed, n.Content[i].Value) {
+			return fmt.Errorf("line %d: %s cannot be combined with %s", n.Content[i].Line, kind, n.Content[i].Value)
+		}
+	}
+	return nil
+}
+
+// includeEntry は include: の1要素（行番号を記録する）。
+type includeEntry struct {
+	Path string
+	line int
+}
+
+func (e *includeEntry) UnmarshalYAML(n *yaml.Node) error {
+	if err := n.Decode(&e.Path); err != nil {
+		return err
+	}
+	if strings.TrimSpace(e.Path) == "" {
+		return fmt.Errorf("line %d: include: empty path", n.Line)
+	}
+	e.line = n.Line
+	return nil
+}
+
+// stepError はステップの失敗に定義元（file:line）を付ける。
+type stepError struct {
+	Source string
+	Step   string
+	Err    error
+}
+
+func (e *stepError) Error() string {
+	return fmt.Sprintf("%s: %s: %v", e.Source, e.Step, e.Err)
+}
+
+func (e *stepError) Unwrap() error { return e.Err }
+
+// withStepSource は err に c の定義元を付ける（入れ子の内側で付けたものはそのまま）。
+func withStepSource(err error, c Cmd) error {
+	if err == nil || c.source == "" {
+		return err
+	}
+	var se *stepError
+	if errors.As(err, &se) {
+		return err
+	}
+	return &stepError{Source: c.source, Step: c.Name, Err: err}
+}
@@ -0,0 +1,400 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// loadConfigString は yml を一時ファイルに書いて loadConfig する。
+func loadConfigString(t *testing.T, yml string) (Config, error) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "x.yml")
+	if err := os.WriteFile(path, []byte(yml), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return loadConfig(path)
+}
+
+func TestLoadConfigValidateSteps(t *testing.T) {
+	tests := []struct {
+		name    string
+		yml     string
+		wantErr string
+	}{
+		{
+			name: "one kind per step",
+			yml: `
+cmd:
+  - name: a
+    aws: ["s3", "ls"]
+  - name: b
+    sh: echo b
+`,
+		},
+		{
+			name: "aws and sh",
+			yml: `
+cmd:
+  - name: a
+    aws: ["s3", "ls"]
+    sh: echo a
+`,
+			wantErr: "only one of aws / sh / transform / render / file can be set (got aws + sh)",
+		},
+		{
+			name: "transform and render in nested ok",
+			yml: `
+cmd:
+  - name: a
+    sh: echo '{}'
+    if: { expr: a, op: exists }
+    ok:
+      - name: b
+        transform: { expr: "@" }
+        render: { template: t.tmpl }
+`,
+			wantErr: "got transform + render",
+		},
+		{
+			name: "file and sh in finally",
+			yml: `
+cmd:
+  - name: a
+    sh: echo a
+finally:
+  - name: b
+    sh: echo b
+    file: { op: mkdir, dst: ./tmp/x }
+`,
+			wantErr: "got sh + file",
+		},
+		{
+			name: "file template op points to render",
+			yml: `
+cmd:
+  - name: a
+    file: { op: template, src: t.tmpl, dst: ./tmp/x }
+`,
+			wantErr: "file: op template is not supported: use a render step",
+		},
+		{
+			name: "file unknown op",
+			yml: `
+cmd:
+  - name: a
+    file: { op: move, dst: ./tmp/x }
+`,
+			wantErr: "file: unsupported op: move",
+		},
+		{
+			name: "if and switch",
+			yml: `
+cmd:
+  - name: a
+    sh: echo '{"s":"x"}'
+    if: { expr: s, op: exists }
+    switch:
+      expr: s
+      default:
+        - { name: b, sh: echo b }
+`,
+			wantErr: "if and switch cannot be used on the same step",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := loadConfigString(t, tt.yml)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("err = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// writeConfigFiles は files（相対パス → 内容）を一時ディレクトリに書き、そこへ移動する。
+func writeConfigFiles(t *testing.T, files map[string]string) {
+	t.Helper()
+	dir := t.TempDir()
+	t.Chdir(dir)
+	for name, s := range files {
+		if err := writeFileMkdir(name, []byte(s), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestLoadConfigInclude(t *testing.T) {
+	writeConfigFiles(t, map[string]string{
+		"common/base.yml": `version: 1
+defaults: { region: us-east-1 }
+shell: sh
+targets: { profiles: [COM_DEV, SND_DEV], exclude: [OLD] }
+protect: ["*_PRD"]
+vars:
+  template-resolve-limit: 5
+  defaults: { ENV: base, OWNER: base }
+  profiles:
+    COM_DEV: { SYSTEM: com, TIER: base }
+setup:
+  - { name: base-setup, sh: echo base }
+cmd:
+  - { name: base-cmd, sh: echo base }
+`,
+		"common/team.yml": `defaults: { region: ap-northeast-1 }
+targets: { exclude: [OLD, TMP] }
+protect: ["*_PRD", "COM_*"]
+vars:
+  defaults: { ENV: team }
+  profiles:
+    COM_DEV: { TIER: team }
+cmd:
+  - { name: team-cmd, sh: echo team }
+`,
+		"conf/main.yml": `include: [../common/base.yml, ../common/team.yml]
+targets: { profiles: [COM_DEV] }
+vars:
+  defaults: { OWNER: main }
+cmd:
+  - { name: main-cmd, sh: echo main }
+`,
+	})
+
+	cfg, err := loadConfig("conf/main.yml")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := map[string]any{
+		"version":  cfg.Version,
+		"region":   cfg.Defaults.Region,
+		"shell":    cfg.Shell,
+		"limit":    cfg.Vars.TemplateResolveLimit,
+		"profiles": strings.Join(cfg.Targets.Profiles, ","),
+		"exclude":  strings.Join(cfg.Targets.Exclude, ","),
+		"ENV":      cfg.Vars.Defaults["ENV"].Value,
+		"OWNER":    cfg.Vars.Defaults["OWNER"].Value,
+		"SYSTEM":   cfg.Vars.Profiles["COM_DEV"]["SYSTEM"].Value,
+		"TIER":     cfg.Vars.Profiles["COM_DEV"]["TIER"].Value,
+		"include":  len(cfg.Include),
+	}
+	want := map[string]any{
+		"version":  1,                // 後のファイルが空なら残る
+		"region":   "ap-northeast-1", // 後に include したものが優先
+		"shell":    "sh",
+		"limit":    5,
+		"profiles": "COM_DEV", // 自ファイルで置き換え
+		"exclude":  "OLD,TMP", // 和集合
+		"ENV":      "team",
+		"OWNER":    "main", // 自ファイルが最後
+		"SYSTEM":   "com",  // profile ごと・キー単位
+		"TIER":     "team",
+		"include":  0,
+	}
+	for k, w := range want {
+		if got[k] != w {
+			t.Errorf("%s = %v, want %v", k, got[k], w)
+		}
+	}
+	if strings.Join(cfg.Protect, ",") != "*_PRD,*_PRD,COM_*" {
+		t.Errorf("protect = %v", cfg.Protect)
+	}
+
+	// ステップは include した順に連結し、定義元のファイルを覚えている
+	var steps []string
+	for _, c := range append(cfg.Setup, cfg.Cmd...) {
+		steps = append(steps, c.Name+"@"+c.source)
+	}
+	wantSteps := []string{
+		"base-setup@common/base.yml:12",
+		"base-cmd@common/base.yml:14",
+		"team-cmd@common/team.yml:9",
+		"main-cmd@conf/main.yml:6",
+	}
+	if strings.Join(steps, " ") != strings.Join(wantSteps, " ") {
+		t.Errorf("steps = %q, want %q", steps, wantSteps)
+	}
+}
+
+func TestLoadConfigImport(t *testing.T) {
+	writeConfigFiles(t, map[string]string{
+		"conf/main.yml": `cmd:
+  - name: first
+    sh: echo first
+  - import: steps/deploy.yml
+    with: { STACK: a, REGION_X: outer }
+  - name: nested
+    sh: echo nested
+    ok:
+      - import: steps/deploy.yml
+`,
+		"conf/steps/deploy.yml": `- name: deploy
+  sh: echo {{ .STACK }}
+- import: wait.yml
+  with: { REGION_X: inner }
+`,
+		"conf/steps/wait.yml": `cmd:
+  - name: wait
+    sh: echo wait
+`,
+	})
+
+	cfg, err := loadConfig("conf/main.yml")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	type step struct{ name, source, with string }
+	flat := func(cmds []Cmd) []step {
+		var out []step
+		for _, c := range cmds {
+			var kv []string
+			for _, k := range []string{"STACK", "REGION_X"} {
+				if v, ok := c.With[k]; ok {
+					kv = append(kv, k+"="+v)
+				}
+			}
+			out = append(out, step{c.Name, c.source, strings.Join(kv, ",")})
+		}
+		return out
+	}
+
+	// with は外側に内側を重ねて引き継ぐ
+	want := []step{
+		{"first", "conf/main.yml:2", ""},
+		{"deploy", "conf/steps/deploy.yml:1", "STACK=a,REGION_X=outer"},
+		{"wait", "conf/steps/wait.yml:2", "STACK=a,REGION_X=inner"},
+		{"nested", "conf/main.yml:6", ""},
+	}
+	if got := flat(cfg.Cmd); !reflect.DeepEqual(got, want) {
+		t.Errorf("cmd = %+v, want %+v", got, want)
+	}
+	// ok の中の import も展開する
+	wantOk := []step{
+		{"deploy", "conf/steps/deploy.yml:1", ""},
+		{"wait", "conf/steps/wait.yml:2", "REGION_X=inner"},
+	}
+	if len(cfg.Cmd) == 4 {
+		if got := flat(cfg.Cmd[3].Ok); !reflect.DeepEqual(got, wantOk) {
+			t.Errorf("ok = %+v, want %+v", got, wantOk)
+		}
+	}
+}
+
+func TestLoadConfigIncludeImportErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		files   map[string]string
+		wantErr string
+	}{
+		{
+			name: "include cycle",
+			files: map[string]string{
+				"a.yml": "version: 1\ninclude: [b.yml]\n",
+				"b.yml": "include:\n  - a.yml\n",
+			},
+			wantErr: "a.yml:2: include b.yml: b.yml:2: include a.yml: include cycle: a.yml -> b.yml -> a.yml",
+		},
+		{
+			name:    "include itself",
+			files:   map[string]string{"a.yml": "include: [./a.yml]\n"},
+			wantErr: "a.yml:1: include ./a.yml: include cycle: a.yml -> a.yml",
+		},
+		{
+			name:    "missing include",
+			files:   map[string]string{"a.yml": "include:\n  - common/nope.yml\n"},
+			wantErr: "a.yml:2: include common/nope.yml: open common/nope.yml:",
+		},
+		{
+			name: "import cycle",
+			files: map[string]string{
+				"a.yml":   "cmd:\n  - import: s/b.yml\n",
+				"s/b.yml": "- { name: b, sh: echo b }\n- import: c.yml\n",
+				"s/c.yml": "- import: b.yml\n",
+			},
+			wantErr: "s/c.yml:1: import cycle: s/b.yml -> s/c.yml -> s/b.yml",
+		},
+		{
+			name:    "missing import",
+			files:   map[string]string{"a.yml": "cmd:\n  - { name: a, sh: echo a }\n  - import: nope.yml\n"},
+			wantErr: "a.yml:3: import nope.yml: open nope.yml:",
+		},
+		{
+			name: "import file without steps",
+			files: map[string]string{
+				"a.yml": "cmd:\n  - import: s.yml\n",
+				"s.yml": "cmd: []\n",
+			},
+			wantErr: "a.yml:2: import s.yml: s.yml: no steps",
+		},
+		{
+			name: "import with other keys",
+			files: map[string]string{
+				"a.yml": "cmd:\n  - import: s.yml\n    sh: echo x\n",
+			},
+			wantErr: "a.yml: line 3: import cannot be combined with sh",
+		},
+		{
+			name: "step error shows the imported file:line",
+			files: map[string]string{
+				"a.yml":      "include: [common.yml]\n",
+				"common.yml": "cmd:\n  - import: s.yml\n",
+				"s.yml":      "- { name: ok, sh: echo ok }\n- name: bad\n  sh: echo bad\n  aws: [s3, ls]\n",
+			},
+			wantErr: "s.yml:2: bad: only one of aws / sh / transform / render / file can be set",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			writeConfigFiles(t, tt.files)
+			_, err := loadConfig("a.yml")
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("err = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestPushLoadStack(t *testing.T) {
+	dir := t.TempDir()
+	t.Chdir(dir)
+
+	stack, err := pushLoadStack(nil, "a.yml", "include")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stack, err = pushLoadStack(stack, "conf/../b.yml", "include")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 兄弟の分岐は互いの stack に影響しない（同じ配列を共有しない）
+	left, err := pushLoadStack(stack, "c.yml", "import")
+	if err != nil {
+		t.Fatal(err)
+	}
+	right, err := pushLoadStack(stack, "d.yml", "import")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if filepath.Base(left[2]) != "c.yml" || filepath.Base(right[2]) != "d.yml" {
+		t.Errorf("left = %v, right = %v", left, right)
+	}
+
+	_, err = pushLoadStack(stack, "./b.yml", "import")
+	if err == nil || err.Error() != "import cycle: b.yml -> b.yml" {
+		t.Errorf("err = %v", err)
+	}
+	_, err = pushLoadStack(stack, filepath.Join(dir, "a.yml"), "include")
+	if err == nil || err.Error() != "include cycle: a.yml -> b.yml -> a.yml" {
+		t.Errorf("err = %v", err)
+	}
+}
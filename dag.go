@@ -0,0 +1,400 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// id / needs（ステップの依存関係と DAG 実行）
+//
+//	cmd:
+//	  - name: s3-check
+//	    id: s3
+//	    needs: []                  # 前のステップを待たずに開始
+//	    aws: ["s3api", "list-buckets"]
+//	  - name: cfn-check
+//	    id: cfn
+//	    needs: []
+//	    aws: ["cloudformation", "describe-stacks"]
+//	  - name: report
+//	    needs: [s3, cfn]           # 両方が終わってから
+//	    sh: echo done
+//
+// needs を書かないステップは今まで通り直前のステップを待つ。needs が1つでもあれば、
+// profile ごとに依存が済んだステップを同時に実行する（scope: global のステップは全 profile の区切り）。
+// 循環（a -> b -> a）や未定義の id は読み込み時にエラーにする。
+
+// stepGraph は top-level cmd の依存関係。
+type stepGraph struct {
+	deps  [][]int // 実行に必要なステップ（needs / 直前のステップ / global の区切り）
+	edges [][]int // graph 表示用（global の区切りは端のステップだけ）
+	dag   bool    // needs を使っている（false なら従来通り step ごとに全 profile を実行）
+}
+
+// stepLabel はログ・エラーに出すステップの名前（name。needs で参照する id が別にあれば "name (id)"）。
+// needs が参照できるのは id だけ（id の無いステップは暗黙の依存のみ）。
+func stepLabel(c Cmd) string {
+	if c.ID != "" && c.ID != c.Name {
+		return c.Name + " (" + c.ID + ")"
+	}
+	return c.Name
+}
+
+// buildStepGraph は cmds の依存関係を作り、未定義の id・循環を確認する。
+func buildStepGraph(cmds []Cmd) (*stepGraph, error) {
+	g := &stepGraph{deps: make([][]int, len(cmds)), edges: make([][]int, len(cmds))}
+
+	ids := map[string]int{}
+	for i, c := range cmds {
+		if c.Needs != nil {
+			g.dag = true
+		}
+		if c.ID == "" {
+			continue
+		}
+		if j, ok := ids[c.ID]; ok {
+			return nil, withStepSource(fmt.Errorf("id: duplicate %q (also on step %s)", c.ID, cmds[j].Name), c)
+		}
+		ids[c.ID] = i
+	}
+
+	segStart, lastGlobal := 0, -1
+	for i, c := range cmds {
+		var deps []int
+		if c.Needs == nil {
+			if i > 0 {
+				deps = append(deps, i-1)
+			}
+		}
+		for _, id := range c.Needs {
+			j, ok := ids[id]
+			if !ok {
+				return nil, withStepSource(fmt.Errorf("needs: unknown id %q", id), c)
+			}
+			deps = appendUnique(deps, j)
+		}
+		g.edges[i] = append([]int(nil), deps...)
+
+		// global のステップは前の区切りからの全ステップの後、後のステップは global の後
+		if c.isGlobal() {
+			for j := segStart; j < i; j++ {
+				deps = appendUnique(deps, j)
+			}
+			if lastGlobal >= 0 {
+				deps = appendUnique(deps, lastGlobal)
+			}
+			segStart, lastGlobal = i+1, i
+		} else if lastGlobal >= 0 {
+			deps = appendUnique(deps, lastGlobal)
+		}
+		g.deps[i] = deps
+	}
+
+	if cycle := g.findCycle(); cycle != nil {
+		names := make([]string, len(cycle))
+		for k, i := range cycle {
+			names[k] = stepLabel(cmds[i])
+		}
+		return nil, withStepSource(fmt.Errorf("needs: dependency cycle: %s", strings.Join(names, " -> ")), cmds[cycle[0]])
+	}
+
+	g.addBarrierEdges(cmds)
+	return g, nil
+}
+
+// findCycle は循環があればその経路（先頭と末尾は同じステップ）を返す。
+func (g *stepGraph) findCycle() []int {
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	state := make([]int, len(g.deps))
+	var stack []int
+	var visit func(i int) []int
+	visit = func(i int) []int {
+		state[i] = visiting
+		stack = append(stack, i)
+		for _, j := range g.deps[i] {
+			switch state[j] {
+			case visiting:
+				for k, s := range stack {
+					if s == j {
+						// 依存の向き（i は j を待つ）を実行順（j -> i）に直して表示する
+						cycle := append([]int{}, stack[k:]...)
+						cycle = append(cycle, j)
+						for a, b := 0, len(cycle)-1; a < b; a, b = a+1, b-1 {
+							cycle[a], cycle[b] = cycle[b], cycle[a]
+						}
+						return cycle
+					}
+				}
+			case unvisited:
+				if c := visit(j); c != nil {
+					return c
+				}
+			}
+		}
+		stack = stack[:len(stack)-1]
+		state[i] = visited
+		return nil
+	}
+	for i := range g.deps {
+		if state[i] == unvisited {
+			if c := visit(i); c != nil {
+				return c
+			}
+		}
+	}
+	return nil
+}
+
+// addBarrierEdges は graph 表示用に global の区切りの辺を足す（前の区切りの末端 -> global -> 後の区切りの先頭）。
+func (g *stepGraph) addBarrierEdges(cmds []Cmd) {
+	segStart, lastGlobal := 0, -1
+	for i, c := range cmds {
+		if !c.isGlobal() {
+			if lastGlobal >= 0 && !hasDepIn(g.edges[i], lastGlobal, i) {
+				g.edges[i] = appendUnique(g.edges[i], lastGlobal)
+			}
+			continue
+		}
+		// 区切り内で他のステップに待たれていないステップ
+		for j := segStart; j < i; j++ {
+			sink := true
+			for k := j + 1; k < i; k++ {
+				if containsInt(g.edges[k], j) {
+					sink = false
+					break
+				}
+			}
+			if sink {
+				g.edges[i] = appendUnique(g.edges[i], j)
+			}
+		}
+		if segStart == i && lastGlobal >= 0 {
+			g.edges[i] = appendUnique(g.edges[i], lastGlobal)
+		}
+		segStart, lastGlobal = i+1, i
+	}
+}
+
+// hasDepIn は deps に (from, to) の範囲のステップがあるか。
+func hasDepIn(deps []int, from, to int) bool {
+	for _, d := range deps {
+		if d >= from && d < to {
+			return true
+		}
+	}
+	return false
+}
+
+// segmentEnd は start から次の global ステップ（または末尾）までの終わりの位置。
+func segmentEnd(cmds []Cmd, start int) int {
+	end := start
+	for end < len(cmds) && !cmds[end].isGlobal() {
+		end++
+	}
+	return end
+}
+
+type dagResult struct {
+	i    int
+	ctx  map[string]string
+	base map[string]string // 開始時の ctx
+	env  *runEnv
+	out  *lockedBuffer
+	err  error
+	took time.Duration
+}
+
+// runStepDAG は cmds[start:end]（global を含まない区切り）を1つの profile で DAG として実行する。
+// 依存が済んだステップを同時に始め、出力は終わった順に表示する。ctx はステップごとに複製し、
+// 終わったステップの capture（変更したキー）を ctx に戻す。最初の失敗の後は新しいステップを始めない。
+// base は summary の列の位置（setup の数）。
+func runStepDAG(env *runEnv, profile string, ctx map[string]string, cmds []Cmd, g *stepGraph, start, end, base int) error {
+	mw := env.mw
+	done := make(map[int]bool, end-start)
+	launched := make(map[int]bool, end-start)
+	results := make(chan dagResult)
+	running := 0
+	var firstErr error
+
+	ready := func(i int) bool {
+		for _, d := range g.deps[i] {
+			if d >= start && d < end && !done[d] {
+				return false
+			}
+		}
+		return true
+	}
+
+	for {
+		if firstErr == nil {
+			if err := env.checkInterrupted(); err != nil {
+				firstErr = err
+			}
+		}
+		if firstErr == nil {
+			for i := start; i < end; i++ {
+				if launched[i] || !ready(i) {
+					continue
+				}
+				launched[i] = true
+				running++
+
+				c := cmds[i]
+				r := dagResult{i: i, ctx: copyMap(ctx), base: copyMap(ctx), out: &lockedBuffer{}}
+				r.env = env.fork(r.out, profile)
+				r.env.step = base + i
+				fmt.Fprintf(mw, "🔀 DAG START | %s | profile=%s | needs=%s | running=%d\n", c.Name, profile, dagNeedsDesc(cmds, g, i, start, end), running)
+				go func(r dagResult) {
+					stepStart := time.Now()
+					r.err = runCmdTreeForProfile(r.env, profile, c.Name, r.ctx, c)
+					r.took = time.Since(stepStart)
+					results <- r
+				}(r)
+			}
+		}
+		if running == 0 {
+			break
+		}
+
+		r := <-results
+		running--
+		done[r.i] = true
+		_, _ = mw.Write(r.out.Bytes())
+		env.summary.record(profile, base+r.i, r.err, r.took)
+		if r.err != nil {
+			if firstErr == nil {
+				firstErr = r.err
+			}
+			continue
+		}
+		// 開始時から変わったキー（capture / transform など）だけを戻す（同時に終わった別ステップの値を消さない）
+		for k, v := range r.ctx {
+			if env.isReadOnlyKey(k) {
+				continue
+			}
+			if old, ok := r.base[k]; !ok || old != v {
+				ctx[k] = v
+			}
+		}
+		env.setLastJSON(profile, r.env.lastJSON(profile))
+	}
+	return firstErr
+}
+
+// dagNeedsDesc は DAG START に表示する待っていたステップ（区切り内のみ）。
+func dagNeedsDesc(cmds []Cmd, g *stepGraph, i, start, end int) string {
+	var names []string
+	for _, d := range g.deps[i] {
+		if d >= start && d < end {
+			names = append(names, stepLabel(cmds[d]))
+		}
+	}
+	if len(names) == 0 {
+		return "-"
+	}
+	return strings.Join(names, ", ")
+}
+
+// writeStepGraph は DAG を DOT / Mermaid で書き出す（necro graph）。
+func writeStepGraph(w io.Writer, cmds []Cmd, g *stepGraph, format string) error {
+	label := func(c Cmd) string {
+		s := stepLabel(c)
+		if c.isGlobal() {
+			s += " [global]"
+		}
+		return s
+	}
+
+	switch format {
+	case "dot":
+		fmt.Fprintln(w, "digraph necro {")
+		fmt.Fprintln(w, "  rankdir=LR;")
+		fmt.Fprintln(w, "  node [shape=box];")
+		for i, c := range cmds {
+			attrs := "label=" + strconv.Quote(label(c))
+			if c.isGlobal() {
+				attrs += ", style=bold"
+			}
+			fmt.Fprintf(w, "  n%d [%s];\n", i, attrs)
+		}
+		for i := range cmds {
+			for _, d := range g.edges[i] {
+				fmt.Fprintf(w, "  n%d -> n%d;\n", d, i)
+			}
+		}
+		fmt.Fprintln(w, "}")
+	case "mermaid":
+		fmt.Fprintln(w, "flowchart LR")
+		for i, c := range cmds {
+			l := strings.ReplaceAll(label(c), `"`, "#quot;")
+			if c.isGlobal() {
+				fmt.Fprintf(w, "  n%d[[\"%s\"]]\n", i, l)
+			} else {
+				fmt.Fprintf(w, "  n%d[\"%s\"]\n", i, l)
+			}
+		}
+		for i := range cmds {
+			for _, d := range g.edges[i] {
+				fmt.Fprintf(w, "  n%d --> n%d\n", d, i)
+			}
+		}
+	default:
+		return fmt.Errorf("graph: unsupported format %q (dot / mermaid)", format)
+	}
+	return nil
+}
+
+// handleGraph は necro graph <yml-file> [--format dot|mermaid]。
+func handleGraph(args []string) {
+	cfgPath, format := "", "dot"
+	for i := 0; i < len(args); i++ {
+		a := args[i]
+		switch {
+		case a == "--format":
+			if i+1 >= len(args) {
+				die(fmt.Errorf("graph: --format requires dot / mermaid"))
+			}
+			i++
+			format = args[i]
+		case strings.HasPrefix(a, "--format="):
+			format = strings.TrimPrefix(a, "--format=")
+		case cfgPath == "" && !strings.HasPrefix(a, "-"):
+			cfgPath = a
+		default:
+			die(fmt.Errorf("graph: unknown argument %q", a))
+		}
+	}
+	if cfgPath == "" {
+		fmt.Println("Usage:")
+		fmt.Println("  necro graph <yml-file> [--format dot|mermaid]")
+		os.Exit(1)
+	}
+
+	cfg, err := loadConfig(cfgPath)
+	dieIf(err)
+	dieIf(writeStepGraph(os.Stdout, cfg.Cmd, cfg.graph, format))
+}
+
+func appendUnique(list []int, v int) []int {
+	if containsInt(list, v) {
+		return list
+	}
+	return append(list, v)
+}
+
+func containsInt(list []int, v int) bool {
+	for _, x := range list {
+		if x == v {
+			return true
+		}
+	}
+	return false
+}
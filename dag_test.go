@@ -0,0 +1,180 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+// parseCmds は cmd の YAML（ステップの配列）を読む。
+func parseCmds(t *testing.T, yml string) []Cmd {
+	t.Helper()
+	var cmds []Cmd
+	if err := yaml.Unmarshal([]byte(yml), &cmds); err != nil {
+		t.Fatal(err)
+	}
+	return cmds
+}
+
+func TestBuildStepGraph(t *testing.T) {
+	tests := []struct {
+		name      string
+		yml       string
+		wantDAG   bool
+		wantDeps  [][]int
+		wantEdges [][]int
+	}{
+		{
+			name: "no needs keeps step order",
+			yml: `
+- { name: a, sh: echo a }
+- { name: b, sh: echo b }
+- { name: c, sh: echo c }
+`,
+			wantDeps:  [][]int{nil, {0}, {1}},
+			wantEdges: [][]int{nil, {0}, {1}},
+		},
+		{
+			name: "needs fan-in",
+			yml: `
+- { name: s3-check, id: s3, needs: [], sh: echo a }
+- { name: cfn-check, id: cfn, needs: [], sh: echo b }
+- { name: report, needs: [s3, cfn], sh: echo c }
+- { name: after, sh: echo d }
+`,
+			wantDAG:   true,
+			wantDeps:  [][]int{nil, nil, {0, 1}, {2}},
+			wantEdges: [][]int{nil, nil, {0, 1}, {2}},
+		},
+		{
+			name: "global step is a barrier",
+			yml: `
+- { name: a, id: a, needs: [], sh: echo a }
+- { name: b, id: b, needs: [], sh: echo b }
+- { name: c, needs: [a], sh: echo c }
+- { name: agg, scope: global, sh: echo g }
+- { name: d, id: d, needs: [], sh: echo d }
+- { name: e, needs: [a], sh: echo e }
+`,
+			wantDAG: true,
+			// global は区切り内の全ステップを待ち、後のステップは global を待つ
+			wantDeps: [][]int{nil, nil, {0}, {2, 0, 1}, {3}, {0, 3}},
+			// 表示用は区切りの末端（b, c）-> global -> 後のステップ
+			wantEdges: [][]int{nil, nil, {0}, {2, 1}, {3}, {0, 3}},
+		},
+		{
+			name: "consecutive global steps",
+			yml: `
+- { name: a, id: a, needs: [], sh: echo a }
+- { name: g1, scope: global, sh: echo g1 }
+- { name: g2, scope: global, needs: [], sh: echo g2 }
+`,
+			wantDAG:   true,
+			wantDeps:  [][]int{nil, {0}, {1}},
+			wantEdges: [][]int{nil, {0}, {1}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g, err := buildStepGraph(parseCmds(t, tt.yml))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if g.dag != tt.wantDAG {
+				t.Errorf("dag = %v, want %v", g.dag, tt.wantDAG)
+			}
+			if !reflect.DeepEqual(g.deps, tt.wantDeps) {
+				t.Errorf("deps = %v, want %v", g.deps, tt.wantDeps)
+			}
+			if !reflect.DeepEqual(g.edges, tt.wantEdges) {
+				t.Errorf("edges = %v, want %v", g.edges, tt.wantEdges)
+			}
+		})
+	}
+}
+
+func TestBuildStepGraphErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		yml     string
+		wantErr string
+	}{
+		{
+			name: "unknown id",
+			yml: `
+- { name: a, needs: [nope], sh: echo a }
+`,
+			wantErr: `needs: unknown id "nope"`,
+		},
+		{
+			name: "needs refers to name, not id",
+			yml: `
+- { name: a, sh: echo a }
+- { name: b, needs: [a], sh: echo b }
+`,
+			wantErr: `needs: unknown id "a"`,
+		},
+		{
+			name: "duplicate id",
+			yml: `
+- { name: a, id: x, sh: echo a }
+- { name: b, id: x, sh: echo b }
+`,
+			wantErr: `id: duplicate "x" (also on step a)`,
+		},
+		{
+			name: "cycle",
+			yml: `
+- { name: first, id: a, needs: [c], sh: echo a }
+- { name: second, id: b, needs: [a], sh: echo b }
+- { name: third, id: c, needs: [b], sh: echo c }
+`,
+			wantErr: "needs: dependency cycle: first (a) -> second (b) -> third (c) -> first (a)",
+		},
+		{
+			name: "cycle through implicit order",
+			yml: `
+- { name: a, id: a, needs: [b], sh: echo a }
+- { name: b, id: b, sh: echo b }
+`,
+			wantErr: "needs: dependency cycle: a -> b -> a",
+		},
+		{
+			name: "needs a step after the global barrier",
+			yml: `
+- { name: a, id: a, needs: [late], sh: echo a }
+- { name: agg, scope: global, sh: echo g }
+- { name: late, id: late, needs: [], sh: echo l }
+`,
+			wantErr: "needs: dependency cycle:",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := buildStepGraph(parseCmds(t, tt.yml))
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("err = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestDagNeedsDescShowsNames(t *testing.T) {
+	cmds := parseCmds(t, `
+- { name: s3-check, id: s3, needs: [], sh: echo a }
+- { name: cfn-check, id: cfn-check, needs: [], sh: echo b }
+- { name: report, needs: [s3, cfn-check], sh: echo c }
+`)
+	g, err := buildStepGraph(cmds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := dagNeedsDesc(cmds, g, 2, 0, len(cmds)), "s3-check (s3), cfn-check"; got != want {
+		t.Errorf("needs = %q, want %q", got, want)
+	}
+	if got := dagNeedsDesc(cmds, g, 0, 0, len(cmds)); got != "-" {
+		t.Errorf("needs = %q, want -", got)
+	}
+}
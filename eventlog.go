@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"os/exec"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// event は tmp/log/<RUN_ID>.jsonl に1行ずつ書く構造化ログ。
+// すべてのイベントに run_id / profile / region / step を付ける（run 単位のものは profile なし）。
+type event struct {
+	Time    string `json:"time"`
+	Event   string `json:"event"` // run_start / sts / step_start / step_plan / step_end / poll / skip / break / capture / if / switch / out / wave / on_failure / finally / run_end
+	RunID   string `json:"run_id"`
+	Profile string `json:"profile,omitempty"`
+	Region  string `json:"region,omitempty"`
+	Step    string `json:"step,omitempty"` // cmd ツリー上のパス: parent/ok/child, loop[0]
+
+	Status     string            `json:"status,omitempty"` // ok / ng / skip / wait(poll)
+	Account    string            `json:"account,omitempty"`
+	Argv       []string          `json:"argv,omitempty"`
+	Sh         string            `json:"sh,omitempty"`
+	In         string            `json:"in,omitempty"`
+	ExitCode   *int              `json:"exit_code,omitempty"`
+	DurationMs *int64            `json:"duration_ms,omitempty"`
+	Captures   map[string]string `json:"captures,omitempty"`
+	IfResult   *bool             `json:"if_result,omitempty"`
+	Case       string            `json:"case,omitempty"` // switch の分岐先（case:<key> / default）
+	Poll       int               `json:"poll,omitempty"` // until の試行回数
+	Wave       int               `json:"wave,omitempty"` // rollout の wave（1 始まり）
+	Out        string            `json:"out,omitempty"`
+	Reason     string            `json:"reason,omitempty"` // skip（when）/ break（break_if）の理由、wave の結果、protect の確認方法
+	Error      string            `json:"error,omitempty"`
+
+	Config    string   `json:"config,omitempty"`
+	Profiles  []string `json:"profiles,omitempty"`
+	Protected []string `json:"protected,omitempty"` // run_start: protect に一致した profile（Reason に確認方法）
+	DryRun    bool     `json:"dry_run,omitempty"`
+}
+
+type eventLog struct {
+	mu     sync.Mutex
+	w      io.Writer
+	runID  string
+	region string
+}
+
+func newEventLog(w io.Writer, runID, region string) *eventLog {
+	return &eventLog{w: w, runID: runID, region: region}
+}
+
+// emit は共通フィールドを埋めて1行書く。書き込み失敗は実行を止めない。
+// secrets は JSON にする前に文字列のフィールドごとに置換する
+// （行全体を置換すると、数字だけのシークレットが duration_ms などの数値を *** にして JSON が壊れる）。
+func (l *eventLog) emit(ev event) {
+	if l == nil {
+		return
+	}
+	maskEvent(&ev) // time / run_id は necro が付ける値なので置換しない
+	ev.Time = time.Now().Format(time.RFC3339Nano)
+	ev.RunID = l.runID
+	if ev.Region == "" && ev.Profile != "" {
+		ev.Region = l.region
+	}
+
+	b, err := json.Marshal(ev)
+	if err != nil {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, _ = l.w.Write(append(b, '\n'))
+}
+
+// maskEvent は event の文字列（string / []string / map の値）の secrets を *** にする。
+func maskEvent(ev *event) {
+	v := reflect.ValueOf(ev).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		f := v.Field(i)
+		switch {
+		case f.Kind() == reflect.String:
+			f.SetString(secretValues.mask(f.String()))
+		case f.Kind() == reflect.Slice && f.Type().Elem().Kind() == reflect.String:
+			if f.IsNil() {
+				continue
+			}
+			masked := reflect.MakeSlice(f.Type(), f.Len(), f.Len())
+			for j := 0; j < f.Len(); j++ {
+				masked.Index(j).SetString(secretValues.mask(f.Index(j).String()))
+			}
+			f.Set(masked)
+		case f.Kind() == reflect.Map && f.Type().Elem().Kind() == reflect.String:
+			if f.IsNil() {
+				continue
+			}
+			masked := reflect.MakeMapWithSize(f.Type(), f.Len())
+			for _, k := range f.MapKeys() {
+				masked.SetMapIndex(k, reflect.ValueOf(secretValues.mask(f.MapIndex(k).String())))
+			}
+			f.Set(masked)
+		}
+	}
+}
+
+func openEventLog(path, runID, region string) (*eventLog, *os.File, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	return newEventLog(f, runID, region), f, nil
+}
+
+func durationMs(d time.Duration) *int64 {
+	ms := d.Milliseconds()
+	return &ms
+}
+
+func exitCodeOf(err error) *int {
+	code := 0
+	if err != nil {
+		code = -1
+		var ee *exec.ExitError
+		if errors.As(err, &ee) {
+			code = ee.ExitCode()
+		}
+	}
+	return &code
+}
+
+func boolPtr(b bool) *bool {
+	return &b
+}
+
+func errString(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
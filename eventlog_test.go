@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestEventLogMasksSecretsAsValidJSON(t *testing.T) {
+	orig := secretValues
+	t.Cleanup(func() { secretValues = orig })
+	secretValues = &secretSet{}
+
+	secrets := []string{
+		"tok-12345",
+		`p"a\ss`,     // JSON ではエスケープされる
+		`ends-with\`, // 末尾のバックスラッシュ
+		"<a&b>",      // json.Marshal は < などにする
+		"-----BEGIN KEY-----\nMIIabc\\def\n-----END KEY-----",
+	}
+	for _, s := range secrets {
+		secretValues.add(s)
+	}
+
+	var buf bytes.Buffer
+	l := newEventLog(&buf, "run-1", "ap-northeast-1")
+	for _, s := range secrets {
+		l.emit(event{
+			Event:    "step_start",
+			Profile:  "COM_DEV",
+			Step:     "deploy",
+			Sh:       "curl -H 'Authorization: " + s + "' https://example.com",
+			Argv:     []string{"--token", s},
+			Captures: map[string]string{"TOKEN": s, "NOTE": "not secret"},
+			Error:    "failed: " + s,
+		})
+	}
+
+	lines := strings.Split(strings.TrimRight(buf.String(), "\n"), "\n")
+	if len(lines) != len(secrets) {
+		t.Fatalf("lines = %d, want %d", len(lines), len(secrets))
+	}
+	for i, line := range lines {
+		var ev event
+		if err := json.Unmarshal([]byte(line), &ev); err != nil {
+			t.Fatalf("line %d is not valid JSON: %v\n%s", i, err, line)
+		}
+		if ev.RunID != "run-1" || ev.Region != "ap-northeast-1" || ev.Time == "" {
+			t.Errorf("line %d: common fields = %+v", i, ev)
+		}
+		want := map[string]string{
+			"sh":      "curl -H 'Authorization: ***' https://example.com",
+			"argv":    "--token ***",
+			"capture": "***",
+			"note":    "not secret",
+			"error":   "failed: ***",
+		}
+		got := map[string]string{
+			"sh":      ev.Sh,
+			"argv":    strings.Join(ev.Argv, " "),
+			"capture": ev.Captures["TOKEN"],
+			"note":    ev.Captures["NOTE"],
+			"error":   ev.Error,
+		}
+		for k, w := range want {
+			if got[k] != w {
+				t.Errorf("line %d (%q): %s = %q, want %q", i, secrets[i], k, got[k], w)
+			}
+		}
+	}
+}
+
+func TestEventLogNumericSecretKeepsNumbers(t *testing.T) {
+	orig := secretValues
+	t.Cleanup(func() { secretValues = orig })
+	secretValues = &secretSet{}
+	secretValues.add("2024")
+
+	var buf bytes.Buffer
+	l := newEventLog(&buf, "20241018-120000-000-abcdef", "ap-northeast-1")
+	code := 2024
+	ms := int64(12024)
+	captures := map[string]string{"PIN": "2024"}
+	l.emit(event{Event: "step_end", Profile: "COM_DEV", ExitCode: &code, DurationMs: &ms, Poll: 2024, Captures: captures, Error: "pin 2024 rejected"})
+
+	var ev event
+	if err := json.Unmarshal(buf.Bytes(), &ev); err != nil {
+		t.Fatalf("not valid JSON: %v\n%s", err, buf.String())
+	}
+	if *ev.ExitCode != 2024 || *ev.DurationMs != 12024 || ev.Poll != 2024 || ev.RunID != "20241018-120000-000-abcdef" {
+		t.Errorf("numbers changed: %s", buf.String())
+	}
+	if ev.Captures["PIN"] != "***" || ev.Error != "pin *** rejected" {
+		t.Errorf("strings not masked: %s", buf.String())
+	}
+	if captures["PIN"] != "2024" {
+		t.Errorf("caller's map was modified: %v", captures)
+	}
+}
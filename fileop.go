@@ -0,0 +1,189 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// FileBlock はシェルを使わないファイル操作ステップ（どの OS でも同じ動作）。
+//
+//	cmd:
+//	  - name: out-dir
+//	    file: { op: mkdir, dst: "./tmp/out/{{ .PROFILE }}" }
+//	  - name: concat
+//	    file: { op: append, src: "./tmp/out/{{ .PROFILE }}/part.txt", dst: ./tmp/out/all.txt }
+//
+// src / dst / content はテンプレート展開される。
+type FileBlock struct {
+	Op      string `yaml:"op"`                // write / append / copy / mkdir / rm
+	Src     string `yaml:"src,omitempty"`     // copy: コピー元 / append: 追記する内容のファイル
+	Dst     string `yaml:"dst"`               // 対象パス
+	Content string `yaml:"content,omitempty"` // write / append の内容
+}
+
+// checkFileOp は op が対応しているかを確認する（読み込み時 / 実行時）。
+// テンプレートファイルからの生成は file ではなく render ステップで行う。
+func checkFileOp(op string) error {
+	switch strings.ToLower(strings.TrimSpace(op)) {
+	case "write", "append", "copy", "mkdir", "rm":
+		return nil
+	case "template":
+		return fmt.Errorf("file: op template is not supported: use a render step (render: { template: <file> }, out: <dst>)")
+	default:
+		return fmt.Errorf("file: unsupported op: %s (write/append/copy/mkdir/rm)", op)
+	}
+}
+
+// renderFileBlock は src / dst / content を展開し、op に必要な項目を検証する。
+func renderFileBlock(fb *FileBlock, ctx map[string]string) (FileBlock, error) {
+	out := FileBlock{Op: strings.ToLower(strings.TrimSpace(fb.Op))}
+	if err := checkFileOp(out.Op); err != nil {
+		return out, err
+	}
+
+	var err error
+	if out.Src, _, err = renderTemplateString(fb.Src, ctx); err != nil {
+		return out, fmt.Errorf("file: src: %w", err)
+	}
+	if out.Dst, _, err = renderTemplateString(fb.Dst, ctx); err != nil {
+		return out, fmt.Errorf("file: dst: %w", err)
+	}
+	if out.Content, _, err = renderTemplateString(fb.Content, ctx); err != nil {
+		return out, fmt.Errorf("file: content: %w", err)
+	}
+
+	if strings.TrimSpace(out.Dst) == "" {
+		return out, fmt.Errorf("file %s: dst is required", out.Op)
+	}
+	switch out.Op {
+	case "write", "mkdir":
+	case "append":
+		if out.Src != "" && out.Content != "" {
+			return out, fmt.Errorf("file append: use either src or content")
+		}
+	case "copy":
+		if strings.TrimSpace(out.Src) == "" {
+			return out, fmt.Errorf("file copy: src is required")
+		}
+	case "rm":
+		if err := checkRmPath(out.Dst); err != nil {
+			return out, err
+		}
+	}
+	return out, nil
+}
+
+// checkRmPath は rm の対象を作業ディレクトリ配下に限る（/ や作業ディレクトリ自体、外側は消さない）。
+// glob は展開しないので、* などを含むパスもエラーにする。
+func checkRmPath(dst string) error {
+	if strings.ContainsAny(dst, "*?[") {
+		return fmt.Errorf("file rm: glob is not supported: %q", dst)
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		return fmt.Errorf("file rm: %w", err)
+	}
+	abs, err := filepath.Abs(dst)
+	if err != nil {
+		return fmt.Errorf("file rm: %w", err)
+	}
+	rel, err := filepath.Rel(wd, abs)
+	if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return fmt.Errorf("file rm: refusing to remove %q (outside the working directory)", dst)
+	}
+	return nil
+}
+
+// desc は FILE PLAN / FILE OK の表示。
+func (fb FileBlock) desc() string {
+	s := "op=" + fb.Op
+	if fb.Src != "" {
+		s += " | src=" + fb.Src
+	}
+	s += " | dst=" + fb.Dst
+	if fb.Content != "" {
+		s += fmt.Sprintf(" | content=%dB", len(fb.Content))
+	}
+	return s
+}
+
+// runFileOp は展開済みの FileBlock を実行する。
+func runFileOp(fb FileBlock) error {
+	switch fb.Op {
+	case "mkdir":
+		return os.MkdirAll(fb.Dst, 0755)
+
+	case "write":
+		return writeFileMkdir(fb.Dst, []byte(fb.Content), 0644)
+
+	case "append":
+		data := []byte(fb.Content)
+		if fb.Src != "" {
+			b, err := os.ReadFile(fb.Src)
+			if err != nil {
+				return fmt.Errorf("file append: src read failed: %w", err)
+			}
+			data = b
+		}
+		if dir := filepath.Dir(fb.Dst); dir != "." && dir != "" {
+			if err := os.MkdirAll(dir, 0755); err != nil {
+				return err
+			}
+		}
+		f, err := os.OpenFile(fb.Dst, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return err
+		}
+		if _, err := f.Write(data); err != nil {
+			f.Close()
+			return err
+		}
+		return f.Close()
+
+	case "copy":
+		dst := fb.Dst
+		// dst が既存ディレクトリ、または / で終わる場合はその中へ
+		if st, err := os.Stat(dst); (err == nil && st.IsDir()) || strings.HasSuffix(fb.Dst, "/") || strings.HasSuffix(fb.Dst, `\`) {
+			dst = filepath.Join(dst, filepath.Base(fb.Src))
+		}
+		return copyFile(fb.Src, dst)
+
+	case "rm":
+		return os.RemoveAll(fb.Dst)
+	}
+	return fmt.Errorf("file: unsupported op: %s", fb.Op)
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return fmt.Errorf("file copy: %w", err)
+	}
+	defer in.Close()
+
+	st, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	if st.IsDir() {
+		return fmt.Errorf("file copy: src is a directory: %s", src)
+	}
+
+	if dir := filepath.Dir(dst); dir != "." && dir != "" {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+	}
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, st.Mode().Perm())
+	if err != nil {
+		return fmt.Errorf("file copy: %w", err)
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return fmt.Errorf("file copy: %w", err)
+	}
+	return out.Close()
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCheckFileOp(t *testing.T) {
+	tests := []struct {
+		op      string
+		wantErr string
+	}{
+		{"write", ""},
+		{" Append ", ""},
+		{"COPY", ""},
+		{"mkdir", ""},
+		{"rm", ""},
+		{"template", "use a render step"},
+		{"mv", "file: unsupported op: mv"},
+		{"", "file: unsupported op: "},
+	}
+	for _, tt := range tests {
+		err := checkFileOp(tt.op)
+		if tt.wantErr == "" {
+			if err != nil {
+				t.Errorf("checkFileOp(%q) = %v", tt.op, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("checkFileOp(%q) = %v, want %q", tt.op, err, tt.wantErr)
+		}
+	}
+}
+
+func TestRenderFileBlock(t *testing.T) {
+	dir := t.TempDir()
+	t.Chdir(dir)
+	outside := t.TempDir()
+
+	ctx := map[string]string{"PROFILE": "COM_DEV", "WD": dir, "EMPTY": ""}
+	tests := []struct {
+		name    string
+		fb      FileBlock
+		want    FileBlock
+		wantErr string
+	}{
+		{
+			name: "templates are expanded",
+			fb:   FileBlock{Op: "Write", Dst: "./tmp/{{ .PROFILE }}.txt", Content: "p={{ .PROFILE }}"},
+			want: FileBlock{Op: "write", Dst: "./tmp/COM_DEV.txt", Content: "p=COM_DEV"},
+		},
+		{name: "dst is required", fb: FileBlock{Op: "mkdir", Dst: " "}, wantErr: "file mkdir: dst is required"},
+		{name: "append src and content", fb: FileBlock{Op: "append", Src: "a", Content: "b", Dst: "c"}, wantErr: "use either src or content"},
+		{name: "copy without src", fb: FileBlock{Op: "copy", Dst: "c"}, wantErr: "file copy: src is required"},
+		{name: "undefined variable", fb: FileBlock{Op: "write", Dst: "{{ .NOPE }}"}, wantErr: "file: dst:"},
+
+		// rm の安全確認
+		{name: "rm inside the working directory", fb: FileBlock{Op: "rm", Dst: "./tmp/{{ .PROFILE }}"}, want: FileBlock{Op: "rm", Dst: "./tmp/COM_DEV"}},
+		{name: "rm absolute path inside", fb: FileBlock{Op: "rm", Dst: "{{ .WD }}/tmp"}, want: FileBlock{Op: "rm", Dst: dir + "/tmp"}},
+		{name: "rm empty path", fb: FileBlock{Op: "rm", Dst: ""}, wantErr: "file rm: dst is required"},
+		{name: "rm empty after template", fb: FileBlock{Op: "rm", Dst: "{{ .EMPTY }}"}, wantErr: "file rm: dst is required"},
+		{name: "rm root", fb: FileBlock{Op: "rm", Dst: "/"}, wantErr: "file rm: refusing to remove \"/\""},
+		{name: "rm working directory", fb: FileBlock{Op: "rm", Dst: "."}, wantErr: "file rm: refusing to remove \".\""},
+		{name: "rm working directory by absolute path", fb: FileBlock{Op: "rm", Dst: "{{ .WD }}"}, wantErr: "outside the working directory"},
+		{name: "rm parent", fb: FileBlock{Op: "rm", Dst: "./tmp/../.."}, wantErr: "outside the working directory"},
+		{name: "rm outside", fb: FileBlock{Op: "rm", Dst: outside}, wantErr: "outside the working directory"},
+		{name: "rm glob", fb: FileBlock{Op: "rm", Dst: "./tmp/*.txt"}, wantErr: "file rm: glob is not supported"},
+		{name: "rm glob class", fb: FileBlock{Op: "rm", Dst: "./tmp/[ab]"}, wantErr: "file rm: glob is not supported"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := renderFileBlock(&tt.fb, ctx)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRunFileOp(t *testing.T) {
+	dir := t.TempDir()
+	t.Chdir(dir)
+
+	read := func(p string) string {
+		t.Helper()
+		b, err := os.ReadFile(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(b)
+	}
+	run := func(fb FileBlock) {
+		t.Helper()
+		if err := runFileOp(fb); err != nil {
+			t.Fatalf("%s: %v", fb.desc(), err)
+		}
+	}
+
+	// mkdir は途中のディレクトリも作る
+	run(FileBlock{Op: "mkdir", Dst: "tmp/out/COM_DEV"})
+	if st, err := os.Stat("tmp/out/COM_DEV"); err != nil || !st.IsDir() {
+		t.Fatalf("mkdir: %v", err)
+	}
+	run(FileBlock{Op: "mkdir", Dst: "tmp/out/COM_DEV"}) // 既にあっても OK
+
+	// write / append は親ディレクトリを作る
+	run(FileBlock{Op: "write", Dst: "tmp/new/part.txt", Content: "a\n"})
+	run(FileBlock{Op: "append", Dst: "tmp/new/all.txt", Content: "head\n"})
+	run(FileBlock{Op: "append", Src: "tmp/new/part.txt", Dst: "tmp/new/all.txt"})
+	if got := read("tmp/new/all.txt"); got != "head\na\n" {
+		t.Errorf("append = %q", got)
+	}
+	run(FileBlock{Op: "write", Dst: "tmp/new/part.txt", Content: "b\n"})
+	if got := read("tmp/new/part.txt"); got != "b\n" {
+		t.Errorf("write = %q, want overwritten", got)
+	}
+
+	// copy: ファイルへ / 既存ディレクトリの中へ / 末尾 / で新しいディレクトリの中へ
+	if err := os.Chmod("tmp/new/part.txt", 0o600); err != nil {
+		t.Fatal(err)
+	}
+	run(FileBlock{Op: "copy", Src: "tmp/new/part.txt", Dst: "tmp/copy.txt"})
+	run(FileBlock{Op: "copy", Src: "tmp/new/part.txt", Dst: "tmp/out"})
+	run(FileBlock{Op: "copy", Src: "tmp/new/part.txt", Dst: "tmp/dir/"})
+	for _, p := range []string{"tmp/copy.txt", "tmp/out/part.txt", "tmp/dir/part.txt"} {
+		if got := read(p); got != "b\n" {
+			t.Errorf("copy %s = %q", p, got)
+		}
+	}
+	if st, err := os.Stat("tmp/copy.txt"); err != nil || st.Mode().Perm() != 0o600 {
+		t.Errorf("copy did not keep the mode: %v %v", st.Mode(), err)
+	}
+
+	// rm はディレクトリごと消す。無くてもエラーにしない
+	run(FileBlock{Op: "rm", Dst: "tmp/new"})
+	if _, err := os.Stat("tmp/new"); !os.IsNotExist(err) {
+		t.Errorf("rm: %v", err)
+	}
+	run(FileBlock{Op: "rm", Dst: "tmp/new"})
+
+	errTests := []struct {
+		name    string
+		fb      FileBlock
+		wantErr string
+	}{
+		{"copy missing src", FileBlock{Op: "copy", Src: "nope.txt", Dst: "x.txt"}, "file copy:"},
+		{"copy directory", FileBlock{Op: "copy", Src: "tmp/out", Dst: "x"}, "file copy: src is a directory"},
+		{"append missing src", FileBlock{Op: "append", Src: "nope.txt", Dst: "x.txt"}, "file append: src read failed"},
+	}
+	for _, tt := range errTests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := runFileOp(tt.fb); err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("err = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+	if _, err := os.Stat(filepath.Join(dir, "x.txt")); !os.IsNotExist(err) {
+		t.Errorf("failed op created x.txt")
+	}
+}
@@ -0,0 +1,571 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	gojmespath "github.com/jmespath/go-jmespath"
+	"gopkg.in/yaml.v3"
+)
+
+// ForEachBlock はステップを要素ごとに繰り返す。
+//
+//	cmd:
+//	  - name: account-check
+//	    sh: echo "{{ .ACC.profile }} ({{ .I }})"
+//	    foreach:
+//	      items_from: ./tmp/out/accounts.jsonl
+//	      as: ACC
+//	      index: I
+//	      filter: "system == 'necro'"
+//	      break_if: { var: FOUND, op: exists }
+//	      parallel: 5                        # 同時に5要素まで（出力は要素の順に表示）
+//	      on_error: collect                  # 全要素を実行してから NG（既定 stop）
+//	      collect: { RESULTS: "{status: Status, id: Id}" }
+//
+// 要素の元（どれか1つ）:
+//   - var:        ctx の JSON 配列、または JSON オブジェクト（要素は {key, value}）
+//   - items:      YAML のリテラル配列
+//   - items_from: JSON（配列 / オブジェクト）または NDJSON ファイル
+//   - range:      整数の範囲 "1..5" / { from, to, step }（to を含む）
+//
+// 要素がオブジェクトなら as には JSON が入り、テンプレートでは {{ .ACC.profile }} で参照できる。
+type ForEachBlock struct {
+	Var       string        `yaml:"var,omitempty"`        // ctx にある配列 / オブジェクト(JSON文字列)
+	Items     []any         `yaml:"items,omitempty"`      // リテラル配列
+	ItemsFrom string        `yaml:"items_from,omitempty"` // JSON / NDJSON ファイル（テンプレート可）
+	Range     *ForEachRange `yaml:"range,omitempty"`      // 整数の範囲
+
+	As    string `yaml:"as"`              // ループ内で使う変数名
+	Index string `yaml:"index,omitempty"` // 要素の位置（0始まり）を入れる変数名
+
+	Filter  string     `yaml:"filter,omitempty"`   // 要素への JMESPath。false / null / 空なら実行しない
+	BreakIf *Condition `yaml:"break_if,omitempty"` // 各要素の実行後に評価し、成り立てば以降を実行しない
+
+	Parallel int    `yaml:"parallel,omitempty"` // 同時に実行する要素数（既定 1 = 順番に）
+	OnError  string `yaml:"on_error,omitempty"` // stop(default): 最初の失敗で止める / collect: 全要素を実行してまとめて NG
+
+	// collect: 変数名 -> 各要素の LAST_JSON への JMESPath。結果を JSON 配列にして親の ctx に入れる
+	Collect map[string]string `yaml:"collect,omitempty"`
+
+	collectPaths map[string]*gojmespath.JMESPath // 読み込み時にコンパイルした collect
+}
+
+// ForEachRange は from から to まで（to を含む）の整数。値はテンプレート可。
+type ForEachRange struct {
+	From string `yaml:"from"`
+	To   string `yaml:"to"`
+	Step string `yaml:"step,omitempty"`
+}
+
+func (r *ForEachRange) UnmarshalYAML(n *yaml.Node) error {
+	if n.Kind == yaml.ScalarNode {
+		from, to, ok := strings.Cut(n.Value, "..")
+		if !ok {
+			return fmt.Errorf("line %d: foreach range: expected \"from..to\" or { from, to, step }, got %q", n.Line, n.Value)
+		}
+		r.From, r.To = strings.TrimSpace(from), strings.TrimSpace(to)
+		return nil
+	}
+	type plain ForEachRange
+	return n.Decode((*plain)(r))
+}
+
+func (fb *ForEachBlock) UnmarshalYAML(n *yaml.Node) error {
+	type plain ForEachBlock
+	if err := n.Decode((*plain)(fb)); err != nil {
+		return err
+	}
+
+	sources := 0
+	for _, set := range []bool{fb.Var != "", fb.Items != nil, fb.ItemsFrom != "", fb.Range != nil} {
+		if set {
+			sources++
+		}
+	}
+	if sources != 1 {
+		return fmt.Errorf("line %d: foreach requires exactly one of var / items / items_from / range", n.Line)
+	}
+	if fb.As == "" {
+		return fmt.Errorf("line %d: foreach requires as", n.Line)
+	}
+	if isBuiltInKey(fb.As) || isBuiltInKey(fb.Index) {
+		return fmt.Errorf("line %d: foreach: cannot bind built-in variable", n.Line)
+	}
+	fb.collectPaths = make(map[string]*gojmespath.JMESPath, len(fb.Collect))
+	for k, expr := range fb.Collect {
+		if isBuiltInKey(k) {
+			return fmt.Errorf("line %d: foreach collect: cannot override built-in variable: %s", n.Line, k)
+		}
+		p, err := gojmespath.Compile(expr)
+		if err != nil {
+			return fmt.Errorf("line %d: foreach collect %s: invalid expr %q: %v", n.Line, k, expr, err)
+		}
+		fb.collectPaths[k] = p
+	}
+	if fb.Parallel < 0 {
+		return fmt.Errorf("line %d: foreach parallel must be >= 1", n.Line)
+	}
+	switch fb.onError() {
+	case "stop", "collect":
+	default:
+		return fmt.Errorf("line %d: foreach on_error: unsupported value %q (stop / collect)", n.Line, fb.OnError)
+	}
+	return nil
+}
+
+func (fb *ForEachBlock) onError() string {
+	s := strings.ToLower(strings.TrimSpace(fb.OnError))
+	if s == "" {
+		return "stop"
+	}
+	return s
+}
+
+func (fb *ForEachBlock) collectErrors() bool {
+	return fb.onError() == "collect"
+}
+
+// sourceDesc はログ / エラー用の要素の元。
+func (fb *ForEachBlock) sourceDesc() string {
+	switch {
+	case fb.Var != "":
+		return "var=" + fb.Var
+	case fb.Items != nil:
+		return "items"
+	case fb.ItemsFrom != "":
+		return "items_from=" + fb.ItemsFrom
+	default:
+		return fmt.Sprintf("range=%s..%s", fb.Range.From, fb.Range.To)
+	}
+}
+
+// items は繰り返す要素を返す。JSON オブジェクトはキー順の {key, value} の配列にする。
+func (fb *ForEachBlock) items(ctx map[string]string) ([]any, error) {
+	switch {
+	case fb.Var != "":
+		raw, ok := ctx[fb.Var]
+		if !ok {
+			return nil, fmt.Errorf("foreach: undefined variable: %s", fb.Var)
+		}
+		var v any
+		if err := json.Unmarshal([]byte(raw), &v); err != nil {
+			return nil, fmt.Errorf("foreach: variable %s is not JSON array or object", fb.Var)
+		}
+		return foreachList(v, "variable "+fb.Var)
+
+	case fb.Items != nil:
+		out := make([]any, len(fb.Items))
+		for i, it := range fb.Items {
+			r, err := renderConditionValue(normalizeJSON(it), ctx)
+			if err != nil {
+				return nil, fmt.Errorf("foreach items[%d]: %w", i, err)
+			}
+			out[i] = r
+		}
+		return out, nil
+
+	case fb.ItemsFrom != "":
+		p, _, err := renderTemplateString(fb.ItemsFrom, ctx)
+		if err != nil {
+			return nil, fmt.Errorf("foreach items_from: %w", err)
+		}
+		return readForEachFile(p)
+
+	default:
+		return fb.Range.values(ctx)
+	}
+}
+
+// foreachList は JSON の配列はそのまま、オブジェクトは {key, value} の配列にする。
+func foreachList(v any, what string) ([]any, error) {
+	switch t := v.(type) {
+	case []any:
+		return t, nil
+	case map[string]any:
+		keys := make([]string, 0, len(t))
+		for k := range t {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		out := make([]any, len(keys))
+		for i, k := range keys {
+			out[i] = map[string]any{"key": k, "value": t[k]}
+		}
+		return out, nil
+	default:
+		return nil, fmt.Errorf("foreach: %s is not JSON array or object", what)
+	}
+}
+
+// readForEachFile は JSON（配列 / オブジェクト）または NDJSON（.jsonl / .ndjson、または1行1 JSON）を読む。
+func readForEachFile(p string) ([]any, error) {
+	b, err := os.ReadFile(p)
+	if err != nil {
+		return nil, fmt.Errorf("foreach items_from: %w", err)
+	}
+
+	ext := strings.ToLower(filepath.Ext(p))
+	if ext != ".jsonl" && ext != ".ndjson" {
+		var v any
+		if err := json.Unmarshal(b, &v); err == nil {
+			return foreachList(v, p)
+		}
+	}
+
+	var out []any
+	sc := bufio.NewScanner(bytes.NewReader(b))
+	sc.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+	for line := 1; sc.Scan(); line++ {
+		s := strings.TrimSpace(sc.Text())
+		if s == "" {
+			continue
+		}
+		var v any
+		if err := json.Unmarshal([]byte(s), &v); err != nil {
+			return nil, fmt.Errorf("foreach items_from: %s:%d: invalid JSON: %w", p, line, err)
+		}
+		out = append(out, v)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, fmt.Errorf("foreach items_from: %s: %w", p, err)
+	}
+	return out, nil
+}
+
+// values は範囲の整数を返す（step の既定は 1、from > to なら -1）。
+func (r *ForEachRange) values(ctx map[string]string) ([]any, error) {
+	num := func(name, s string) (int, error) {
+		v, _, err := renderTemplateString(s, ctx)
+		if err != nil {
+			return 0, fmt.Errorf("foreach range %s: %w", name, err)
+		}
+		n, err := strconv.Atoi(strings.TrimSpace(v))
+		if err != nil {
+			return 0, fmt.Errorf("foreach range %s: not an integer: %q", name, v)
+		}
+		return n, nil
+	}
+
+	from, err := num("from", r.From)
+	if err != nil {
+		return nil, err
+	}
+	to, err := num("to", r.To)
+	if err != nil {
+		return nil, err
+	}
+	step := 1
+	if from > to {
+		step = -1
+	}
+	if strings.TrimSpace(r.Step) != "" {
+		if step, err = num("step", r.Step); err != nil {
+			return nil, err
+		}
+	}
+	if step == 0 || (from < to && step < 0) || (from > to && step > 0) {
+		return nil, fmt.Errorf("foreach range: step %d never reaches %d from %d", step, to, from)
+	}
+
+	var out []any
+	for i := from; (step > 0 && i <= to) || (step < 0 && i >= to); i += step {
+		out = append(out, i)
+	}
+	return out, nil
+}
+
+// keep は filter（要素への JMESPath）の結果が truthy か。
+func (fb *ForEachBlock) keep(item any) (bool, error) {
+	if strings.TrimSpace(fb.Filter) == "" {
+		return true, nil
+	}
+	// range の値（int）は JSON の数値と同じ float64 で比較する
+	if n, ok := item.(int); ok {
+		item = float64(n)
+	}
+	v, err := gojmespath.Search(fb.Filter, item)
+	if err != nil {
+		return false, fmt.Errorf("foreach: invalid filter %q: %w", fb.Filter, err)
+	}
+	if b, ok := v.(bool); ok {
+		return b, nil
+	}
+	return !isEmptyValue(v), nil
+}
+
+// foreachIter は1要素分の実行（並列時は出力と LAST_JSON を分けて持つ）。
+type foreachIter struct {
+	index int
+	path  string
+	ctx   map[string]string
+
+	env     *runEnv
+	out     *lockedBuffer
+	done    chan struct{}
+	started bool
+	err     error
+	stop    bool           // break_if が成り立った
+	values  map[string]any // collect の値
+}
+
+// runForEach は要素ごとに foreach を外したステップを実行する。
+// index（と step のパス loop[i]）は filter で除いた要素も数えた元の位置。
+func runForEach(env *runEnv, profile, path string, ctx map[string]string, c Cmd) error {
+	fb := c.ForEach
+	mw := env.mw
+
+	// setup の変数は実行時に決まるので、ここで確認する
+	if env.isReadOnlyKey(fb.As) || env.isReadOnlyKey(fb.Index) {
+		fmt.Fprintf(mw, "❌ FOREACH NG | %s | profile=%s\n", c.Name, profile)
+		return fmt.Errorf("foreach: cannot bind built-in / setup variable: %s", strings.TrimSpace(fb.As+" "+fb.Index))
+	}
+	for k := range fb.Collect {
+		if env.isReadOnlyKey(k) {
+			fmt.Fprintf(mw, "❌ COLLECT NG | %s | profile=%s\n", c.Name, profile)
+			return fmt.Errorf("foreach collect: cannot override setup variable: %s", k)
+		}
+	}
+
+	items, err := fb.items(ctx)
+	if err != nil {
+		fmt.Fprintf(mw, "❌ FOREACH NG | %s | profile=%s | %s\n", c.Name, profile, fb.sourceDesc())
+		return err
+	}
+
+	// IMPORTANT:
+	// Copy the entire command so that Aws/Sh/In/Out/Run/etc are preserved.
+	// Only remove ForEach to avoid infinite recursion.
+	childCmd := c
+	childCmd.ForEach = nil
+	childCmd.With = nil
+	childCmd.When = nil
+
+	var iters []*foreachIter
+	for i, item := range items {
+		ok, err := fb.keep(item)
+		if err != nil {
+			fmt.Fprintf(mw, "❌ FOREACH NG | %s | profile=%s | %s\n", c.Name, profile, fb.sourceDesc())
+			return err
+		}
+		if !ok {
+			continue
+		}
+
+		childCtx := copyMap(ctx)
+		childCtx[fb.As] = textValue(item)
+		if fb.Index != "" {
+			childCtx[fb.Index] = strconv.Itoa(i)
+		}
+		iters = append(iters, &foreachIter{index: i, path: fmt.Sprintf("%s[%d]", path, i), ctx: childCtx})
+	}
+
+	if fb.Parallel > 1 && len(iters) > 1 {
+		return runForEachParallel(env, profile, path, ctx, c, childCmd, iters)
+	}
+
+	var errs []error
+	for _, it := range iters {
+		it.started = true
+		if err := runForEachIter(env, profile, c, childCmd, it); err != nil {
+			it.err = err
+			// Ctrl-C は on_error: collect でも残りの要素を実行しない
+			if !fb.collectErrors() || errors.Is(err, errInterrupted) {
+				return err
+			}
+			errs = append(errs, fmt.Errorf("[%d]: %w", it.index, err))
+			continue
+		}
+		if it.stop {
+			break
+		}
+	}
+	if err := applyCollect(env, profile, path, c, ctx, iters); err != nil {
+		return err
+	}
+	return foreachErrors(errs, len(iters))
+}
+
+// runForEachIter は1要素を実行し、break_if を評価する。
+func runForEachIter(env *runEnv, profile string, c, childCmd Cmd, it *foreachIter) error {
+	fb := c.ForEach
+	if err := env.checkInterrupted(); err != nil {
+		return err
+	}
+	if err := runCmdTreeForProfile(env, profile, it.path, it.ctx, childCmd); err != nil {
+		return err
+	}
+
+	// dry-run では実行結果が無いので collect / break_if は評価しない
+	if env.dryRun {
+		return nil
+	}
+
+	if len(fb.Collect) > 0 {
+		last := env.lastJSON(profile)
+		if last == nil {
+			fmt.Fprintf(env.mw, "❌ COLLECT NG | %s | profile=%s\n", c.Name, profile)
+			return fmt.Errorf("collect requires JSON stdout, but LAST_JSON is nil")
+		}
+		it.values = make(map[string]any, len(fb.Collect))
+		for k, p := range fb.collectPaths {
+			v, err := p.Search(last)
+			if err != nil {
+				fmt.Fprintf(env.mw, "❌ COLLECT NG | %s | profile=%s\n", c.Name, profile)
+				return fmt.Errorf("collect %s: %q: %w", k, fb.Collect[k], err)
+			}
+			it.values[k] = v
+		}
+	}
+
+	if fb.BreakIf == nil {
+		return nil
+	}
+	stop, err := evalCondition("break_if", fb.BreakIf, it.ctx, env.lastJSON(profile))
+	if err != nil {
+		fmt.Fprintf(env.mw, "❌ FOREACH NG | %s | profile=%s | break_if\n", c.Name, profile)
+		return err
+	}
+	if stop {
+		it.stop = true
+		reason := fmt.Sprintf("break_if %s at [%d]", fb.BreakIf.String(), it.index)
+		fmt.Fprintf(env.mw, "⏹  BREAK     | %s | profile=%s | %s\n", c.Name, profile, reason)
+		env.events.emit(event{Event: "break", Profile: profile, Step: it.path, Status: "ok", Reason: reason})
+	}
+	return nil
+}
+
+// runForEachParallel は最大 parallel 個の要素を同時に実行する。
+// 各要素の出力はバッファし、要素の順に表示する（JSONL のイベントは発生順）。
+// on_error: stop なら最初の失敗（または break_if）の後は新しい要素を始めない。
+func runForEachParallel(env *runEnv, profile, path string, ctx map[string]string, c, childCmd Cmd, iters []*foreachIter) error {
+	fb := c.ForEach
+	mw := env.mw
+	collect := fb.collectErrors()
+
+	fmt.Fprintf(mw, "🔁 FOREACH   | %s | profile=%s | items=%d | parallel=%d | on_error=%s\n",
+		c.Name, profile, len(iters), fb.Parallel, fb.onError())
+
+	for _, it := range iters {
+		it.done = make(chan struct{})
+	}
+
+	var stopped atomic.Bool
+	sem := make(chan struct{}, fb.Parallel)
+	go func() {
+		for _, it := range iters {
+			sem <- struct{}{}
+			if stopped.Load() {
+				<-sem
+				close(it.done)
+				continue
+			}
+			it.started = true
+			it.out = &lockedBuffer{}
+			it.env = env.fork(it.out, profile)
+			go func(it *foreachIter) {
+				defer func() {
+					<-sem
+					close(it.done)
+				}()
+				it.err = runForEachIter(it.env, profile, c, childCmd, it)
+				if it.stop || (it.err != nil && !collect) || errors.Is(it.err, errInterrupted) {
+					stopped.Store(true)
+				}
+			}(it)
+		}
+	}()
+
+	var errs []error
+	var last *foreachIter
+	for _, it := range iters {
+		<-it.done
+		if !it.started {
+			continue
+		}
+		_, _ = mw.Write(it.out.Bytes())
+		last = it
+		if it.err != nil {
+			errs = append(errs, fmt.Errorf("[%d]: %w", it.index, it.err))
+		}
+	}
+
+	// LAST_JSON は最後の要素（index 順）のもの
+	if last != nil {
+		env.setLastJSON(profile, last.env.lastJSON(profile))
+	}
+
+	if len(errs) > 0 && !collect {
+		return errors.Unwrap(errs[0])
+	}
+	if err := applyCollect(env, profile, path, c, ctx, iters); err != nil {
+		return err
+	}
+	return foreachErrors(errs, len(iters))
+}
+
+// applyCollect は成功した要素の collect の値を index 順の JSON 配列にして親の ctx に入れる。
+// filter / break_if で実行しなかった要素と、失敗した要素（on_error: collect）は含めない。
+func applyCollect(env *runEnv, profile, path string, c Cmd, ctx map[string]string, iters []*foreachIter) error {
+	fb := c.ForEach
+	if len(fb.Collect) == 0 {
+		return nil
+	}
+
+	keys := make([]string, 0, len(fb.Collect))
+	for k := range fb.Collect {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	// dry-run では実行結果が無いので、後続のステップが展開できるように空の配列を入れる
+	if env.dryRun {
+		for _, k := range keys {
+			ctx[k] = "[]"
+			env.captured.add(k)
+		}
+		fmt.Fprintf(env.mw, "🧪 COLLECT PLAN | %s | profile=%s | %s = [] (placeholder)\n", c.Name, profile, strings.Join(keys, ", "))
+		return nil
+	}
+
+	collected := make(map[string]string, len(keys))
+	counts := make([]string, 0, len(keys))
+	for _, k := range keys {
+		list := []any{}
+		for _, it := range iters {
+			if it.started && it.err == nil {
+				list = append(list, it.values[k])
+			}
+		}
+		b, err := json.Marshal(list)
+		if err != nil {
+			fmt.Fprintf(env.mw, "❌ COLLECT NG | %s | profile=%s\n", c.Name, profile)
+			return fmt.Errorf("collect %s: json marshal failed: %w", k, err)
+		}
+		ctx[k] = string(b)
+		env.captured.add(k)
+		collected[k] = string(b)
+		counts = append(counts, fmt.Sprintf("%s=%d items", k, len(list)))
+	}
+
+	fmt.Fprintf(env.mw, "✅ COLLECT OK | %s | profile=%s | %s\n", c.Name, profile, strings.Join(counts, " | "))
+	env.events.emit(event{Event: "capture", Profile: profile, Step: path, Status: "ok", Captures: collected})
+	return nil
+}
+
+// foreachErrors は on_error: collect で集めたエラーを1つにまとめる。
+func foreachErrors(errs []error, total int) error {
+	if len(errs) == 0 {
+		return nil
+	}
+	return fmt.Errorf("foreach: %d of %d items failed:\n%w", len(errs), total, errors.Join(errs...))
+}
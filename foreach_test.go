@@ -0,0 +1,285 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+func TestForEachUnmarshalErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		yml     string
+		wantErr string
+	}{
+		{"no source", `{ as: X }`, "exactly one of var / items / items_from / range"},
+		{"two sources", `{ var: L, items: [1], as: X }`, "exactly one of"},
+		{"no as", `{ items: [1] }`, "requires as"},
+		{"built-in as", `{ items: [1], as: PROFILE }`, "cannot bind built-in variable"},
+		{"bad on_error", `{ items: [1], as: X, on_error: skip }`, "on_error: unsupported value"},
+		{"built-in collect", `{ items: [1], as: X, collect: { REGION: a } }`, "cannot override built-in variable: REGION"},
+		{"invalid collect expr", `{ items: [1], as: X, collect: { R: "Stacks[0" } }`, `foreach collect R: invalid expr "Stacks[0"`},
+		{"bad range", `{ range: "1-5", as: X }`, "expected \"from..to\""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var fb ForEachBlock
+			err := yaml.Unmarshal([]byte(tt.yml), &fb)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("err = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestForEachItems(t *testing.T) {
+	dir := t.TempDir()
+	ndjson := filepath.Join(dir, "acc.jsonl")
+	if err := os.WriteFile(ndjson, []byte("{\"id\":1}\n\n{\"id\":2}\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	obj := filepath.Join(dir, "obj.json")
+	if err := os.WriteFile(obj, []byte(`{"b":2,"a":1}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := map[string]string{
+		"LIST": `["x","y"]`,
+		"MAP":  `{"k2":"v2","k1":"v1"}`,
+		"ENV":  "prd",
+		"N":    "3",
+		"DIR":  dir,
+	}
+
+	tests := []struct {
+		name    string
+		yml     string
+		want    []any
+		wantErr string
+	}{
+		{name: "var array", yml: `{ var: LIST, as: X }`, want: []any{"x", "y"}},
+		{name: "var object sorted", yml: `{ var: MAP, as: X }`, want: []any{
+			map[string]any{"key": "k1", "value": "v1"},
+			map[string]any{"key": "k2", "value": "v2"},
+		}},
+		{name: "var undefined", yml: `{ var: NOPE, as: X }`, wantErr: "undefined variable: NOPE"},
+		{name: "var not JSON", yml: `{ var: ENV, as: X }`, wantErr: "not JSON array or object"},
+		{name: "items template", yml: `{ items: ["a-{{ .ENV }}", 2], as: X }`, want: []any{"a-prd", float64(2)}},
+		{name: "items_from ndjson", yml: `{ items_from: "{{ .DIR }}/acc.jsonl", as: X }`, want: []any{
+			map[string]any{"id": float64(1)}, map[string]any{"id": float64(2)},
+		}},
+		{name: "items_from object", yml: `{ items_from: "{{ .DIR }}/obj.json", as: X }`, want: []any{
+			map[string]any{"key": "a", "value": float64(1)}, map[string]any{"key": "b", "value": float64(2)},
+		}},
+		{name: "range", yml: `{ range: "1..{{ .N }}", as: X }`, want: []any{1, 2, 3}},
+		{name: "range down", yml: `{ range: "3..1", as: X }`, want: []any{3, 2, 1}},
+		{name: "range step", yml: `{ range: { from: 0, to: 5, step: 2 }, as: X }`, want: []any{0, 2, 4}},
+		{name: "range above 1e6", yml: `{ range: "999999..1000001", as: X }`, want: []any{999999, 1000000, 1000001}},
+		{name: "range bad step", yml: `{ range: { from: 0, to: 5, step: -1 }, as: X }`, wantErr: "never reaches"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var fb ForEachBlock
+			if err := yaml.Unmarshal([]byte(tt.yml), &fb); err != nil {
+				t.Fatal(err)
+			}
+			got, err := fb.items(ctx)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("items = %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+// runForEachYAML は yml の1ステップを sh で実行し、ctx と出力を返す。
+func runForEachYAML(t *testing.T, yml string, dryRun bool, setupVars map[string]bool) (map[string]string, string, error) {
+	t.Helper()
+	var c Cmd
+	if err := yaml.Unmarshal([]byte(yml), &c); err != nil {
+		t.Fatal(err)
+	}
+	out := &lockedBuffer{}
+	env := &runEnv{mw: out, dryRun: dryRun, limit: 10, shell: "sh", step: -1, setupVars: setupVars}
+	ctx := map[string]string{"PROFILE": "COM_DEV"}
+	err := runCmdTreeForProfile(env, "COM_DEV", c.Name, ctx, c)
+	return ctx, string(out.Bytes()), err
+}
+
+func TestForEachCollect(t *testing.T) {
+	tests := []struct {
+		name    string
+		yml     string
+		dryRun  bool
+		want    map[string]string
+		wantErr string
+		wantOut string
+	}{
+		{
+			name: "serial with filter",
+			yml: `
+name: each
+sh: |
+  echo '{"n": {{ .X }}, "sq": {{ mul .X .X }}}'
+foreach:
+  range: "1..4"
+  as: X
+  filter: "@ != ` + "`2`" + `"
+  collect: { NS: n, SQ: "{n: n, sq: sq}" }
+`,
+			want: map[string]string{
+				"NS": "[1,3,4]",
+				"SQ": `[{"n":1,"sq":1},{"n":3,"sq":9},{"n":4,"sq":16}]`,
+			},
+		},
+		{
+			name: "parallel keeps index order",
+			yml: `
+name: each
+sh: |
+  echo '{"n": {{ .X }}}'
+foreach:
+  range: "1..6"
+  as: X
+  parallel: 3
+  collect: { NS: n }
+`,
+			want: map[string]string{"NS": "[1,2,3,4,5,6]"},
+		},
+		{
+			name: "break_if stops after item",
+			yml: `
+name: each
+sh: |
+  echo '{"n": {{ .X }}}'
+foreach:
+  range: "1..5"
+  as: X
+  break_if: { expr: n, op: ge, value: 2 }
+  collect: { NS: n }
+`,
+			want: map[string]string{"NS": "[1,2]"},
+		},
+		{
+			name: "on_error collect skips failed items",
+			yml: `
+name: each
+sh: |
+  test {{ .X }} -ne 2 && echo '{"n": {{ .X }}}'
+foreach:
+  range: "1..3"
+  as: X
+  on_error: collect
+  collect: { NS: n }
+`,
+			want:    map[string]string{"NS": "[1,3]"},
+			wantErr: "foreach: 1 of 3 items failed",
+		},
+		{
+			name: "large integer items are not in exponent form",
+			yml: `
+name: each
+sh: |
+  echo '{"v": "{{ .X }}"}'
+foreach:
+  items: [123456789012, 7, 1.5]
+  as: X
+  collect: { VS: v }
+`,
+			want: map[string]string{"VS": `["123456789012","7","1.5"]`},
+		},
+		{
+			name: "range above 1e6",
+			yml: `
+name: each
+sh: |
+  echo '{"v": "{{ .X }}"}'
+foreach:
+  range: "999999..1000001"
+  as: X
+  filter: "@ != ` + "`1000000`" + `"
+  collect: { VS: v }
+`,
+			want: map[string]string{"VS": `["999999","1000001"]`},
+		},
+		{
+			name: "collect requires JSON",
+			yml: `
+name: each
+sh: |
+  echo not-json
+foreach:
+  items: [a]
+  as: X
+  collect: { NS: n }
+`,
+			wantErr: "collect requires JSON stdout",
+			wantOut: "❌ COLLECT NG",
+		},
+		{
+			name: "dry-run sets placeholder",
+			yml: `
+name: each
+sh: |
+  echo '{"n": 1}'
+foreach:
+  items: [a, b]
+  as: X
+  collect: { NS: n, IDS: id }
+`,
+			dryRun:  true,
+			want:    map[string]string{"NS": "[]", "IDS": "[]"},
+			wantOut: "🧪 COLLECT PLAN | each | profile=COM_DEV | IDS, NS = [] (placeholder)",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, out, err := runForEachYAML(t, tt.yml, tt.dryRun, nil)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want %q\n%s", err, tt.wantErr, out)
+				}
+			} else if err != nil {
+				t.Fatalf("unexpected error: %v\n%s", err, out)
+			}
+			for k, v := range tt.want {
+				if ctx[k] != v {
+					t.Errorf("ctx[%s] = %q, want %q", k, ctx[k], v)
+				}
+			}
+			if tt.wantOut != "" && !strings.Contains(out, tt.wantOut) {
+				t.Errorf("output does not contain %q:\n%s", tt.wantOut, out)
+			}
+		})
+	}
+}
+
+func TestForEachCollectSetupVar(t *testing.T) {
+	_, out, err := runForEachYAML(t, `
+name: each
+sh: |
+  echo '{"n": 1}'
+foreach:
+  items: [a]
+  as: X
+  collect: { NS: n }
+`, false, map[string]bool{"NS": true})
+	if err == nil || !strings.Contains(err.Error(), "cannot override setup variable: NS") {
+		t.Fatalf("err = %v", err)
+	}
+	if !strings.Contains(out, "❌ COLLECT NG") || strings.Contains(out, "CMD OK") {
+		t.Errorf("want COLLECT NG before running items:\n%s", out)
+	}
+}
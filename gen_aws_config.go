@@ -0,0 +1,224 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+const defaultGeneratedMarker = ";; GENERATED CODE DO NOT DELETE"
+
+// genAccount は organizations list-accounts の1アカウント分と、名前から導出した値。
+type genAccount struct {
+	Id     string
+	Name   string // profile 名
+	System string
+	Env    string
+	Role   string // sso_role_name
+}
+
+type genAWSConfigOptions struct {
+	Profile    string // 管理アカウントの profile
+	Region     string
+	SSOSession string
+	RoleName   string // Go template: .System / .Env / .Name / .Id
+	Split      string // Name を System / Env に分ける区切り文字
+	Out        string // config 断片の出力先（空なら stdout）
+	VarsOut    string // vars.profiles YAML の出力先（空なら stdout）
+	Merge      string // marker 以下を置き換える既存の config（~/.aws/config など）
+	Marker     string
+	DryRun     bool
+}
+
+// handleGen は `necro gen <kind> ...` を処理する。
+func handleGen(args []string) {
+	if len(args) == 0 || args[0] != "aws-config" {
+		fmt.Println("Usage:")
+		fmt.Println("  necro gen aws-config --profile <management-profile> [options]")
+		os.Exit(1)
+	}
+	if err := runGenAWSConfig(args[1:], os.Stdout); err != nil {
+		die(err)
+	}
+}
+
+func runGenAWSConfig(args []string, w io.Writer) error {
+	var o genAWSConfigOptions
+	fs := flag.NewFlagSet("necro gen aws-config", flag.ContinueOnError)
+	fs.SetOutput(w)
+	fs.StringVar(&o.Profile, "profile", "", "management account profile (organizations list-accounts)")
+	fs.StringVar(&o.Region, "region", "ap-northeast-1", "region written to each profile")
+	fs.StringVar(&o.SSOSession, "sso-session", "AWS_SESSION", "sso_session name")
+	fs.StringVar(&o.RoleName, "role-name", "ps-org-admin-for-{{.System}}-{{.Env}}", "sso_role_name template (.System/.Env/.Name/.Id)")
+	fs.StringVar(&o.Split, "split", "_", "separator to split account Name into System (first) / Env (last)")
+	fs.StringVar(&o.Out, "out", "", "write config fragment to file (default: stdout)")
+	fs.StringVar(&o.VarsOut, "vars-out", "", "write vars.profiles YAML to file (default: stdout)")
+	fs.StringVar(&o.Merge, "merge", "", "update the section below --marker in this config file in place")
+	fs.StringVar(&o.Marker, "marker", defaultGeneratedMarker, "marker line for --merge")
+	fs.BoolVar(&o.DryRun, "dry-run", false, "print results without writing files")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if o.Profile == "" {
+		return fmt.Errorf("gen aws-config: --profile is required")
+	}
+	if o.Split == "" {
+		return fmt.Errorf("gen aws-config: --split must not be empty")
+	}
+
+	b, errText, err := runAWSQuiet(o.Profile, o.Region, "organizations", "list-accounts")
+	if err != nil {
+		return fmt.Errorf("gen aws-config: organizations list-accounts: %w", awsQuietError(err, errText))
+	}
+
+	accounts, err := genAccountsFromJSON(b, o)
+	if err != nil {
+		return err
+	}
+
+	fragment := genAWSConfigFragment(accounts, o)
+	varsYAML, err := genVarsProfilesYAML(accounts)
+	if err != nil {
+		return err
+	}
+
+	if err := genWrite(w, o.Out, "aws config", fragment, o.DryRun); err != nil {
+		return err
+	}
+	if err := genWrite(w, o.VarsOut, "vars.profiles", varsYAML, o.DryRun); err != nil {
+		return err
+	}
+
+	if o.Merge != "" {
+		cur, err := os.ReadFile(o.Merge)
+		if err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("gen aws-config: merge read failed: %w", err)
+		}
+		merged := markerHead(string(cur), o.Marker) + "\n" + fragment
+		if o.DryRun {
+			fmt.Fprintf(w, "🧪 MERGE PLAN | path=%s | marker=%q | profiles=%d\n", o.Merge, o.Marker, len(accounts))
+			return nil
+		}
+		// 元ファイルは .bak に残す
+		if len(cur) > 0 {
+			if err := os.WriteFile(o.Merge+".bak", cur, 0600); err != nil {
+				return fmt.Errorf("gen aws-config: backup failed: %w", err)
+			}
+		}
+		if err := writeFileMkdir(o.Merge, []byte(merged), 0600); err != nil {
+			return fmt.Errorf("gen aws-config: merge write failed: %w", err)
+		}
+		fmt.Fprintf(w, "💾 MERGE OK | path=%s | profiles=%d\n", o.Merge, len(accounts))
+	}
+	return nil
+}
+
+func genAccountsFromJSON(b []byte, o genAWSConfigOptions) ([]genAccount, error) {
+	var data struct {
+		Accounts []struct {
+			Id     string `json:"Id"`
+			Name   string `json:"Name"`
+			Status string `json:"Status"`
+		} `json:"Accounts"`
+	}
+	if err := json.Unmarshal(b, &data); err != nil {
+		return nil, fmt.Errorf("gen aws-config: json parse failed: %w", err)
+	}
+
+	var out []genAccount
+	for _, a := range data.Accounts {
+		if strings.TrimSpace(a.Id) == "" || strings.TrimSpace(a.Name) == "" {
+			continue
+		}
+		// SUSPENDED などは profile を作らない
+		if a.Status != "" && a.Status != "ACTIVE" {
+			continue
+		}
+
+		// 区切り文字が無い名前（Audit など）は System も Env も名前全体（README に記載）
+		parts := strings.Split(a.Name, o.Split)
+		acc := genAccount{
+			Id:     a.Id,
+			Name:   a.Name,
+			System: strings.ToLower(parts[0]),
+			Env:    strings.ToLower(parts[len(parts)-1]),
+		}
+		role, err := renderTemplateData(o.RoleName, acc)
+		if err != nil {
+			return nil, fmt.Errorf("gen aws-config: role-name: %w", err)
+		}
+		acc.Role = role
+		out = append(out, acc)
+	}
+
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out, nil
+}
+
+func genAWSConfigFragment(accounts []genAccount, o genAWSConfigOptions) string {
+	var b strings.Builder
+	for _, a := range accounts {
+		fmt.Fprintf(&b, "[profile %s]\n", a.Name)
+		fmt.Fprintf(&b, "region = %s\n", o.Region)
+		fmt.Fprintf(&b, "sso_account_id = %s\n", a.Id)
+		fmt.Fprintf(&b, "sso_session = %s\n", o.SSOSession)
+		fmt.Fprintf(&b, "sso_role_name = %s\n", a.Role)
+		b.WriteString("\n")
+	}
+	return b.String()
+}
+
+func genVarsProfilesYAML(accounts []genAccount) (string, error) {
+	profiles := make(map[string]map[string]string, len(accounts))
+	for _, a := range accounts {
+		profiles[a.Name] = map[string]string{
+			"SYSTEM": a.System,
+			"ENV":    a.Env,
+		}
+	}
+	doc := map[string]any{
+		"vars": map[string]any{"profiles": profiles},
+	}
+	var b strings.Builder
+	enc := yaml.NewEncoder(&b)
+	enc.SetIndent(2)
+	if err := enc.Encode(doc); err != nil {
+		return "", fmt.Errorf("gen aws-config: yaml marshal failed: %w", err)
+	}
+	if err := enc.Close(); err != nil {
+		return "", fmt.Errorf("gen aws-config: yaml marshal failed: %w", err)
+	}
+	return b.String(), nil
+}
+
+func genWrite(w io.Writer, path, label, content string, dryRun bool) error {
+	if path == "" || dryRun {
+		fmt.Fprintf(w, "==== %s ====\n", strings.ToUpper(label))
+		fmt.Fprint(w, content)
+		if path != "" {
+			fmt.Fprintf(w, "🧪 OUT PLAN  | %s | path=%s\n", label, path)
+		}
+		return nil
+	}
+	if err := writeFileMkdir(path, []byte(content), 0644); err != nil {
+		return fmt.Errorf("gen aws-config: %s write failed: %w", label, err)
+	}
+	fmt.Fprintf(w, "💾 OUT OK    | %s | path=%s\n", label, path)
+	return nil
+}
+
+func writeFileMkdir(path string, data []byte, perm os.FileMode) error {
+	if dir := filepath.Dir(path); dir != "." && dir != "" {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+	}
+	return os.WriteFile(path, data, perm)
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const genAccountsJSON = `{"Accounts": [
+  {"Id": "333333333333", "Name": "SND_DEV", "Status": "ACTIVE"},
+  {"Id": "111111111111", "Name": "COM_PRD", "Status": "ACTIVE"},
+  {"Id": "444444444444", "Name": "OLD_PRD", "Status": "SUSPENDED"},
+  {"Id": "555555555555", "Name": "", "Status": "ACTIVE"},
+  {"Id": " ", "Name": "NO_ID", "Status": "ACTIVE"},
+  {"Id": "666666666666", "Name": "Audit"},
+  {"Id": "777777777777", "Name": "COM_APP_STG", "Status": "ACTIVE"}
+]}`
+
+func testGenOptions() genAWSConfigOptions {
+	return genAWSConfigOptions{
+		Region:     "ap-northeast-1",
+		SSOSession: "AWS_SESSION",
+		RoleName:   "ps-org-admin-for-{{.System}}-{{.Env}}",
+		Split:      "_",
+		Marker:     defaultGeneratedMarker,
+	}
+}
+
+func TestGenAccountsFromJSON(t *testing.T) {
+	got, err := genAccountsFromJSON([]byte(genAccountsJSON), testGenOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []genAccount{
+		// 区切り文字が無い名前は System も Env も名前全体
+		{Id: "666666666666", Name: "Audit", System: "audit", Env: "audit", Role: "ps-org-admin-for-audit-audit"},
+		{Id: "777777777777", Name: "COM_APP_STG", System: "com", Env: "stg", Role: "ps-org-admin-for-com-stg"},
+		{Id: "111111111111", Name: "COM_PRD", System: "com", Env: "prd", Role: "ps-org-admin-for-com-prd"},
+		{Id: "333333333333", Name: "SND_DEV", System: "snd", Env: "dev", Role: "ps-org-admin-for-snd-dev"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("accounts =\n%+v\nwant\n%+v", got, want)
+	}
+}
+
+func TestGenAccountsFromJSONOptions(t *testing.T) {
+	tests := []struct {
+		name     string
+		split    string
+		roleName string
+		want     []string // Role
+		wantErr  string
+	}{
+		{name: "name and id", split: "_", roleName: "{{.Name}}-{{.Id}}", want: []string{"COM_PRD-111111111111", "SND-DEV-333333333333"}},
+		{name: "other separator", split: "-", roleName: "{{.System}}/{{.Env}}", want: []string{"com_prd/com_prd", "snd/dev"}},
+		{name: "sprig", split: "_", roleName: "{{.System | upper}}", want: []string{"COM", "SND-DEV"}},
+		{name: "bad template", split: "_", roleName: "{{.System", wantErr: "gen aws-config: role-name:"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o := testGenOptions()
+			o.Split, o.RoleName = tt.split, tt.roleName
+			got, err := genAccountsFromJSON([]byte(`{"Accounts": [{"Id": "333333333333", "Name": "SND-DEV"}, {"Id": "111111111111", "Name": "COM_PRD"}]}`), o)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			var roles []string
+			for _, a := range got {
+				roles = append(roles, a.Role)
+			}
+			if !reflect.DeepEqual(roles, tt.want) {
+				t.Errorf("roles = %q, want %q", roles, tt.want)
+			}
+		})
+	}
+
+	if _, err := genAccountsFromJSON([]byte("not json"), testGenOptions()); err == nil || !strings.Contains(err.Error(), "json parse failed") {
+		t.Errorf("err = %v, want json parse failed", err)
+	}
+}
+
+func TestGenAWSConfigFragmentAndVars(t *testing.T) {
+	accounts := []genAccount{
+		{Id: "111111111111", Name: "COM_PRD", System: "com", Env: "prd", Role: "ps-org-admin-for-com-prd"},
+		{Id: "333333333333", Name: "SND_DEV", System: "snd", Env: "dev", Role: "ps-org-admin-for-snd-dev"},
+	}
+
+	wantFragment := `[profile COM_PRD]
+region = ap-northeast-1
+sso_account_id = 111111111111
+sso_session = AWS_SESSION
+sso_role_name = ps-org-admin-for-com-prd
+
+[profile SND_DEV]
+region = ap-northeast-1
+sso_account_id = 333333333333
+sso_session = AWS_SESSION
+sso_role_name = ps-org-admin-for-snd-dev
+
+`
+	if got := genAWSConfigFragment(accounts, testGenOptions()); got != wantFragment {
+		t.Errorf("fragment =\n%s\nwant\n%s", got, wantFragment)
+	}
+
+	wantVars := `vars:
+  profiles:
+    COM_PRD:
+      ENV: prd
+      SYSTEM: com
+    SND_DEV:
+      ENV: dev
+      SYSTEM: snd
+`
+	got, err := genVarsProfilesYAML(accounts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != wantVars {
+		t.Errorf("vars =\n%s\nwant\n%s", got, wantVars)
+	}
+}
+
+func TestRunGenAWSConfigMerge(t *testing.T) {
+	orig := runAWSQuiet
+	t.Cleanup(func() { runAWSQuiet = orig })
+	runAWSQuiet = func(profile, region string, args ...string) ([]byte, string, error) {
+		return []byte(`{"Accounts": [{"Id": "111111111111", "Name": "COM_PRD", "Status": "ACTIVE"}]}`), "", nil
+	}
+
+	const fragment = "[profile COM_PRD]\nregion = ap-northeast-1\nsso_account_id = 111111111111\nsso_session = AWS_SESSION\nsso_role_name = ps-org-admin-for-com-prd\n\n"
+	m := defaultGeneratedMarker
+
+	tests := []struct {
+		name    string
+		current *string // nil = ファイル無し
+		dryRun  bool
+		want    string
+		wantBak bool
+	}{
+		{
+			name:    "existing marker",
+			current: ptr("[default]\nregion = us-east-1\n" + m + "\n[profile OLD]\n"),
+			want:    "[default]\nregion = us-east-1\n" + m + "\n\n" + fragment,
+			wantBak: true,
+		},
+		{
+			name:    "no marker",
+			current: ptr("[default]\nregion = us-east-1\n"),
+			want:    "[default]\nregion = us-east-1\n\n" + m + "\n\n" + fragment,
+			wantBak: true,
+		},
+		{
+			name: "missing file",
+			want: m + "\n\n" + fragment,
+		},
+		{
+			name:    "dry-run does not write",
+			current: ptr("[default]\n"),
+			dryRun:  true,
+			want:    "[default]\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			path := filepath.Join(dir, "aws", "config")
+			if tt.current != nil {
+				if err := writeFileMkdir(path, []byte(*tt.current), 0o600); err != nil {
+					t.Fatal(err)
+				}
+			}
+			args := []string{"--profile", "mgmt", "--merge", path, "--vars-out", filepath.Join(dir, "vars.yml"), "--out", filepath.Join(dir, "frag.txt")}
+			if tt.dryRun {
+				args = append(args, "--dry-run")
+			}
+			var out bytes.Buffer
+			if err := runGenAWSConfig(args, &out); err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("merged =\n%q\nwant\n%q", got, tt.want)
+			}
+			bak, err := os.ReadFile(path + ".bak")
+			if tt.wantBak {
+				if err != nil || string(bak) != *tt.current {
+					t.Errorf("backup = %q, %v; want original", bak, err)
+				}
+			} else if err == nil {
+				t.Errorf("unexpected backup: %q", bak)
+			}
+			if tt.dryRun {
+				if !strings.Contains(out.String(), "🧪 MERGE PLAN") {
+					t.Errorf("output:\n%s", out.String())
+				}
+				if _, err := os.Stat(filepath.Join(dir, "frag.txt")); err == nil {
+					t.Errorf("dry-run wrote --out")
+				}
+			}
+		})
+	}
+}
+
+func ptr(s string) *string { return &s }
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+)
+
+// globalProfile は scope: global のステップのログ / summary / JSONL 上の profile 名。
+const globalProfile = "(global)"
+
+// isGlobal は scope: global のステップか。profile ごとではなく1回だけ実行する（それより前の cmd が全 profile で終わった後）。
+//
+//	cmd:
+//	  - name: bucket-list
+//	    aws: ["s3api", "list-buckets"]
+//	    capture: { BUCKETS: "Buckets[].Name" }
+//	    out: "./tmp/out/{{ .PROFILE }}/buckets.json"
+//	  - name: bucket-inventory
+//	    scope: global
+//	    transform:
+//	      var: PROFILES
+//	      expr: "sort_by(values(@), &profile)[].{profile: profile, account: vars.ACCOUNT_ID, buckets: vars.BUCKETS}"
+//	    out: "./tmp/out/bucket-inventory.json"
+//
+// ctx は RUN_ID / REGION と、profile に依存しない vars.defaults、そして PROFILES:
+//
+//	{"<profile>": {"profile": "<profile>", "vars": {...capture 後の ctx（secrets 以外）}, "outs": {"<step>": "<out のパス>"}}}
+func (c *Cmd) isGlobal() bool {
+	return c.Scope == "global"
+}
+
+// validateScopes は scope の値と、global / id / needs が top-level にだけあることを確認する。
+func validateScopes(cmds []Cmd, nested bool) error {
+	for _, c := range cmds {
+		if nested && (c.ID != "" || c.Needs != nil) {
+			return withStepSource(fmt.Errorf("id / needs is only allowed on top-level cmd"), c)
+		}
+		switch c.Scope {
+		case "", "profile":
+		case "global":
+			if nested {
+				return withStepSource(fmt.Errorf("scope: global is only allowed on top-level cmd"), c)
+			}
+		default:
+			return withStepSource(fmt.Errorf("scope: unsupported value %q (profile / global)", c.Scope), c)
+		}
+
+		if err := c.mapChildren(func(steps []Cmd) ([]Cmd, error) {
+			return steps, validateScopes(steps, true)
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// newGlobalCtx は profile に依存しない ctx を作る（RUN_ID / REGION + vars.defaults）。
+// .PROFILE などを参照していて解決できない defaults は入れない。ssm / cfn_output も profile が必要なので対象外。
+func newGlobalCtx(cfg *Config, runID, region string) (map[string]string, error) {
+	ctx := map[string]string{
+		"REGION": region,
+		"RUN_ID": runID,
+	}
+	staticVars, _ := splitVars(cfg.Vars.Defaults)
+	mergeVarsNoOverride(ctx, staticVars, nil)
+
+	order, _, err := resolveOrder(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	for _, k := range order {
+		v, didChange, err := renderTemplateString(ctx[k], ctx)
+		if err != nil {
+			delete(ctx, k)
+			continue
+		}
+		if didChange {
+			ctx[k] = v
+		}
+	}
+	return ctx, nil
+}
+
+// keyRecorder は setup の実行中に capture / collect で書いた変数を記録する（foreach の並列実行でも共有する）。
+type keyRecorder struct {
+	mu sync.Mutex
+	m  map[string]bool
+}
+
+func (r *keyRecorder) add(k string) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.m == nil {
+		r.m = map[string]bool{}
+	}
+	r.m[k] = true
+}
+
+// setupVars は記録した変数のうち、setup の後の ctx に残っているもの（foreach の要素内だけの capture は除く）。
+func (r *keyRecorder) setupVars(ctx map[string]string) map[string]bool {
+	out := map[string]bool{}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for k := range r.m {
+		if _, ok := ctx[k]; ok {
+			out[k] = true
+		}
+	}
+	return out
+}
+
+// isReadOnlyKey は built-in 変数と setup の変数（defaults / secrets / capture / with で上書きできない）。
+func isReadOnlyKey(setupVars map[string]bool, k string) bool {
+	return isBuiltInKey(k) || setupVars[k]
+}
+
+// profileOuts は profile ごとの out の保存先（step パス -> ファイル）。foreach の並列実行でも共有する。
+type profileOuts struct {
+	mu sync.Mutex
+	m  map[string]map[string]string
+}
+
+func (o *profileOuts) record(profile, step, path string) {
+	if o == nil {
+		return
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.m == nil {
+		o.m = map[string]map[string]string{}
+	}
+	if o.m[profile] == nil {
+		o.m[profile] = map[string]string{}
+	}
+	o.m[profile][step] = path
+}
+
+func (o *profileOuts) get(profile string) map[string]string {
+	out := map[string]string{}
+	if o == nil {
+		return out
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for k, v := range o.m[profile] {
+		out[k] = v
+	}
+	return out
+}
+
+// profilesJSON は global ステップ用の PROFILES（profile -> vars / outs）を作る。secrets（vars.secrets と SecureString）の値は含めない。
+func profilesJSON(profiles []string, ctxByProfile map[string]map[string]string, secrets map[string]bool, outs *profileOuts) (string, error) {
+	type entry struct {
+		Profile string            `json:"profile"`
+		Vars    map[string]any    `json:"vars"`
+		Outs    map[string]string `json:"outs"`
+	}
+	all := make(map[string]entry, len(profiles))
+	for _, p := range profiles {
+		vars := make(map[string]any, len(ctxByProfile[p]))
+		for k, v := range ctxByProfile[p] {
+			if secrets[k] {
+				continue
+			}
+			// capture した配列 / オブジェクトは JSON のまま入れる
+			vars[k] = v
+			if j, ok := parseJSONOrNil([]byte(v)); ok {
+				switch j.(type) {
+				case map[string]any, []any:
+					vars[k] = j
+				}
+			}
+		}
+		all[p] = entry{Profile: p, Vars: vars, Outs: outs.get(p)}
+	}
+	b, err := json.Marshal(all)
+	if err != nil {
+		return "", fmt.Errorf("PROFILES: json marshal failed: %w", err)
+	}
+	return string(b), nil
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+func TestSetupVarsRecordsCaptures(t *testing.T) {
+	var setup []Cmd
+	if err := yaml.Unmarshal([]byte(`
+- name: same-as-default
+  sh: |
+    echo '{"env": "dev", "id": "x1"}'
+  capture: { ENV: env, REGION: id }
+- name: per-item
+  sh: |
+    echo '{"id": "{{ .I }}"}'
+  capture: { ITEM_ID: id }
+  foreach: { items: [a, b], as: I, collect: { IDS: id } }
+- name: skipped
+  sh: |
+    echo '{"v": 1}'
+  when: { var: ENV, op: eq, value: prd }
+  capture: { NEVER: v }
+`), &setup); err != nil {
+		t.Fatal(err)
+	}
+
+	env := &runEnv{mw: &lockedBuffer{}, limit: 10, shell: "sh", step: -1, captured: &keyRecorder{}}
+	ctx := map[string]string{"REGION": "ap-northeast-1", "ENV": "dev"}
+	for _, c := range setup {
+		if err := runCmdTreeForProfile(env, globalProfile, c.Name, ctx, c); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// 値が defaults と同じでも capture したキーは setup の変数。built-in / 要素内だけの capture / 実行しなかったステップは含まない
+	want := map[string]bool{"ENV": true, "IDS": true}
+	if got := env.captured.setupVars(ctx); !reflect.DeepEqual(got, want) {
+		t.Errorf("setupVars = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+)
+
+// on_failure / finally（失敗時の後始末・ロールバック）
+//
+//	cmd:
+//	  - name: stack-update-changeset-exec
+//	    aws: ["cloudformation", "execute-change-set", "--stack-name", "{{ .STACK_NAME }}", "--change-set-name", "{{ .CHANGE_SET_NAME }}"]
+//	    on_failure:                          # このステップ（子ステップ含む）が失敗したとき
+//	      - name: changeset-delete
+//	        aws: ["cloudformation", "delete-change-set", "--stack-name", "{{ .STACK_NAME }}", "--change-set-name", "{{ .CHANGE_SET_NAME }}"]
+//	on_failure:                              # run が失敗したとき（profile ごと）
+//	  - name: notify
+//	    sh: echo "{{ .PROFILE }} {{ .FAILED_STEP }}: {{ .ERROR }}"
+//	finally:                                 # 成功 / 失敗に関わらず最後に（profile ごと）
+//	  - name: cleanup
+//	    sh: rm -rf ./tmp/work/{{ .PROFILE }}
+//
+// hook は失敗した時点の ctx（の複製）で実行し、FAILED_STEP / ERROR（top-level は FAILED_PROFILE / RUN_STATUS も）を足す。
+// hook が失敗しても残りの hook は実行し、元のエラーはそのまま返す。Ctrl-C でも実行する。
+
+var errInterrupted = errors.New("interrupted (Ctrl-C)")
+
+var (
+	interrupted   atomic.Bool
+	interruptOnce sync.Once
+	interruptCh   = make(chan struct{})
+)
+
+// watchInterrupt は Ctrl-C / SIGTERM で即終了せず、実行中のステップを失敗させて hook を走らせる。
+// 2回目で即終了する。
+func watchInterrupt(mw *maskWriter) {
+	sig := make(chan os.Signal, 2)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		n := 0
+		for range sig {
+			n++
+			if n > 1 {
+				mw.Flush()
+				fmt.Fprintln(os.Stderr, "\ninterrupted again: exit without hooks")
+				os.Exit(130)
+			}
+			fmt.Fprintln(mw, "\n🛑 INTERRUPT | stopping after the current step; running on_failure / finally (Ctrl-C again to exit now)")
+			interrupted.Store(true)
+			interruptOnce.Do(func() { close(interruptCh) })
+		}
+	}()
+}
+
+// checkInterrupted はステップを始める前に呼ぶ（hook の実行中は止めない）。
+func (e *runEnv) checkInterrupted() error {
+	if interrupted.Load() && !e.inHook {
+		return errInterrupted
+	}
+	return nil
+}
+
+// failureVars は hook 用の FAILED_STEP / ERROR（最も内側の失敗したステップとそのエラー）。
+func failureVars(c Cmd, err error) (step, msg string) {
+	var se *stepError
+	if errors.As(err, &se) {
+		return se.Step, se.Err.Error()
+	}
+	return c.Name, err.Error()
+}
+
+// runHooks は hooks を ctx の複製で順に実行する。kind は on_failure / finally。
+// path はフックを持つステップ（top-level の hook は ""）。失敗した hook があっても残りを実行し、最初の hook のエラーを返す。
+func runHooks(env *runEnv, profile, path, kind string, ctx map[string]string, vars map[string]string, hooks []Cmd) error {
+	// hook の中（並列の foreach / DAG の別ステップには影響しない）だけ中断チェックを止める
+	env = env.fork(env.mw, profile)
+	env.inHook = true
+
+	hctx := copyMap(ctx)
+	for k, v := range vars {
+		hctx[k] = v
+	}
+
+	label := "🧯 ON_FAILURE"
+	if kind == "finally" {
+		label = "🧹 FINALLY   "
+	}
+	owner := path
+	if owner == "" {
+		owner = "(run)"
+	}
+	if vars["FAILED_STEP"] != "" {
+		fmt.Fprintf(env.mw, "%s | %s | profile=%s | failed=%s\n", label, owner, profile, vars["FAILED_STEP"])
+	} else {
+		fmt.Fprintf(env.mw, "%s | %s | profile=%s\n", label, owner, profile)
+	}
+
+	var first error
+	for _, h := range hooks {
+		hp := stepPath(path, kind, h.Name)
+		if path == "" {
+			hp = kind + "/" + h.Name
+		}
+		err := runCmdTreeForProfile(env, profile, hp, hctx, h)
+		if err != nil {
+			fmt.Fprintf(env.mw, "❌ HOOK NG    | %s | profile=%s | %s | %v\n", h.Name, profile, kind, err)
+			if first == nil {
+				first = err
+			}
+		}
+	}
+
+	ev := event{Event: kind, Profile: profile, Step: owner, Status: "ok"}
+	if first != nil {
+		ev.Status = "ng"
+		ev.Error = errString(first)
+	}
+	env.events.emit(ev)
+	return first
+}
+
+// runTopLevelHooks は top-level の on_failure（失敗時）と finally を profile ごとに実行する。
+// failedProfile / err は失敗した profile（setup / global ステップなら (global)）とエラー。成功時は err == nil。
+// hook の失敗はログに出すだけで、run の結果は変えない。
+func runTopLevelHooks(env *runEnv, cfg *Config, profiles []string, ctxByProfile map[string]map[string]string, failedProfile string, err error) {
+	if len(cfg.OnFailure) == 0 && len(cfg.Finally) == 0 {
+		return
+	}
+
+	vars := map[string]string{"RUN_STATUS": "ok", "FAILED_PROFILE": "", "FAILED_STEP": "", "ERROR": ""}
+	if err != nil {
+		vars["RUN_STATUS"] = "ng"
+		vars["FAILED_PROFILE"] = failedProfile
+		vars["FAILED_STEP"], vars["ERROR"] = failureVars(Cmd{}, err)
+		// Ctrl-C で子プロセスが止まったときは、そのステップのエラー（exit status など）になる
+		if errors.Is(err, errInterrupted) || interrupted.Load() {
+			vars["RUN_STATUS"] = "interrupted"
+		}
+	}
+
+	for _, p := range profiles {
+		ctx, ok := ctxByProfile[p]
+		if !ok {
+			continue // STS より前に失敗した profile
+		}
+		if err != nil && len(cfg.OnFailure) > 0 {
+			_ = runHooks(env, p, "", "on_failure", ctx, vars, cfg.OnFailure)
+		}
+		if len(cfg.Finally) > 0 {
+			_ = runHooks(env, p, "", "finally", ctx, vars, cfg.Finally)
+		}
+	}
+}
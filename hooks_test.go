@@ -0,0 +1,88 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+// setInterrupted は Ctrl-C を受けた状態にして、テストの後に戻す。
+func setInterrupted(t *testing.T) {
+	t.Helper()
+	interrupted.Store(true)
+	t.Cleanup(func() { interrupted.Store(false) })
+}
+
+func TestHooksRunAfterInterrupt(t *testing.T) {
+	setInterrupted(t)
+
+	var c Cmd
+	if err := yaml.Unmarshal([]byte(`
+name: deploy
+sh: exit 3
+on_failure:
+  - name: rollback
+    sh: echo rolled-back
+`), &c); err != nil {
+		t.Fatal(err)
+	}
+	out := &lockedBuffer{}
+	env := &runEnv{mw: out, limit: 10, shell: "sh", step: -1}
+
+	err := runCmdTreeForProfile(env, "COM_DEV", c.Name, map[string]string{}, c)
+	if err == nil || errors.Is(err, errInterrupted) {
+		t.Fatalf("err = %v, want the step error", err)
+	}
+	if o := string(out.Bytes()); !strings.Contains(o, "rolled-back") || strings.Contains(o, "HOOK NG") {
+		t.Errorf("hook step did not run:\n%s", out.Bytes())
+	}
+
+	// hook の中だけ止めない（hook の外の並列ステップは止まる）
+	if err := env.checkInterrupted(); !errors.Is(err, errInterrupted) {
+		t.Errorf("outside hook: err = %v, want interrupted", err)
+	}
+	henv := env.fork(env.mw, "COM_DEV")
+	henv.inHook = true
+	if err := henv.fork(env.mw, "COM_DEV").checkInterrupted(); err != nil {
+		t.Errorf("inside hook: err = %v, want nil", err)
+	}
+}
+
+func TestRunStatusInterrupted(t *testing.T) {
+	var cfg Config
+	if err := yaml.Unmarshal([]byte(`
+finally:
+  - name: status
+    sh: echo "status={{ .RUN_STATUS }}"
+`), &cfg); err != nil {
+		t.Fatal(err)
+	}
+	ctxByProfile := map[string]map[string]string{"COM_DEV": {"PROFILE": "COM_DEV"}}
+
+	tests := []struct {
+		name        string
+		interrupted bool
+		err         error
+		want        string
+	}{
+		{name: "ok", want: "status=ok"},
+		{name: "ng", err: errors.New("exit status 3"), want: "status=ng"},
+		{name: "interrupted check", interrupted: true, err: errInterrupted, want: "status=interrupted"},
+		{name: "step killed by Ctrl-C", interrupted: true, err: errors.New("signal: interrupt"), want: "status=interrupted"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.interrupted {
+				setInterrupted(t)
+			}
+			out := &lockedBuffer{}
+			env := &runEnv{mw: out, limit: 10, shell: "sh", step: -1}
+			runTopLevelHooks(env, &cfg, []string{"COM_DEV"}, ctxByProfile, "COM_DEV", tt.err)
+			if !strings.Contains(string(out.Bytes()), tt.want) {
+				t.Errorf("output does not contain %q:\n%s", tt.want, out.Bytes())
+			}
+		})
+	}
+}
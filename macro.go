@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+	"text/template"
+
+	"github.com/Masterminds/sprig/v3"
+	"gopkg.in/yaml.v3"
+)
+
+// MacroDef は名前付き・パラメータ付きのステップ列。
+//
+//	macros:
+//	  cfn-changeset-update:
+//	    params:
+//	      stack:                          # 値なし = 必須
+//	      params: {}                      # 既定値
+//	    cmd:
+//	      - name: "changeset-create:[[ .stack ]]"
+//	        aws: ["cloudformation", "create-change-set", "--stack-name", "[[ .stack ]]"]
+//	cmd:
+//	  - use: cfn-changeset-update
+//	    with: { stack: stack-necro }
+//
+// 読み込み時に [[ ]] をパラメータで展開する（{{ }} は実行時の ctx 用にそのまま残る）。
+// 配列の要素が複数行に展開された場合は行ごとの要素に分け、空になった要素は取り除く。
+type MacroDef struct {
+	Params map[string]any `yaml:"params,omitempty"`
+	Cmd    yaml.Node      `yaml:"cmd"`
+
+	file string // 定義元（エラー表示用）
+}
+
+// expandMacros は cmds（ok / ng / on_failure / switch 内も含む）の use をマクロのステップ列に展開する。
+func expandMacros(cmds []Cmd, macros map[string]MacroDef, stack []string) ([]Cmd, error) {
+	out := make([]Cmd, 0, len(cmds))
+	for _, c := range cmds {
+		if c.Use == "" {
+			if err := c.mapChildren(func(steps []Cmd) ([]Cmd, error) {
+				return expandMacros(steps, macros, stack)
+			}); err != nil {
+				return nil, err
+			}
+			out = append(out, c)
+			continue
+		}
+
+		if containsString(stack, c.Use) {
+			return nil, fmt.Errorf("%s: macro cycle: %s -> %s", c.source, strings.Join(stack, " -> "), c.Use)
+		}
+		def, ok := macros[c.Use]
+		if !ok {
+			return nil, fmt.Errorf("%s: use %s: undefined macro", c.source, c.Use)
+		}
+
+		steps, err := instantiateMacro(c.Use, def, c.useWith)
+		if err != nil {
+			return nil, fmt.Errorf("%s: use %s: %w", c.source, c.Use, err)
+		}
+
+		// 展開したステップの定義元は「マクロ内の行 (use した場所)」
+		for i := range steps {
+			setStepSource(&steps[i], def.file, c.source)
+			steps[i].With = mergeWith(c.With, steps[i].With)
+		}
+
+		expanded, err := expandMacros(steps, macros, append(stack[:len(stack):len(stack)], c.Use))
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, expanded...)
+	}
+	return out, nil
+}
+
+// instantiateMacro はパラメータを検証し、[[ ]] を展開したステップ列を返す。
+func instantiateMacro(name string, def MacroDef, with map[string]any) ([]Cmd, error) {
+	data := make(map[string]any, len(def.Params))
+	for k, v := range def.Params {
+		if v != nil {
+			data[k] = v
+		}
+	}
+	for k, v := range with {
+		if _, ok := def.Params[k]; !ok {
+			return nil, fmt.Errorf("unknown param: %s (params: %s)", k, strings.Join(macroParamNames(def), ", "))
+		}
+		data[k] = v
+	}
+	var missing []string
+	for _, k := range macroParamNames(def) {
+		if _, ok := data[k]; !ok {
+			missing = append(missing, k)
+		}
+	}
+	if len(missing) > 0 {
+		return nil, fmt.Errorf("missing required param: %s", strings.Join(missing, ", "))
+	}
+
+	if def.Cmd.Kind != yaml.SequenceNode || len(def.Cmd.Content) == 0 {
+		return nil, fmt.Errorf("%s:%d: macro %s: cmd must be a non-empty list", def.file, def.Cmd.Line, name)
+	}
+
+	body, err := renderMacroNode(&def.Cmd, data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", def.file, err)
+	}
+
+	var steps []Cmd
+	if err := body.Decode(&steps); err != nil {
+		return nil, fmt.Errorf("%s: macro %s: %w", def.file, name, err)
+	}
+	// マクロ内の import は定義元ファイルからの相対パス
+	return expandImports(def.file, steps, nil, nil)
+}
+
+func macroParamNames(def MacroDef) []string {
+	names := make([]string, 0, len(def.Params))
+	for k := range def.Params {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// renderMacroNode は n を複製し、スカラーの [[ ]] を展開する。
+func renderMacroNode(n *yaml.Node, data map[string]any) (*yaml.Node, error) {
+	cp := *n
+	if n.Kind == yaml.ScalarNode {
+		if !strings.Contains(n.Value, "[[") {
+			return &cp, nil
+		}
+		v, err := renderMacroString(n.Value, data)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", n.Line, err)
+		}
+		cp.Value = v
+		return &cp, nil
+	}
+
+	cp.Content = make([]*yaml.Node, 0, len(n.Content))
+	for i, child := range n.Content {
+		// マッピングのキーは展開のみ（要素の分割・削除はしない）
+		if n.Kind == yaml.MappingNode && i%2 == 0 {
+			k, err := renderMacroNode(child, data)
+			if err != nil {
+				return nil, err
+			}
+			cp.Content = append(cp.Content, k)
+			continue
+		}
+		r, err := renderMacroNode(child, data)
+		if err != nil {
+			return nil, err
+		}
+		// 配列の要素: 複数行 → 複数要素、空 → 削除（args の可変長展開用）
+		if n.Kind == yaml.SequenceNode && r.Kind == yaml.ScalarNode && strings.Contains(child.Value, "[[") {
+			for _, line := range strings.Split(r.Value, "\n") {
+				if strings.TrimSpace(line) == "" {
+					continue
+				}
+				item := *r
+				item.Value = line
+				item.Style = yaml.DoubleQuotedStyle
+				cp.Content = append(cp.Content, &item)
+			}
+			continue
+		}
+		cp.Content = append(cp.Content, r)
+	}
+	return &cp, nil
+}
+
+func renderMacroString(s string, data map[string]any) (string, error) {
+	t, err := template.New("macro").
+		Delims("[[", "]]").
+		Option("missingkey=error").
+		Funcs(sprig.TxtFuncMap()).
+		Parse(s)
+	if err != nil {
+		return "", fmt.Errorf("macro template parse failed: %w (in %q)", err, s)
+	}
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, data); err != nil {
+		return "", fmt.Errorf("macro template exec failed: %w (in %q)", err, s)
+	}
+	return buf.String(), nil
+}
+
+// setStepSource はマクロから展開したステップ（子ステップ含む）に定義元を付ける。
+func setStepSource(c *Cmd, file, useSite string) {
+	c.source = fmt.Sprintf("%s:%d (use at %s)", file, c.line, useSite)
+	_ = c.mapChildren(func(steps []Cmd) ([]Cmd, error) {
+		for i := range steps {
+			setStepSource(&steps[i], file, useSite)
+		}
+		return steps, nil
+	})
+}
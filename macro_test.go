@@ -0,0 +1,229 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const macroChangeset = `
+macros:
+  changeset:
+    params:
+      stack:          # 必須
+      template:       # 必須
+      region: ap-northeast-1
+      params: {}
+    cmd:
+      - name: "create:[[ .stack ]]"
+        aws:
+          [
+            "cloudformation", "create-change-set",
+            "--stack-name", "[[ .stack ]]",
+            "--template-body", "file://[[ .template ]]",
+            "--region", "[[ .region ]]",
+            "[[ if .params ]]--parameters[[ end ]]",
+            '[[ range $k, $v := .params ]]ParameterKey=[[ $k ]],ParameterValue=[[ $v ]][[ "\n" ]][[ end ]]',
+            "--tags", "Env={{ .ENV }}",
+          ]
+`
+
+func TestMacroExpand(t *testing.T) {
+	tests := []struct {
+		name    string
+		use     string
+		want    []string // aws
+		wantErr string
+	}{
+		{
+			name: "defaults and empty elements removed",
+			use:  `{ use: changeset, with: { stack: s1, template: t.yml } }`,
+			want: []string{"cloudformation", "create-change-set", "--stack-name", "s1", "--template-body", "file://t.yml", "--region", "ap-northeast-1", "--tags", "Env={{ .ENV }}"},
+		},
+		{
+			name: "multi-line value is split into elements",
+			use:  `{ use: changeset, with: { stack: s1, template: t.yml, region: us-east-1, params: { Env: "{{ .ENV }}", System: necro } } }`,
+			want: []string{"cloudformation", "create-change-set", "--stack-name", "s1", "--template-body", "file://t.yml", "--region", "us-east-1",
+				"--parameters", "ParameterKey=Env,ParameterValue={{ .ENV }}", "ParameterKey=System,ParameterValue=necro", "--tags", "Env={{ .ENV }}"},
+		},
+		{
+			name: "non-string param",
+			use:  `{ use: changeset, with: { stack: 1, template: t.yml, region: "" } }`,
+			want: []string{"cloudformation", "create-change-set", "--stack-name", "1", "--template-body", "file://t.yml", "--region", "--tags", "Env={{ .ENV }}"},
+		},
+		{
+			name:    "missing required params",
+			use:     `{ use: changeset, with: { region: x } }`,
+			wantErr: "use changeset: missing required param: stack, template",
+		},
+		{
+			name:    "unknown param",
+			use:     `{ use: changeset, with: { stack: s1, template: t.yml, stak: typo } }`,
+			wantErr: "use changeset: unknown param: stak (params: params, region, stack, template)",
+		},
+		{
+			name:    "undefined macro",
+			use:     `{ use: nope }`,
+			wantErr: "use nope: undefined macro",
+		},
+		{
+			name:    "use with other keys",
+			use:     "\n    use: changeset\n    sh: echo x",
+			wantErr: "use cannot be combined with sh",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, err := loadConfigString(t, macroChangeset+"cmd:\n  - "+tt.use+"\n")
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(cfg.Cmd) != 1 {
+				t.Fatalf("cmd = %d steps, want 1", len(cfg.Cmd))
+			}
+			if !reflect.DeepEqual(cfg.Cmd[0].Aws, tt.want) {
+				t.Errorf("aws =\n%q\nwant\n%q", cfg.Cmd[0].Aws, tt.want)
+			}
+			if cfg.Cmd[0].Name != "create:s1" && cfg.Cmd[0].Name != "create:1" {
+				t.Errorf("name = %q", cfg.Cmd[0].Name)
+			}
+		})
+	}
+}
+
+func TestMacroNested(t *testing.T) {
+	cfg, err := loadConfigString(t, `
+macros:
+  wait:
+    params: { stack: }
+    cmd:
+      - name: "wait:[[ .stack ]]"
+        sh: echo wait [[ .stack ]] {{ .PROFILE }}
+  deploy:
+    params: { stack: , wait: true }
+    cmd:
+      - name: "deploy:[[ .stack ]]"
+        sh: echo deploy
+        ok:
+          - use: wait
+            with: { stack: "[[ .stack ]]-ok" }
+      - use: wait
+        with: { stack: "[[ .stack ]]" }
+cmd:
+  - name: before
+    sh: echo before
+  - use: deploy
+    with: { stack: a }
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	for _, c := range cfg.Cmd {
+		got = append(got, c.Name)
+		for _, o := range c.Ok {
+			got = append(got, "  "+o.Name+" "+o.Sh.For("linux"))
+		}
+	}
+	want := []string{"before", "deploy:a", "  wait:a-ok echo wait a-ok {{ .PROFILE }}", "wait:a"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("steps = %q, want %q", got, want)
+	}
+
+	// 定義元は「マクロ内の行 (use した場所)」
+	if src := cfg.Cmd[1].source; !strings.Contains(src, "x.yml:11 (use at ") || !strings.HasSuffix(src, "x.yml:21)") {
+		t.Errorf("source = %q", src)
+	}
+}
+
+func TestMacroErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		yml     string
+		wantErr string
+	}{
+		{
+			name: "self cycle",
+			yml: `
+macros:
+  a: { cmd: [ { use: a } ] }
+cmd:
+  - use: a
+`,
+			wantErr: "macro cycle: a -> a",
+		},
+		{
+			name: "macro calls macro cycle",
+			yml: `
+macros:
+  a: { cmd: [ { name: a, sh: echo a }, { use: b } ] }
+  b:
+    cmd:
+      - name: b
+        sh: echo b
+        ng:
+          - use: a
+cmd:
+  - use: a
+`,
+			wantErr: "macro cycle: a -> b -> a",
+		},
+		{
+			name: "undefined param in template",
+			yml: `
+macros:
+  a:
+    params: { stack: }
+    cmd: [ { name: "[[ .stak ]]", sh: echo } ]
+cmd:
+  - { use: a, with: { stack: s } }
+`,
+			wantErr: `macro template exec failed`,
+		},
+		{
+			name: "template parse error",
+			yml: `
+macros:
+  a: { cmd: [ { name: "[[ .x ", sh: echo } ] }
+cmd:
+  - use: a
+`,
+			wantErr: `macro template parse failed`,
+		},
+		{
+			name: "empty cmd",
+			yml: `
+macros:
+  a: { cmd: [] }
+cmd:
+  - use: a
+`,
+			wantErr: "macro a: cmd must be a non-empty list",
+		},
+		{
+			name: "validated after expansion",
+			yml: `
+macros:
+  a: { cmd: [ { name: a, sh: echo a, aws: [s3, ls] } ] }
+cmd:
+  - use: a
+`,
+			wantErr: "only one of aws / sh / transform / render / file can be set",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := loadConfigString(t, tt.yml)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("err = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -6,24 +6,30 @@ import (
 	"crypto/rand"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/Masterminds/sprig/v3"
 	gojmespath "github.com/jmespath/go-jmespath"
-	"gopkg.in/yaml.v3"
 
 	"text/template"
 )
 
 type Config struct {
-	Version  int `yaml:"version"`
+	Version int `yaml:"version"`
+
+	// include: 共通設定ファイル（このファイルからの相対パス）。マージ規則は config.go
+	Include []includeEntry `yaml:"include,omitempty"`
+
 	Defaults struct {
 		Region string `yaml:"region"`
 	} `yaml:"defaults"`
@@ -36,22 +42,55 @@ type Config struct {
 		//   template-resolve-limit: 10
 		TemplateResolveLimit int `yaml:"template-resolve-limit"`
 
-		Defaults map[string]string            `yaml:"defaults"`
-		Profiles map[string]map[string]string `yaml:"profiles"`
+		// 値は文字列（テンプレート）または外部参照 { ssm: ... } / { cfn_output: {stack, key} }
+		Defaults map[string]VarValue            `yaml:"defaults"`
+		Profiles map[string]map[string]VarValue `yaml:"profiles"`
+
+		// secrets: 値は console / log 出力で *** にマスクされる
+		Secrets map[string]SecretSource `yaml:"secrets"`
 	} `yaml:"vars"`
+	// shell: sh ステップのインタプリタ（bash / sh / pwsh / cmd / none）
+	// 未指定なら OS 既定（windows: pwsh, それ以外: bash）
+	Shell string `yaml:"shell,omitempty"`
+
+	// macros: 名前付き・パラメータ付きのステップ列（cmd で - use: name として展開）
+	Macros map[string]MacroDef `yaml:"macros,omitempty"`
+
+	// protect: 一致する profile を実行するときはアカウントの alias / ID の入力を必須にする（protect.go）
+	Protect []string `yaml:"protect,omitempty"`
+
+	// rollout: profile を canary / waves に分けて順に実行する（rollout.go）
+	Rollout *RolloutBlock `yaml:"rollout,omitempty"`
+
+	// setup: STS チェックより前に1回だけ実行するステップ。capture は全 profile で読み取り専用の変数になる
+	Setup []Cmd `yaml:"setup,omitempty"`
+
 	Cmd []Cmd `yaml:"cmd"`
+
+	// on_failure: run が失敗したとき（Ctrl-C 含む）、finally: 成功 / 失敗に関わらず最後に、profile ごとに実行する（hooks.go）
+	OnFailure []Cmd `yaml:"on_failure,omitempty"`
+	Finally   []Cmd `yaml:"finally,omitempty"`
+
+	graph *stepGraph // cmd の依存関係（loadConfig で作る）
 }
 
 type Cmd struct {
 	Name string `yaml:"name"`
 
+	// id / needs: 依存関係（top-level cmd のみ）。needs が無ければ直前のステップを待つ、needs: [] なら待たない（dag.go）
+	ID    string   `yaml:"id,omitempty"`
+	Needs []string `yaml:"needs,omitempty"`
+
 	// New:
 	// - aws: AWS CLI subcommand args (necro will prepend aws --profile/--region/--output json ...)
-	// - sh:  Shell command string executed by bash -lc (supports pipes/redirection)
+	// - sh:  Shell command string executed by shell (supports pipes/redirection)
+	//        string, or per-OS map {linux: ..., darwin: ..., windows: ..., unix: ..., default: ...}
+	// - shell: interpreter for sh (bash / sh / pwsh / cmd / none). overrides global shell
 	// - in:  Optional input file path; content is fed to stdin for sh
-	Aws []string `yaml:"aws,omitempty"`
-	Sh  string   `yaml:"sh,omitempty"`
-	In  string   `yaml:"in,omitempty"`
+	Aws   []string `yaml:"aws,omitempty"`
+	Sh    ShScript `yaml:"sh,omitempty"`
+	Shell string   `yaml:"shell,omitempty"`
+	In    string   `yaml:"in,omitempty"`
 
 	// Backward compatible:
 	// - run: treated as aws args (same as aws:)
@@ -60,22 +99,45 @@ type Cmd struct {
 	Capture map[string]string `yaml:"capture,omitempty"`
 	Out     string            `yaml:"out,omitempty"`
 
+	// when: 実行前の条件（false ならスキップ）。テンプレート文字列 or { var, op, value }
+	When *WhenBlock `yaml:"when,omitempty"`
+
 	If *IfBlock `yaml:"if,omitempty"`
 	Ok []Cmd    `yaml:"ok,omitempty"`
 	Ng []Cmd    `yaml:"ng,omitempty"`
 
-	ForEach *ForEachBlock `yaml:"foreach,omitempty"`
-}
+	// switch: 値（expr / var）で cases / default に分岐（if の後に評価）
+	Switch *SwitchBlock `yaml:"switch,omitempty"`
 
-type ForEachBlock struct {
-	Var string `yaml:"var"` // ctx にある配列(JSON文字列)
-	As  string `yaml:"as"`  // ループ内で使う変数名
-}
+	ForEach *ForEachBlock `yaml:"foreach,omitempty"`
 
-type IfBlock struct {
-	Expr  string `yaml:"expr"`            // JMESPath against LAST_JSON
-	Op    string `yaml:"op"`              // eq/ne/contains/exists/in
-	Value string `yaml:"value,omitempty"` // rendered by ${VAR} from ctx
+	// on_failure: このステップ（子ステップ含む）が失敗したときに実行する。ctx に FAILED_STEP / ERROR
+	OnFailure []Cmd `yaml:"on_failure,omitempty"`
+
+	// scope: profile(default) / global（全 profile の後に1回だけ実行。ctx に PROFILES）
+	Scope string `yaml:"scope,omitempty"`
+
+	// until: 条件が成り立つまで繰り返す（interval / max_wait / fail_if）。capture 等は最後の応答に対して
+	Until *UntilBlock `yaml:"until,omitempty"`
+
+	// Built-in steps (no external process):
+	// - transform: JSON 加工（JMESPath + 要素ごとの template）。入力は in / var / LAST_JSON
+	// - render:    テンプレートファイルから out を生成（marker 以下の置き換えも可）
+	// - file:      ファイル操作（write / append / copy / mkdir / rm）
+	Transform *TransformBlock `yaml:"transform,omitempty"`
+	Render    *RenderBlock    `yaml:"render,omitempty"`
+	File      *FileBlock      `yaml:"file,omitempty"`
+
+	// - import: 別ファイルのステップ配列をこの位置に展開する（読み込み時）
+	// - use:    macros のステップ列を展開する（この場合 with はマクロのパラメータ）
+	// - with:   このステップ（import なら展開した各ステップ）の実行中だけ ctx に入る変数
+	Import string            `yaml:"import,omitempty"`
+	Use    string            `yaml:"use,omitempty"`
+	With   map[string]string `yaml:"with,omitempty"`
+
+	useWith map[string]any
+	source  string // 定義元 file:line（エラー表示用）
+	line    int
 }
 
 var (
@@ -89,18 +151,21 @@ func main() {
 		return
 	}
 
-	cfgPath, dryRun := parseArgs(os.Args)
+	opts, err := parseArgs(os.Args)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		usage()
+		os.Exit(1)
+	}
+	cfgPath, dryRun := opts.CfgPath, opts.DryRun
 	if cfgPath == "" {
 		usage()
 		os.Exit(1)
 	}
 
-	cfgData, err := os.ReadFile(cfgPath)
+	cfg, err := loadConfig(cfgPath)
 	dieIf(err)
 
-	var cfg Config
-	dieIf(yaml.Unmarshal(cfgData, &cfg))
-
 	region := cfg.Defaults.Region
 	if region == "" {
 		region = "ap-northeast-1"
@@ -121,6 +186,12 @@ func main() {
 		os.Exit(1)
 	}
 
+	var waves []rolloutWave
+	if cfg.Rollout != nil {
+		waves, err = cfg.Rollout.plan(profiles)
+		dieIf(err)
+	}
+
 	// ---------- Log setup ----------
 	runID := newRunID()
 
@@ -132,9 +203,18 @@ func main() {
 	dieIf(err)
 	defer logFile.Close()
 
-	mw := io.MultiWriter(os.Stdout, logFile)
+	// secrets は console / log / 子プロセス出力のすべてでマスクする
+	mw := newMaskWriter(io.MultiWriter(os.Stdout, logFile), secretValues)
+	defer mw.Flush()
+
+	// 構造化ログ（監査/集計用）: 1行1イベント
+	eventPath := filepath.Join(logDir, runID+".jsonl")
+	events, eventFile, err := openEventLog(eventPath, runID, region)
+	dieIf(err)
+	defer eventFile.Close()
 
 	fmt.Fprintf(mw, "🧾 LOG FILE | %s\n", logPath)
+	fmt.Fprintf(mw, "🧾 EVENTS   | %s\n", eventPath)
 	fmt.Fprintf(mw, "🆔 RUN ID   | %s\n", runID)
 
 	// ---------- Global start time ----------
@@ -142,18 +222,53 @@ func main() {
 	fmt.Fprintf(mw, "🕒 START    | %s\n", runStart.Format(time.RFC3339))
 
 	// ---------- Preview ----------
+	protected := protectedProfiles(cfg.Protect, profiles)
 	fmt.Fprintln(mw, "\n==== TARGET PROFILES ====")
 	for _, p := range profiles {
+		if isProtected(cfg.Protect, p) {
+			fmt.Fprintln(mw, "-", p, "🔒 PROTECTED")
+			continue
+		}
 		fmt.Fprintln(mw, "-", p)
 	}
 
+	if cfg.Rollout != nil {
+		fmt.Fprintf(mw, "\n==== ROLLOUT (pause_between=%s, max_failure_rate=%s%%) ====\n", cfg.Rollout.pauseDesc(), formatRate(cfg.Rollout.MaxFailureRate))
+		for i, w := range waves {
+			fmt.Fprintf(mw, "- wave %d/%d | %s | %s\n", i+1, len(waves), w.label, strings.Join(w.profiles, ", "))
+		}
+	}
+
+	if len(cfg.Setup) > 0 {
+		fmt.Fprintln(mw, "\n==== SETUP ====")
+		for _, c := range cfg.Setup {
+			fmt.Fprintln(mw, "-", c.Name)
+		}
+	}
+
 	fmt.Fprintln(mw, "\n==== COMMANDS ====")
 	for _, c := range cfg.Cmd {
+		if c.Needs != nil {
+			fmt.Fprintf(mw, "- %s (needs: %s)\n", c.Name, strings.Join(c.Needs, ", "))
+			continue
+		}
 		fmt.Fprintln(mw, "-", c.Name)
 	}
 
+	confirmed := ""
 	if dryRun {
 		fmt.Fprintln(mw, "\n==== DRY RUN PLAN ====")
+	} else if len(protected) > 0 {
+		// protect に一致する profile があれば y/N の代わりに alias / ID の入力（または --confirm-prd）
+		targets, err := lookupProtectTargets(protected, region)
+		if err == nil {
+			confirmed, err = confirmProtected(mw, stdin, targets, opts.ConfirmPrd)
+		}
+		if err != nil {
+			fmt.Fprintln(mw, "Cancelled.")
+			mw.Flush()
+			die(err)
+		}
 	} else {
 		if !confirmProceed() {
 			fmt.Fprintln(mw, "Cancelled.")
@@ -161,8 +276,95 @@ func main() {
 		}
 	}
 
-	// ---------- STS check + ctx cache ----------
+	events.emit(event{Event: "run_start", Region: region, Config: cfgPath, Profiles: profiles, DryRun: dryRun, Protected: protected, Reason: confirmed})
+
+	// Ctrl-C: 実行中のステップを止めて on_failure / finally を実行してから終了する
+	watchInterrupt(mw)
+
+	// summary の列: setup（(global) 行）→ cmd
+	stepNames := make([]string, 0, len(cfg.Setup)+len(cfg.Cmd))
+	globalSteps := make([]bool, 0, len(cfg.Setup)+len(cfg.Cmd))
+	for _, c := range cfg.Setup {
+		stepNames = append(stepNames, c.Name)
+		globalSteps = append(globalSteps, true)
+	}
+	for _, c := range cfg.Cmd {
+		stepNames = append(stepNames, c.Name)
+		globalSteps = append(globalSteps, c.isGlobal())
+	}
+	summary := newRunSummary(runID, cfgPath, profiles, stepNames, globalSteps, dryRun, runStart)
+
+	// サマリー表と --report は成功/失敗どちらでも出す
+	finish := func(status string) {
+		mw.Flush()
+		summary.finish(status, time.Now())
+		summary.printTable(mw)
+		for _, rp := range opts.Reports {
+			if err := summary.writeReport(rp); err != nil {
+				fmt.Fprintf(mw, "❌ REPORT NG | path=%s | %v\n", rp, err)
+				continue
+			}
+			fmt.Fprintf(mw, "📊 REPORT OK | path=%s\n", rp)
+		}
+	}
+
+	env := &runEnv{
+		mw:      mw,
+		dryRun:  dryRun,
+		region:  region,
+		limit:   templateResolveLimitOrDefault(&cfg),
+		shell:   cfg.Shell,
+		events:  events,
+		summary: summary,
+		outs:    &profileOuts{},
+		secrets: secretNames(cfg.Vars.Secrets),
+		step:    -1,
+	}
+
+	// STS を通った profile の ctx（top-level の on_failure / finally もこれを使う）
 	ctxByProfile := make(map[string]map[string]string, len(profiles))
+	hookProfiles := profiles
+
+	// 失敗時も on_failure / finally と run_end を済ませてから停止する
+	fail := func(profile string, err error) {
+		runTopLevelHooks(env, &cfg, hookProfiles, ctxByProfile, profile, err)
+		finish("ng")
+		events.emit(event{
+			Event:      "run_end",
+			Profile:    profile,
+			Status:     "ng",
+			Error:      errString(err),
+			DurationMs: durationMs(time.Since(runStart)),
+		})
+		die(err)
+	}
+
+	// setup / scope: global のステップ用（global ステップ間では capture を引き継ぐ）
+	globalCtx, err := newGlobalCtx(&cfg, runID, region)
+	if err != nil {
+		fail(globalProfile, err)
+	}
+
+	// ---------- Setup (once, before STS fan-out) ----------
+	if len(cfg.Setup) > 0 {
+		env.captured = &keyRecorder{}
+		for si, c := range cfg.Setup {
+			if err := env.checkInterrupted(); err != nil {
+				fail(globalProfile, err)
+			}
+			stepStart := time.Now()
+			err := runTopStep(env, globalProfile, si, globalCtx, c)
+			summary.record(globalProfile, si, err, time.Since(stepStart))
+			if err != nil {
+				fail(globalProfile, err)
+			}
+		}
+		env.setupVars = env.captured.setupVars(globalCtx)
+		env.captured = nil
+	}
+
+	// ---------- STS check + ctx cache ----------
+	varCache := newVarSourceCache()
 
 	for _, profile := range profiles {
 		accountID, _, errText, e := getCallerIdentity(profile, region)
@@ -171,10 +373,12 @@ func main() {
 			if errText != "" {
 				fmt.Fprintf(mw, "   stderr  | %s\n", errText)
 			}
-			die(e)
+			events.emit(event{Event: "sts", Profile: profile, Status: "ng", Error: strings.TrimSpace(e.Error() + " " + errText)})
+			fail(profile, e)
 		}
 
 		fmt.Fprintf(mw, "🔐 STS | profile=%s | account=%s\n", profile, accountID)
+		events.emit(event{Event: "sts", Profile: profile, Status: "ok", Account: accountID})
 
 		ctx := map[string]string{
 			"PROFILE":    profile,
@@ -182,58 +386,195 @@ func main() {
 			"ACCOUNT_ID": accountID,
 			"RUN_ID":     runID,
 		}
+		// setup の capture（読み取り専用: defaults / secrets / capture で上書きされない）
+		for k := range env.setupVars {
+			ctx[k] = globalCtx[k]
+		}
 
-		mergeVarsNoOverride(ctx, cfg.Vars.Defaults)
+		staticVars, sourceVars := splitVars(mergeVarValues(cfg.Vars.Defaults, cfg.Vars.Profiles[profile]))
+		mergeVarsNoOverride(ctx, staticVars, env.setupVars)
 
-		if pv, ok := cfg.Vars.Profiles[profile]; ok {
-			mergeVarsNoOverride(ctx, pv)
+		// secrets: 取得元は built-in 変数のみで展開（defaults/profiles より優先）
+		if len(cfg.Vars.Secrets) > 0 {
+			sec, err := loadSecrets(mw, profile, region, builtInCtx(ctx), cfg.Vars.Secrets)
+			if err != nil {
+				fail(profile, fmt.Errorf("profile %s: %w", profile, err))
+			}
+			mergeVarsNoOverride(ctx, sec, env.setupVars)
 		}
 
 		limit := templateResolveLimitOrDefault(&cfg)
-		if err := resolveContextTemplates(ctx, limit); err != nil {
-			die(fmt.Errorf("profile %s: %w", profile, err))
+
+		// ssm / cfn_output: profile ごとに参照（実行中はキャッシュ、dry-run でも値を表示）
+		if len(sourceVars) > 0 {
+			secure, err := resolveVarSources(mw, varCache, profile, region, limit, env.secrets, env.setupVars, ctx, sourceVars)
+			if err != nil {
+				fail(profile, fmt.Errorf("profile %s: %w", profile, err))
+			}
+			// SecureString は vars.secrets と同じ扱い（テンプレートとして解決しない・PROFILES に出さない）
+			for _, k := range secure {
+				env.secrets[k] = true
+			}
+		}
+
+		if err := resolveContextTemplates(ctx, limit, env.secrets); err != nil {
+			fail(profile, fmt.Errorf("profile %s: %w", profile, err))
 		}
 
 		ctxByProfile[profile] = ctx
 	}
 
 	// ---------- Execute cmd by cmd ----------
-	for _, c := range cfg.Cmd {
-		for _, profile := range profiles {
-			// profileごとにctxは独立させる（captureで汚染しない）
-			ctx := ctxByProfile[profile]
+	// failed が nil なら最初の失敗で停止（今まで通り）。
+	// rollout では失敗を profile ごとに failed に記録し、その profile の残りのステップだけを実行しない。
+	stepFailed := func(profile string, err error, failed map[string]error) {
+		if failed == nil || errors.Is(err, errInterrupted) {
+			fail(profile, err)
+		}
+		failed[profile] = err
+	}
+
+	runCmds := func(targets []string, failed map[string]error) {
+		for ci := 0; ci < len(cfg.Cmd); ci++ {
+			c := cfg.Cmd[ci]
+			if c.isGlobal() {
+				if err := env.checkInterrupted(); err != nil {
+					fail(globalProfile, err)
+				}
+				pj, err := profilesJSON(profiles, ctxByProfile, env.secrets, env.outs)
+				if err != nil {
+					fail(globalProfile, err)
+				}
+				globalCtx["PROFILES"] = pj
 
-			limit := templateResolveLimitOrDefault(&cfg)
+				stepStart := time.Now()
+				err = runTopStep(env, globalProfile, len(cfg.Setup)+ci, globalCtx, c)
+				summary.record(globalProfile, len(cfg.Setup)+ci, err, time.Since(stepStart))
+				if err != nil {
+					fail(globalProfile, err)
+				}
+				continue
+			}
+
+			// needs あり: 次の global ステップまでを profile ごとに DAG で実行
+			if cfg.graph.dag {
+				end := segmentEnd(cfg.Cmd, ci)
+				for _, profile := range targets {
+					if failed[profile] != nil {
+						continue
+					}
+					if err := env.checkInterrupted(); err != nil {
+						fail(profile, err)
+					}
+					if err := runStepDAG(env, profile, ctxByProfile[profile], cfg.Cmd, cfg.graph, ci, end, len(cfg.Setup)); err != nil {
+						stepFailed(profile, err, failed)
+					}
+				}
+				ci = end - 1
+				continue
+			}
 
-			if err := runCmdTreeForProfile(mw, dryRun, profile, region, limit, ctx, c); err != nil {
-				// 失敗したら即停止（今まで通り）
-				die(err)
+			for _, profile := range targets {
+				if failed[profile] != nil {
+					continue
+				}
+				// profileごとにctxは独立させる（captureで汚染しない）
+				ctx := ctxByProfile[profile]
+
+				if err := env.checkInterrupted(); err != nil {
+					fail(profile, err)
+				}
+				stepStart := time.Now()
+				err := runTopStep(env, profile, len(cfg.Setup)+ci, ctx, c)
+				summary.record(profile, len(cfg.Setup)+ci, err, time.Since(stepStart))
+				if err != nil {
+					// rollout でなければ即停止。rollout ではこの profile の残りのステップだけ実行しない
+					stepFailed(profile, err, failed)
+				}
 			}
 		}
 	}
 
+	if cfg.Rollout == nil {
+		runCmds(profiles, nil)
+	} else {
+		// hook は実行を始めた wave の profile だけ
+		hookProfiles = nil
+		failedProfile, err := runRollout(env, cfg.Rollout, waves, func(targets []string, failed map[string]error) {
+			hookProfiles = append(hookProfiles, targets...)
+			runCmds(targets, failed)
+		})
+		if err != nil {
+			fail(failedProfile, err)
+		}
+	}
+
 	// ---------- Global end ----------
+	runTopLevelHooks(env, &cfg, hookProfiles, ctxByProfile, "", nil)
+	finish("ok")
 	runEnd := time.Now()
 	totalDuration := runEnd.Sub(runStart)
 	fmt.Fprintf(mw, "\nEND | %s | TOTAL %s\n",
 		runEnd.Format(time.RFC3339),
 		totalDuration,
 	)
+	events.emit(event{Event: "run_end", Status: "ok", DurationMs: durationMs(totalDuration)})
 }
 
-func parseArgs(args []string) (cfgPath string, dryRun bool) {
-	// usage: necro <yml-file> [--dry-run]
-	// accept --dry-run anywhere after program name
+type cliOptions struct {
+	CfgPath string
+	DryRun  bool
+	Reports []string // --report <path>（.json / .md / .xml(junit)）、複数指定可
+
+	ConfirmPrd int // --confirm-prd=<count>: protect に一致する profile の数（入力の代わり）。未指定は -1
+}
+
+func parseArgs(args []string) (cliOptions, error) {
+	// usage: necro <yml-file> [--dry-run] [--report <path>]... [--confirm-prd=<count>]
+	// accept options anywhere after program name
+	opts := cliOptions{ConfirmPrd: -1}
 	for i := 1; i < len(args); i++ {
-		if args[i] == "--dry-run" {
-			dryRun = true
+		a := args[i]
+		switch {
+		case a == "--dry-run":
+			opts.DryRun = true
+			continue
+		case a == "--report":
+			if i+1 >= len(args) {
+				return opts, fmt.Errorf("--report requires a path")
+			}
+			i++
+			opts.Reports = append(opts.Reports, args[i])
+			continue
+		case strings.HasPrefix(a, "--report="):
+			opts.Reports = append(opts.Reports, strings.TrimPrefix(a, "--report="))
+			continue
+		case a == "--confirm-prd" || strings.HasPrefix(a, "--confirm-prd="):
+			v := strings.TrimPrefix(a, "--confirm-prd=")
+			if a == "--confirm-prd" {
+				if i+1 >= len(args) {
+					return opts, fmt.Errorf("--confirm-prd requires the number of protected profiles")
+				}
+				i++
+				v = args[i]
+			}
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 0 {
+				return opts, fmt.Errorf("--confirm-prd: invalid count %q", v)
+			}
+			opts.ConfirmPrd = n
 			continue
 		}
-		if cfgPath == "" && !strings.HasPrefix(args[i], "-") {
-			cfgPath = args[i]
+		if opts.CfgPath == "" && !strings.HasPrefix(a, "-") {
+			opts.CfgPath = a
+		}
+	}
+	for _, rp := range opts.Reports {
+		if err := validateReportPath(rp); err != nil {
+			return opts, err
 		}
 	}
-	return cfgPath, dryRun
+	return opts, nil
 }
 
 func usage() {
@@ -241,25 +582,33 @@ func usage() {
 	fmt.Println("")
 	fmt.Println("Usage:")
 	fmt.Println("  necro version")
-	fmt.Println("  necro <yml-file> [--dry-run]")
+	fmt.Println("  necro gen aws-config --profile <management-profile> [--sso-session NAME] [--role-name TEMPLATE] [--region REGION] [--split _] [--out FILE] [--vars-out FILE] [--merge ~/.aws/config] [--dry-run]")
+	fmt.Println("  necro graph <yml-file> [--format dot|mermaid]")
+	fmt.Println("  necro <yml-file> [--dry-run] [--report report.json|report.md|junit.xml]... [--confirm-prd=<count>]")
 }
 
 func confirmProceed() bool {
-	fmt.Print("\nProceed? (y/N): ")
-	in := bufio.NewScanner(os.Stdin)
-	if !in.Scan() {
+	return confirmPrompt("\nProceed? (y/N): ")
+}
+
+// stdin は確認の入力（rollout の wave ごとの確認でも同じものを読む）。
+var stdin = bufio.NewScanner(os.Stdin)
+
+func confirmPrompt(prompt string) bool {
+	fmt.Print(prompt)
+	if !stdin.Scan() {
 		return false
 	}
-	return strings.ToLower(strings.TrimSpace(in.Text())) == "y"
+	return strings.ToLower(strings.TrimSpace(stdin.Text())) == "y"
 }
 
-func mergeVarsNoOverride(dst map[string]string, add map[string]string) {
+func mergeVarsNoOverride(dst map[string]string, add map[string]string, setupVars map[string]bool) {
 	if add == nil {
 		return
 	}
 	for k, v := range add {
-		// built-in keys must win
-		if isBuiltInKey(k) {
+		// built-in keys (and setup captures) must win
+		if isReadOnlyKey(setupVars, k) {
 			continue
 		}
 		dst[k] = v
@@ -270,15 +619,24 @@ func isBuiltInKey(k string) bool {
 	return k == "PROFILE" || k == "REGION" || k == "ACCOUNT_ID" || k == "RUN_ID"
 }
 
+func builtInCtx(ctx map[string]string) map[string]string {
+	out := make(map[string]string, 4)
+	for k, v := range ctx {
+		if isBuiltInKey(k) {
+			out[k] = v
+		}
+	}
+	return out
+}
+
 func renderAWSArgs(profile, region string, run []string, ctx map[string]string) ([]string, error) {
 	// build final: aws --profile ... --region ... --output json + rendered run args
-	full := []string{
-		"aws",
-		"--no-cli-pager",
-		"--profile", profile,
-		"--region", region,
-		"--output", "json",
+	full := []string{"aws", "--no-cli-pager"}
+	// setup / scope: global は --profile なし（AWS_PROFILE / 既定の認証情報、または args の --profile）
+	if profile != globalProfile {
+		full = append(full, "--profile", profile)
 	}
+	full = append(full, "--region", region, "--output", "json")
 
 	for _, a := range run {
 		na, _, err := renderTemplateString(a, ctx)
@@ -331,8 +689,12 @@ func getCallerIdentity(profile, region string) (accountID string, arn string, er
 	return data.Account, data.Arn, "", nil
 }
 
-func runShellAndCapture(script string, stdinBytes []byte, w io.Writer) (stdout []byte, err error) {
-	cmd := exec.Command("bash", "-lc", script)
+func runShellAndCapture(shell, script string, stdinBytes []byte, w io.Writer) (stdout []byte, err error) {
+	argv, err := shellArgv(shell, script)
+	if err != nil {
+		return nil, err
+	}
+	cmd := exec.Command(argv[0], argv[1:]...)
 
 	var outBuf bytes.Buffer
 	cmd.Stdout = io.MultiWriter(w, &outBuf)
@@ -347,7 +709,9 @@ func runShellAndCapture(script string, stdinBytes []byte, w io.Writer) (stdout [
 		"AWS_CLI_AUTO_PROMPT=off",
 	)
 
-	if e := cmd.Run(); e != nil {
+	e := cmd.Run()
+	flushWriter(w)
+	if e != nil {
 		return outBuf.Bytes(), e
 	}
 	return outBuf.Bytes(), nil
@@ -368,7 +732,9 @@ func runAWSAndCapture(full []string, w io.Writer) (stdout []byte, err error) {
 		"AWS_CLI_AUTO_PROMPT=off",
 	)
 
-	if e := cmd.Run(); e != nil {
+	e := cmd.Run()
+	flushWriter(w)
+	if e != nil {
 		return outBuf.Bytes(), e
 	}
 	return outBuf.Bytes(), nil
@@ -434,17 +800,23 @@ func dieIf(err error) {
 }
 
 func die(err error) {
-	fmt.Fprintln(os.Stderr, "error:", err)
+	fmt.Fprintln(os.Stderr, "error:", secretValues.mask(err.Error()))
 	os.Exit(1)
 }
 
 func handleSubcommand(args []string) bool {
-	// subcommands: version, help
+	// subcommands: version, help, gen, graph
 	if len(args) < 2 {
 		return false
 	}
 
 	switch args[1] {
+	case "gen":
+		handleGen(args[2:])
+		return true
+	case "graph":
+		handleGraph(args[2:])
+		return true
 	case "version":
 		fmt.Printf("necro %s (commit=%s, date=%s)\n", version, commit, date)
 		return true
@@ -479,7 +851,7 @@ func parseJSONOrNil(b []byte) (any, bool) {
 	}
 	return v, true
 }
-func applyCapture(ctx map[string]string, last any, capMap map[string]string) error {
+func applyCapture(env *runEnv, ctx map[string]string, last any, capMap map[string]string) error {
 	if len(capMap) == 0 {
 		return nil
 	}
@@ -488,8 +860,8 @@ func applyCapture(ctx map[string]string, last any, capMap map[string]string) err
 	}
 
 	for varName, expr := range capMap {
-		if isBuiltInKey(varName) {
-			// built-inは上書きさせない（今の思想のまま）
+		if env.isReadOnlyKey(varName) {
+			// built-in / setup の変数は上書きさせない（今の思想のまま）
 			continue
 		}
 		val, err := gojmespath.Search(expr, last)
@@ -504,7 +876,7 @@ func applyCapture(ctx map[string]string, last any, capMap map[string]string) err
 		case string:
 			ctx[varName] = v
 		case bool, float64:
-			ctx[varName] = fmt.Sprint(v)
+			ctx[varName] = textValue(v)
 		default:
 			j, e := json.Marshal(v)
 			if e != nil {
@@ -512,6 +884,7 @@ func applyCapture(ctx map[string]string, last any, capMap map[string]string) err
 			}
 			ctx[varName] = string(j)
 		}
+		env.captured.add(varName)
 	}
 
 	return nil
@@ -521,110 +894,162 @@ func evalIf(ifb *IfBlock, ctx map[string]string, last any) (bool, error) {
 	if ifb == nil {
 		return true, nil
 	}
-	if last == nil {
-		return false, fmt.Errorf("if requires JSON stdout, but LAST_JSON is nil")
+	return evalCondition("if", ifb, ctx, last)
+}
+
+// runEnv は cmd ツリー実行で profile によらず共通の設定・出力先。
+type runEnv struct {
+	mw      io.Writer
+	dryRun  bool
+	region  string
+	limit   int    // template-resolve-limit
+	shell   string // 全体の shell 設定（cmd.shell が優先）
+	events  *eventLog
+	summary *runSummary
+	outs    *profileOuts    // profile ごとの out（scope: global の PROFILES 用）
+	secrets map[string]bool // vars.secrets のキー（テンプレートとして解決しない）
+	step    int             // 実行中の top-level ステップの summary の列（-1 = 記録しない）
+
+	setupVars map[string]bool // setup の capture / collect で作った変数（全 profile で読み取り専用）
+	captured  *keyRecorder    // setup の実行中だけ設定（capture / collect したキーを記録する）
+	inHook    bool            // on_failure / finally の実行中（Ctrl-C でも止めない）
+
+	lastMu sync.Mutex
+	last   map[string]any // profile -> 直前ステップの JSON 出力（LAST_JSON）
+}
+
+// fork は foreach の並列実行用に、出力先と LAST_JSON を分けた runEnv を返す。
+func (e *runEnv) fork(w io.Writer, profile string) *runEnv {
+	return &runEnv{
+		mw:      w,
+		dryRun:  e.dryRun,
+		region:  e.region,
+		limit:   e.limit,
+		shell:   e.shell,
+		events:  e.events,
+		summary: e.summary,
+		outs:    e.outs,
+		secrets: e.secrets,
+		step:    -1,
+		last:    map[string]any{profile: e.lastJSON(profile)},
+
+		setupVars: e.setupVars,
+		captured:  e.captured,
+		inHook:    e.inHook,
 	}
+}
 
-	op := strings.ToLower(strings.TrimSpace(ifb.Op))
-	if op == "" {
-		op = "eq"
+// isReadOnlyKey は built-in 変数と、この実行の setup で作った変数。
+func (e *runEnv) isReadOnlyKey(k string) bool {
+	return isReadOnlyKey(e.setupVars, k)
+}
+
+// forStep は top-level ステップ（summary の列 step）用の runEnv。if / when の結果をその列に記録する。
+func (e *runEnv) forStep(profile string, step int) *runEnv {
+	f := e.fork(e.mw, profile)
+	f.step = step
+	return f
+}
+
+// summaryStep は path が top-level ステップなら summary の列、ネストしたステップなら -1。
+func (e *runEnv) summaryStep(path string) int {
+	if strings.Contains(path, "/") {
+		return -1
 	}
+	return e.step
+}
 
-	// expr: JMESPath against LAST_JSON
-	got, err := gojmespath.Search(ifb.Expr, last)
-	if err != nil {
-		return false, fmt.Errorf("if: invalid expr %q: %w", ifb.Expr, err)
+// runTopStep は top-level ステップ（setup 含む）を実行し、LAST_JSON を env に戻す。
+func runTopStep(env *runEnv, profile string, step int, ctx map[string]string, c Cmd) error {
+	senv := env.forStep(profile, step)
+	err := runCmdTreeForProfile(senv, profile, c.Name, ctx, c)
+	env.setLastJSON(profile, senv.lastJSON(profile))
+	return err
+}
+
+func (e *runEnv) lastJSON(profile string) any {
+	e.lastMu.Lock()
+	defer e.lastMu.Unlock()
+	return e.last[profile]
+}
+
+func (e *runEnv) setLastJSON(profile string, v any) {
+	e.lastMu.Lock()
+	defer e.lastMu.Unlock()
+	if e.last == nil {
+		e.last = map[string]any{}
 	}
+	e.last[profile] = v
+}
 
-	want := ""
-	if ifb.Value != "" {
-		want, _, err = renderTemplateString(ifb.Value, ctx)
-		if err != nil {
-			return false, fmt.Errorf("if: value render failed: %w", err)
-		}
+// stepPath は JSONL / summary 用の cmd ツリー上のパス（parent/ok/child, loop[0]）。
+func stepPath(parent, branch, name string) string {
+	if parent == "" {
+		return name
+	}
+	if branch == "" {
+		return parent + "/" + name
 	}
+	return parent + "/" + branch + "/" + name
+}
 
-	switch op {
-	case "exists":
-		return got != nil, nil
+func runCmdTreeForProfile(env *runEnv, profile string, path string, ctx map[string]string, c Cmd) (err error) {
+	mw := env.mw
+	dryRun := env.dryRun
+	region := env.region
 
-	case "eq", "ne":
-		gs := fmt.Sprint(got)
-		if op == "eq" {
-			return gs == want, nil
-		}
-		return gs != want, nil
+	// 失敗したステップの定義元（file:line）をエラーに付ける
+	defer func() { err = withStepSource(err, c) }()
 
-	case "contains":
-		// string contains / array contains
-		switch v := got.(type) {
-		case string:
-			return strings.Contains(v, want), nil
-		case []any:
-			for _, it := range v {
-				if fmt.Sprint(it) == want {
-					return true, nil
-				}
-			}
-			return false, nil
-		default:
-			return false, fmt.Errorf("if contains: unsupported type %T", got)
+	// with: このステップ（子ステップ含む）の実行中だけ ctx に入れる
+	if len(c.With) > 0 {
+		restore, e := applyWith(ctx, c.With, env.setupVars)
+		if e != nil {
+			fmt.Fprintf(mw, "❌ CMD NG    | %s | profile=%s (with)\n", c.Name, profile)
+			return e
 		}
+		defer restore()
+	}
 
-	case "in":
-		// want is comma-separated list OR JSON array string. keep it simple: comma list.
-		parts := strings.Split(want, ",")
-		gs := fmt.Sprint(got)
-		for _, p := range parts {
-			if strings.TrimSpace(p) == gs {
-				return true, nil
+	// on_failure: 失敗した時点の ctx（with を含む）で実行し、元のエラーを返す
+	// foreach のステップは失敗した要素ごとに（要素の変数が入った ctx で）実行する
+	if len(c.OnFailure) > 0 && c.ForEach == nil {
+		defer func() {
+			if err == nil {
+				return
 			}
-		}
-		return false, nil
-
-	default:
-		return false, fmt.Errorf("if: unsupported op: %s", op)
+			step, msg := failureVars(c, err)
+			_ = runHooks(env, profile, path, "on_failure", ctx, map[string]string{"FAILED_STEP": step, "ERROR": msg}, c.OnFailure)
+		}()
 	}
-}
 
-func runCmdTreeForProfile(mw io.Writer, dryRun bool, profile string, region string, templateResolveLimit int, ctx map[string]string, c Cmd) error {
+	// when: false ならこのステップ（foreach / 子ステップ含む）を実行しない
+	if c.When != nil {
+		pass, reason, e := evalWhen(c.When, ctx, env.lastJSON(profile))
+		if e != nil {
+			fmt.Fprintf(mw, "❌ WHEN NG   | %s | profile=%s\n", c.Name, profile)
+			return e
+		}
+		if !pass {
+			fmt.Fprintf(mw, "⏭  SKIP      | %s | profile=%s | %s\n", c.Name, profile, reason)
+			env.events.emit(event{Event: "skip", Profile: profile, Step: path, Status: "skip", Reason: reason})
+			env.summary.recordSkip(profile, env.summaryStep(path), reason)
+			return nil
+		}
+	}
 
 	// ===============================
 	// foreach handling
 	// ===============================
 	if c.ForEach != nil {
-		raw, ok := ctx[c.ForEach.Var]
-		if !ok {
-			return fmt.Errorf("foreach: undefined variable: %s", c.ForEach.Var)
-		}
-
-		var arr []any
-		if err := json.Unmarshal([]byte(raw), &arr); err != nil {
-			return fmt.Errorf("foreach: variable %s is not JSON array", c.ForEach.Var)
-		}
-
-		for _, item := range arr {
-			childCtx := copyMap(ctx)
-			childCtx[c.ForEach.As] = fmt.Sprint(item)
-
-			// IMPORTANT:
-			// Copy the entire command so that Aws/Sh/In/Out/Run/etc are preserved.
-			// Only remove ForEach to avoid infinite recursion.
-			childCmd := c
-			childCmd.ForEach = nil
-
-			if err := runCmdTreeForProfile(mw, dryRun, profile, region, templateResolveLimit, childCtx, childCmd); err != nil {
-				return err
-			}
-		}
-		return nil
+		return runForEach(env, profile, path, ctx, c)
 	}
 
 	// ===============================
 	// normal execution
 	// ===============================
 
-	// Determine command kind (priority: aws -> sh -> run(backward))
+	// Determine command kind (priority: aws -> sh -> built-in -> run(backward))
 	kind := ""
 	var awsArgs []string
 	shScript := ""
@@ -632,9 +1057,19 @@ func runCmdTreeForProfile(mw io.Writer, dryRun bool, profile string, region stri
 	if len(c.Aws) > 0 {
 		kind = "aws"
 		awsArgs = c.Aws
-	} else if strings.TrimSpace(c.Sh) != "" {
+	} else if !c.Sh.IsZero() {
 		kind = "sh"
-		shScript = c.Sh
+		shScript = c.Sh.For(hostOS)
+		if strings.TrimSpace(shScript) == "" {
+			fmt.Fprintf(mw, "❌ CMD NG    | %s | profile=%s (sh)\n", c.Name, profile)
+			return fmt.Errorf("sh: no script for os=%s", hostOS)
+		}
+	} else if c.Transform != nil {
+		kind = "transform"
+	} else if c.Render != nil {
+		kind = "render"
+	} else if c.File != nil {
+		kind = "file"
 	} else {
 		kind = "aws"
 		awsArgs = c.Run
@@ -644,20 +1079,39 @@ func runCmdTreeForProfile(mw io.Writer, dryRun bool, profile string, region stri
 	var finalArgs []string
 	var renderedSh string
 	var renderedInPath string
-	var err error
 
-	if kind == "aws" {
-		finalArgs, err = renderAWSArgs(profile, region, awsArgs, ctx)
+	shell := ""
+	if kind == "sh" {
+		shell, err = resolveShell(c.Shell, env.shell, hostOS)
+		if err != nil {
+			fmt.Fprintf(mw, "❌ CMD NG    | %s | profile=%s (shell)\n", c.Name, profile)
+			return err
+		}
+	}
+
+	var renderedFile FileBlock
+	if kind == "file" {
+		renderedFile, err = renderFileBlock(c.File, ctx)
 		if err != nil {
 			fmt.Fprintf(mw, "❌ CMD NG    | %s | profile=%s (render)\n", c.Name, profile)
 			return err
 		}
-	} else {
-		renderedSh, _, err = renderTemplateString(shScript, ctx)
+	}
+
+	if kind == "aws" {
+		finalArgs, err = renderAWSArgs(profile, region, awsArgs, ctx)
 		if err != nil {
 			fmt.Fprintf(mw, "❌ CMD NG    | %s | profile=%s (render)\n", c.Name, profile)
 			return err
 		}
+	} else {
+		if kind == "sh" {
+			renderedSh, _, err = renderTemplateString(shScript, ctx)
+			if err != nil {
+				fmt.Fprintf(mw, "❌ CMD NG    | %s | profile=%s (render)\n", c.Name, profile)
+				return err
+			}
+		}
 
 		if strings.TrimSpace(c.In) != "" {
 			renderedInPath, _, err = renderTemplateString(c.In, ctx)
@@ -670,15 +1124,35 @@ func runCmdTreeForProfile(mw io.Writer, dryRun bool, profile string, region stri
 
 	// Dry-run preview
 	if dryRun {
-		fmt.Fprintf(mw, "🧪 RUN PLAN  | %s | profile=%s\n", c.Name, profile)
-		if kind == "aws" {
-			fmt.Fprintln(mw, strings.Join(finalArgs, " "))
-		} else {
-			if strings.TrimSpace(renderedInPath) != "" {
-				fmt.Fprintf(mw, "cat %s | %s\n", renderedInPath, renderedSh)
-			} else {
-				fmt.Fprintln(mw, renderedSh)
+		env.events.emit(event{Event: "step_plan", Profile: profile, Step: path, Argv: finalArgs, Sh: renderedSh, In: renderedInPath})
+		switch kind {
+		case "transform":
+			format, e := transformFormat(c.Transform)
+			if e != nil {
+				return e
+			}
+			fmt.Fprintf(mw, "🧪 TRANSFORM PLAN | %s | profile=%s | %s | expr=%s | format=%s\n",
+				c.Name, profile, transformInputDesc(c.Transform, renderedInPath), c.Transform.Expr, format)
+		case "file":
+			fmt.Fprintf(mw, "🧪 FILE PLAN | %s | profile=%s | %s\n", c.Name, profile, renderedFile.desc())
+		case "render":
+			tplPath, _, e := renderTemplateString(c.Render.Template, ctx)
+			if e != nil {
+				fmt.Fprintf(mw, "❌ CMD NG    | %s | profile=%s (render-template)\n", c.Name, profile)
+				return fmt.Errorf("render: template path: %w", e)
+			}
+			fmt.Fprintf(mw, "🧪 RENDER PLAN | %s | profile=%s | template=%s | data=%s",
+				c.Name, profile, tplPath, renderDataDesc(c.Render, renderedInPath))
+			if c.Render.Marker != "" {
+				fmt.Fprintf(mw, " | marker=%q", c.Render.Marker)
 			}
+			fmt.Fprintln(mw)
+		case "aws":
+			fmt.Fprintf(mw, "🧪 RUN PLAN  | %s | profile=%s\n", c.Name, profile)
+			fmt.Fprintln(mw, strings.Join(finalArgs, " "))
+		default:
+			fmt.Fprintf(mw, "🧪 RUN PLAN  | %s | profile=%s | shell=%s\n", c.Name, profile, shell)
+			fmt.Fprintln(mw, shellPreview(shell, renderedSh, strings.TrimSpace(renderedInPath)))
 		}
 		if strings.TrimSpace(c.Out) != "" {
 			outPath, _, e := renderTemplateString(c.Out, ctx)
@@ -687,11 +1161,18 @@ func runCmdTreeForProfile(mw io.Writer, dryRun bool, profile string, region stri
 			}
 			fmt.Fprintf(mw, "🧪 OUT PLAN  | %s | profile=%s | path=%s\n", c.Name, profile, outPath)
 		}
+		if c.Until != nil {
+			fmt.Fprintf(mw, "🧪 UNTIL PLAN | %s | profile=%s | %s\n", c.Name, profile, c.Until.desc())
+		}
+		if c.Switch != nil {
+			return runSwitch(env, profile, path, ctx, c, nil)
+		}
 		return nil
 	}
 
 	// Execute
 	fmt.Fprintf(mw, "▶️  RUN | %s | profile=%s\n", c.Name, profile)
+	env.events.emit(event{Event: "step_start", Profile: profile, Step: path, Argv: finalArgs, Sh: renderedSh, In: renderedInPath})
 
 	runCmdStart := time.Now()
 
@@ -706,19 +1187,71 @@ func runCmdTreeForProfile(mw io.Writer, dryRun bool, profile string, region stri
 		fmt.Fprintf(mw, "📥 IN OK     | %s | profile=%s | path=%s\n", c.Name, profile, renderedInPath)
 	}
 
+	// 1回分の実行（until ではこれを繰り返す）。出力は w へ
+	// LAST_JSON: aws / sh は stdout の JSON（JSON でなければ nil）、built-in は結果をそのまま
+	execOnce := func(w io.Writer) (stdout []byte, last any, err error) {
+		switch kind {
+		case "aws":
+			stdout, err = runAWSAndCapture(finalArgs, w)
+		case "transform":
+			stdout, last, err = runTransform(c.Transform, ctx, renderedInPath, env.lastJSON(profile))
+			if err == nil && strings.TrimSpace(c.Out) == "" {
+				_, _ = w.Write(stdout)
+			}
+			return stdout, last, err
+		case "file":
+			err = runFileOp(renderedFile)
+			if err == nil {
+				fmt.Fprintf(w, "📁 FILE OK   | %s | profile=%s | %s\n", c.Name, profile, renderedFile.desc())
+			}
+			return stdout, nil, err
+		case "render":
+			outPath := ""
+			if strings.TrimSpace(c.Out) != "" {
+				outPath, _, err = renderTemplateString(c.Out, ctx)
+			}
+			if err == nil {
+				stdout, err = runRender(c.Render, ctx, renderedInPath, outPath, env.lastJSON(profile))
+			}
+			if err == nil && outPath == "" {
+				_, _ = w.Write(stdout)
+			}
+			return stdout, nil, err
+		default:
+			stdout, err = runShellAndCapture(shell, renderedSh, stdinBytes, w)
+		}
+		if v, ok := parseJSONOrNil(stdout); ok {
+			last = v
+		}
+		return stdout, last, err
+	}
+
 	var stdout []byte
-	if kind == "aws" {
-		stdout, err = runAWSAndCapture(finalArgs, mw)
+	var last any
+	if c.Until != nil {
+		stdout, last, err = runUntil(env, profile, path, c, ctx, execOnce)
 	} else {
-		stdout, err = runShellAndCapture(renderedSh, stdinBytes, mw)
+		stdout, last, err = execOnce(mw)
 	}
 
 	runCmdDuration := time.Since(runCmdStart)
 
+	stepEnd := event{
+		Event:      "step_end",
+		Profile:    profile,
+		Step:       path,
+		Status:     "ok",
+		ExitCode:   exitCodeOf(err),
+		DurationMs: durationMs(runCmdDuration),
+	}
 	if err != nil {
 		fmt.Fprintf(mw, "❌ RUN NG    | %s | profile=%s | duration=%s\n", c.Name, profile, runCmdDuration)
+		stepEnd.Status = "ng"
+		stepEnd.Error = errString(err)
+		env.events.emit(stepEnd)
 		return err
 	}
+	env.events.emit(stepEnd)
 
 	// out: save raw stdout to file (no formatting)
 	if strings.TrimSpace(c.Out) != "" {
@@ -741,29 +1274,32 @@ func runCmdTreeForProfile(mw io.Writer, dryRun bool, profile string, region stri
 			return fmt.Errorf("out write failed: %w", e)
 		}
 		fmt.Fprintf(mw, "💾 OUT OK    | %s | profile=%s | path=%s\n", c.Name, profile, outPath)
+		env.outs.record(profile, path, outPath)
+		env.events.emit(event{Event: "out", Profile: profile, Step: path, Status: "ok", Out: outPath})
 	}
 
-	// parse LAST_JSON (works for aws and sh; if sh doesn't output JSON, LAST_JSON=nil)
-	last, ok := parseJSONOrNil(stdout)
-	if !ok {
-		last = nil
-	}
+	// LAST_JSON (works for aws and sh; if sh doesn't output JSON, LAST_JSON=nil)
+	env.setLastJSON(profile, last)
 
 	// capture
 	if len(c.Capture) > 0 {
-		if err := applyCapture(ctx, last, c.Capture); err != nil {
+		if err := applyCapture(env, ctx, last, c.Capture); err != nil {
 			fmt.Fprintf(mw, "❌ CAPTURE NG | %s | profile=%s\n", c.Name, profile)
 			return err
 		}
 
-		// NOTE: cfg is not in scope here, so default is used unless you pass limit down.
-		// If you want cfg-based limit here, pass it into runCmdTreeForProfile as an arg.
-		if err := resolveContextTemplates(ctx, templateResolveLimit); err != nil {
+		if err := resolveContextTemplates(ctx, env.limit, env.secrets); err != nil {
 			fmt.Fprintf(mw, "❌ RESOLVE NG | %s | profile=%s\n", c.Name, profile)
 			return err
 		}
 
 		fmt.Fprintf(mw, "✅ CAPTURE OK | %s | profile=%s\n", c.Name, profile)
+
+		captured := make(map[string]string, len(c.Capture))
+		for k := range c.Capture {
+			captured[k] = ctx[k]
+		}
+		env.events.emit(event{Event: "capture", Profile: profile, Step: path, Status: "ok", Captures: captured})
 	}
 
 	// if handling
@@ -774,23 +1310,35 @@ func runCmdTreeForProfile(mw io.Writer, dryRun bool, profile string, region stri
 			return err
 		}
 
+		env.events.emit(event{Event: "if", Profile: profile, Step: path, IfResult: boolPtr(pass)})
+		if pass {
+			env.summary.recordBranch(profile, env.summaryStep(path), "ok")
+		} else {
+			env.summary.recordBranch(profile, env.summaryStep(path), "ng")
+		}
+
 		if pass {
 			fmt.Fprintf(mw, "✅ IF OK     | %s | profile=%s\n", c.Name, profile)
 			for _, child := range c.Ok {
-				if err := runCmdTreeForProfile(mw, dryRun, profile, region, templateResolveLimit, ctx, child); err != nil {
+				if err := runCmdTreeForProfile(env, profile, stepPath(path, "ok", child.Name), ctx, child); err != nil {
 					return err
 				}
 			}
 		} else {
 			fmt.Fprintf(mw, "❌ IF NG     | %s | profile=%s\n", c.Name, profile)
 			for _, child := range c.Ng {
-				if err := runCmdTreeForProfile(mw, dryRun, profile, region, templateResolveLimit, ctx, child); err != nil {
+				if err := runCmdTreeForProfile(env, profile, stepPath(path, "ng", child.Name), ctx, child); err != nil {
 					return err
 				}
 			}
 		}
 	}
 
+	// switch handling
+	if c.Switch != nil {
+		return runSwitch(env, profile, path, ctx, c, last)
+	}
+
 	return nil
 }
 func templateResolveLimitOrDefault(cfg *Config) int {
@@ -803,26 +1351,144 @@ func templateResolveLimitOrDefault(cfg *Config) int {
 	return 10
 }
 
-func renderTemplateString(s string, ctx map[string]string) (string, bool, error) {
+func parseTemplate(s string) (*template.Template, error) {
 	// Go template + sprig. undefined key -> error
 	tpl, err := template.New("necro").
 		Option("missingkey=error").
 		Funcs(sprig.TxtFuncMap()).
 		Parse(s)
 	if err != nil {
-		return "", false, fmt.Errorf("template parse failed: %w (in %q)", err, s)
+		return nil, fmt.Errorf("template parse failed: %w (in %q)", err, s)
+	}
+	return tpl, nil
+}
+
+func renderTemplateString(s string, ctx map[string]string) (string, bool, error) {
+	tpl, err := parseTemplate(s)
+	if err != nil {
+		return "", false, err
 	}
 
 	var buf bytes.Buffer
-	if err := tpl.Execute(&buf, ctx); err != nil {
+	if err := tpl.Execute(&buf, ctxTemplateData(tpl, ctx)); err != nil {
 		return "", false, fmt.Errorf("template exec failed: %w (in %q)", err, s)
 	}
-
 	out := buf.String()
 	return out, out != s, nil
 }
 
-func resolveContextTemplates(ctx map[string]string, limit int) error {
+// ctxTemplateData は .ITEM.key / range .LIST / index .MAP "k" のように使われている ctx 変数が
+// JSON オブジェクト / 配列なら、その変数だけ構造化した値で渡す（それ以外は ctx の文字列のまま）。
+func ctxTemplateData(tpl *template.Template, ctx map[string]string) any {
+	if tpl.Tree == nil {
+		return ctx
+	}
+	deep := map[string]struct{}{}
+	collectTemplateFieldRefs(tpl.Tree.Root, deep)
+
+	var data map[string]any
+	for k := range deep {
+		raw, ok := ctx[k]
+		if !ok {
+			continue
+		}
+		v, ok := parseJSONOrNil([]byte(raw))
+		if !ok {
+			continue
+		}
+		switch v.(type) {
+		case map[string]any, []any:
+		default:
+			continue
+		}
+		if data == nil {
+			data = make(map[string]any, len(ctx))
+			for ck, cv := range ctx {
+				data[ck] = cv
+			}
+		}
+		data[k] = templateJSON(v)
+	}
+	if data == nil {
+		return ctx
+	}
+	return data
+}
+
+// jsonObject / jsonArray はテンプレートでフィールドを辿れて、そのまま出力すると JSON になる値。
+type (
+	jsonObject map[string]any
+	jsonArray  []any
+)
+
+func (o jsonObject) String() string { return textValue(map[string]any(o)) }
+func (a jsonArray) String() string  { return textValue([]any(a)) }
+
+func templateJSON(v any) any {
+	switch t := v.(type) {
+	case map[string]any:
+		out := make(jsonObject, len(t))
+		for k, it := range t {
+			out[k] = templateJSON(it)
+		}
+		return out
+	case []any:
+		out := make(jsonArray, len(t))
+		for i, it := range t {
+			out[i] = templateJSON(it)
+		}
+		return out
+	default:
+		return v
+	}
+}
+
+// renderTemplateData は ctx 以外のデータ（JSON の要素など）でテンプレートを展開する。
+func renderTemplateData(s string, data any) (string, error) {
+	tpl, err := parseTemplate(s)
+	if err != nil {
+		return "", err
+	}
+
+	var buf bytes.Buffer
+	if err := tpl.Execute(&buf, data); err != nil {
+		return "", fmt.Errorf("template exec failed: %w (in %q)", err, s)
+	}
+	return buf.String(), nil
+}
+
+// resolveContextTemplates は ctx の値をテンプレートとして解決する。
+// literal のキー（secrets）は値に {{ }} が含まれていてもそのまま使う。
+func resolveContextTemplates(ctx map[string]string, limit int, literal map[string]bool) error {
+	// 1) テンプレートの参照(.KEY)から依存グラフを作り、トポロジカル順に1回ずつ解決
+	//    循環参照はここでエラー（A -> B -> A）
+	order, dynamic, err := resolveOrder(ctx, literal)
+	if err != nil {
+		return err
+	}
+
+	for _, k := range order {
+		if literal[k] {
+			continue
+		}
+		nv, didChange, err := renderTemplateString(ctx[k], ctx)
+		if err != nil {
+			return fmt.Errorf("resolve ctx[%s] failed: %w", k, err)
+		}
+		if didChange {
+			ctx[k] = nv
+		}
+	}
+
+	// 2) 動的参照（index . "KEY" / range / with 等）や、解決結果にまだテンプレートが
+	//    残っている場合のみ、従来の反復評価にフォールバック
+	if !dynamic && !hasTemplateLeft(ctx, literal) {
+		return nil
+	}
+	return resolveContextTemplatesIterative(ctx, limit, literal)
+}
+
+func resolveContextTemplatesIterative(ctx map[string]string, limit int, literal map[string]bool) error {
 	// resolve all ctx values as templates using ctx itself, iteratively until stable
 	if limit <= 0 {
 		limit = 10
@@ -839,6 +1505,9 @@ func resolveContextTemplates(ctx map[string]string, limit int) error {
 		sort.Strings(keys)
 
 		for _, k := range keys {
+			if literal[k] {
+				continue
+			}
 			v := ctx[k]
 			nv, didChange, err := renderTemplateString(v, ctx)
 			if err != nil {
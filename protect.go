@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+)
+
+// protect: 本番などの profile を実行するときは、y/N ではなくアカウントの alias / ID の入力を必須にする。
+//
+//	protect: ["*_PRD", "COM_SEC"]   # profile 名のパターン（* / ? / [...]）
+//
+// 対象に一致する profile があれば、一覧（alias / ID）を表示し、profile ごとに alias か ID を入力させる。
+// CI などでは --confirm-prd=<一致する profile の数> で入力の代わりにできる。dry-run では確認しない。
+
+// validateProtect はパターンの書式を確認する。
+func validateProtect(patterns []string) error {
+	for _, p := range patterns {
+		if _, err := path.Match(p, ""); err != nil {
+			return fmt.Errorf("protect: invalid pattern %q: %w", p, err)
+		}
+	}
+	return nil
+}
+
+// isProtected は profile が protect のパターンに一致するか。
+func isProtected(patterns []string, profile string) bool {
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, profile); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// protectedProfiles は profiles のうち protect に一致するもの（profiles の順）。
+func protectedProfiles(patterns, profiles []string) []string {
+	var out []string
+	for _, p := range profiles {
+		if isProtected(patterns, p) {
+			out = append(out, p)
+		}
+	}
+	return out
+}
+
+type protectTarget struct {
+	profile string
+	account string
+	alias   string // 無ければ ""
+}
+
+// lookupProtectTargets は確認用に各 profile のアカウント ID と alias を取得する。
+// alias（iam list-account-aliases）が取れなければ ID だけで確認する。
+func lookupProtectTargets(profiles []string, region string) ([]protectTarget, error) {
+	targets := make([]protectTarget, 0, len(profiles))
+	for _, p := range profiles {
+		accountID, _, errText, err := getCallerIdentity(p, region)
+		if err != nil {
+			return nil, fmt.Errorf("protect: profile %s: sts get-caller-identity: %w", p, awsQuietError(err, strings.TrimSpace(errText)))
+		}
+		t := protectTarget{profile: p, account: accountID}
+
+		if b, _, err := runAWSQuiet(p, region, "iam", "list-account-aliases"); err == nil {
+			var res struct {
+				AccountAliases []string `json:"AccountAliases"`
+			}
+			if json.Unmarshal(b, &res) == nil && len(res.AccountAliases) > 0 {
+				t.alias = res.AccountAliases[0]
+			}
+		}
+		targets = append(targets, t)
+	}
+	return targets, nil
+}
+
+func (t protectTarget) desc() string {
+	if t.alias == "" {
+		return fmt.Sprintf("%s | account=%s", t.profile, t.account)
+	}
+	return fmt.Sprintf("%s | account=%s | alias=%s", t.profile, t.account, t.alias)
+}
+
+// confirmProtected は protect に一致する profile の実行を確認する（入力は in から1行ずつ読む）。
+// confirmCount >= 0（--confirm-prd）なら入力の代わりに数の一致を確認する。
+// 戻り値の reason は run_start に残す確認方法。
+func confirmProtected(mw io.Writer, in *bufio.Scanner, targets []protectTarget, confirmCount int) (reason string, err error) {
+	fmt.Fprintf(mw, "\n==== 🔒 PROTECTED PROFILES (%d) ====\n", len(targets))
+	for _, t := range targets {
+		fmt.Fprintln(mw, "-", t.desc())
+	}
+	if f, ok := mw.(interface{ Flush() error }); ok {
+		_ = f.Flush()
+	}
+
+	if confirmCount >= 0 {
+		if confirmCount != len(targets) {
+			return "", fmt.Errorf("protect: --confirm-prd=%d does not match the number of protected profiles (%d)", confirmCount, len(targets))
+		}
+		fmt.Fprintf(mw, "🔒 CONFIRMED | --confirm-prd=%d\n", confirmCount)
+		return fmt.Sprintf("--confirm-prd=%d", confirmCount), nil
+	}
+
+	for _, t := range targets {
+		want := "account ID"
+		if t.alias != "" {
+			want = "account alias or ID"
+		}
+		fmt.Printf("\nType the %s of %s to proceed: ", want, t.profile)
+		if !in.Scan() {
+			return "", fmt.Errorf("protect: cancelled (%s)", t.profile)
+		}
+		typed := strings.TrimSpace(in.Text())
+		if typed == "" || (typed != t.account && typed != t.alias) {
+			return "", fmt.Errorf("protect: cancelled: %q does not match the %s of %s", typed, want, t.profile)
+		}
+	}
+	fmt.Fprintf(mw, "🔒 CONFIRMED | typed %d account alias / ID\n", len(targets))
+	return "typed", nil
+}
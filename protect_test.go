@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bufio"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestProtectedProfiles(t *testing.T) {
+	profiles := []string{"COM_DEV", "COM_PRD", "COM_PRD2", "SND_PRD", "COM_SEC", "SEC_DEV"}
+	tests := []struct {
+		name     string
+		patterns []string
+		want     []string
+	}{
+		{name: "suffix", patterns: []string{"*_PRD"}, want: []string{"COM_PRD", "SND_PRD"}},
+		{name: "exact name", patterns: []string{"COM_SEC"}, want: []string{"COM_SEC"}},
+		{name: "single char", patterns: []string{"COM_PRD?"}, want: []string{"COM_PRD2"}},
+		{name: "class", patterns: []string{"[CS]*_DEV"}, want: []string{"COM_DEV", "SEC_DEV"}},
+		{name: "several patterns keep profile order", patterns: []string{"COM_SEC", "*_PRD"}, want: []string{"COM_PRD", "SND_PRD", "COM_SEC"}},
+		{name: "case sensitive", patterns: []string{"*_prd"}},
+		{name: "no patterns"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := protectedProfiles(tt.patterns, profiles); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("protectedProfiles = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	if err := validateProtect([]string{"*_PRD", "COM_[DP]*"}); err != nil {
+		t.Errorf("validateProtect: %v", err)
+	}
+	if err := validateProtect([]string{"COM_[PRD"}); err == nil || !strings.Contains(err.Error(), `protect: invalid pattern "COM_[PRD"`) {
+		t.Errorf("err = %v, want invalid pattern", err)
+	}
+}
+
+func TestConfirmProtected(t *testing.T) {
+	prd := protectTarget{profile: "COM_PRD", account: "111111111111", alias: "necro-prd"}
+	sec := protectTarget{profile: "COM_SEC", account: "333333333333"} // alias 無し
+
+	tests := []struct {
+		name       string
+		targets    []protectTarget
+		input      string
+		count      int
+		wantReason string
+		wantErr    string
+	}{
+		{name: "right alias", targets: []protectTarget{prd}, input: "necro-prd\n", count: -1, wantReason: "typed"},
+		{name: "account ID", targets: []protectTarget{prd}, input: "111111111111\n", count: -1, wantReason: "typed"},
+		{name: "surrounding spaces", targets: []protectTarget{prd}, input: "  necro-prd \n", count: -1, wantReason: "typed"},
+		{name: "one per profile", targets: []protectTarget{prd, sec}, input: "necro-prd\n333333333333\n", count: -1, wantReason: "typed"},
+		{
+			name: "wrong alias", targets: []protectTarget{prd}, input: "necro-dev\n", count: -1,
+			wantErr: `protect: cancelled: "necro-dev" does not match the account alias or ID of COM_PRD`,
+		},
+		{
+			name: "alias is case sensitive", targets: []protectTarget{prd}, input: "NECRO-PRD\n", count: -1,
+			wantErr: `"NECRO-PRD" does not match`,
+		},
+		{
+			name: "profile name is not accepted", targets: []protectTarget{prd}, input: "COM_PRD\n", count: -1,
+			wantErr: `"COM_PRD" does not match`,
+		},
+		{
+			name: "y is not accepted", targets: []protectTarget{prd}, input: "y\n", count: -1,
+			wantErr: `"y" does not match`,
+		},
+		{
+			name: "empty input without alias", targets: []protectTarget{sec}, input: "\n", count: -1,
+			wantErr: `protect: cancelled: "" does not match the account ID of COM_SEC`,
+		},
+		{
+			name: "other profile's ID", targets: []protectTarget{prd, sec}, input: "necro-prd\n111111111111\n", count: -1,
+			wantErr: `"111111111111" does not match the account ID of COM_SEC`,
+		},
+		{
+			name: "EOF", targets: []protectTarget{prd, sec}, input: "necro-prd\n", count: -1,
+			wantErr: "protect: cancelled (COM_SEC)",
+		},
+		{name: "--confirm-prd matches", targets: []protectTarget{prd, sec}, count: 2, wantReason: "--confirm-prd=2"},
+		{
+			name: "--confirm-prd too few", targets: []protectTarget{prd, sec}, input: "necro-prd\n333333333333\n", count: 1,
+			wantErr: "protect: --confirm-prd=1 does not match the number of protected profiles (2)",
+		},
+		{
+			name: "--confirm-prd=0", targets: []protectTarget{prd}, count: 0,
+			wantErr: "protect: --confirm-prd=0 does not match the number of protected profiles (1)",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out := &lockedBuffer{}
+			in := bufio.NewScanner(strings.NewReader(tt.input))
+			reason, err := confirmProtected(out, in, tt.targets, tt.count)
+			for _, tg := range tt.targets {
+				if !strings.Contains(string(out.Bytes()), "- "+tg.desc()+"\n") {
+					t.Errorf("%s is not listed:\n%s", tg.profile, out.Bytes())
+				}
+			}
+			// --confirm-prd のときは入力を読まない
+			if tt.count >= 0 && tt.input != "" && (!in.Scan() || in.Text() != strings.SplitN(tt.input, "\n", 2)[0]) {
+				t.Errorf("input was read with --confirm-prd")
+			}
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want %q", err, tt.wantErr)
+				}
+				if strings.Contains(string(out.Bytes()), "CONFIRMED") {
+					t.Errorf("CONFIRMED on error:\n%s", out.Bytes())
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if reason != tt.wantReason {
+				t.Errorf("reason = %q, want %q", reason, tt.wantReason)
+			}
+			if !strings.Contains(string(out.Bytes()), "🔒 CONFIRMED") {
+				t.Errorf("output:\n%s", out.Bytes())
+			}
+		})
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// RenderBlock はテンプレートファイルから設定ファイル等を生成するステップ。
+//
+//	cmd:
+//	  - name: aws-config
+//	    render:
+//	      template: conf/sample/operation/generate_aws_config/aws_config_profiles.tmpl
+//	      marker: ";; GENERATED CODE DO NOT DELETE"
+//	      base: conf/sample/operation/generate_aws_config/aws_config_template.txt
+//	    in: "./tmp/out/{{ .PROFILE }}/org-accounts.json"
+//	    out: "./tmp/out/aws_config.txt"
+//
+// データ: ctx 変数 + in（JSON/NDJSONファイル） / var（ctx変数のJSON） / last（LAST_JSON）
+// JSON がオブジェクトならフィールドをトップレベルに展開（.Accounts で range 可能）、全体は .data
+type RenderBlock struct {
+	Template string `yaml:"template"`         // テンプレートファイルのパス（Go template + sprig）
+	Var      string `yaml:"var,omitempty"`    // データにする ctx 変数（JSON文字列）
+	Last     bool   `yaml:"last,omitempty"`   // データに直前ステップの JSON 出力を使う
+	Marker   string `yaml:"marker,omitempty"` // out の marker 行より下だけを置き換える
+	Base     string `yaml:"base,omitempty"`   // marker モードで out が未作成のときの初期内容（ファイル）
+}
+
+// renderDataDesc は dry-run / ログ用のデータ元の表示。
+func renderDataDesc(rb *RenderBlock, inPath string) string {
+	switch {
+	case inPath != "":
+		return "in=" + inPath
+	case rb.Var != "":
+		return "var=" + rb.Var
+	case rb.Last:
+		return "LAST_JSON"
+	default:
+		return "ctx"
+	}
+}
+
+// runRender はテンプレートを展開し、out に書く内容を返す。
+// marker モードでは既存の out（無ければ base）の marker 行までを残して、その下を置き換える。
+func runRender(rb *RenderBlock, ctx map[string]string, inPath, outPath string, lastJSON any) ([]byte, error) {
+	if strings.TrimSpace(rb.Template) == "" {
+		return nil, fmt.Errorf("render: template is required")
+	}
+	if rb.Marker != "" && outPath == "" {
+		return nil, fmt.Errorf("render: marker requires out")
+	}
+
+	tplPath, _, err := renderTemplateString(rb.Template, ctx)
+	if err != nil {
+		return nil, fmt.Errorf("render: template path: %w", err)
+	}
+	tplBytes, err := os.ReadFile(tplPath)
+	if err != nil {
+		return nil, fmt.Errorf("render: template read failed: %w", err)
+	}
+
+	data, err := renderData(rb, ctx, inPath, lastJSON)
+	if err != nil {
+		return nil, err
+	}
+
+	body, err := renderTemplateData(string(tplBytes), data)
+	if err != nil {
+		return nil, fmt.Errorf("render: %s: %w", tplPath, err)
+	}
+
+	if rb.Marker == "" {
+		return []byte(body), nil
+	}
+
+	head, err := renderMarkerHead(rb, ctx, outPath)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(head + body), nil
+}
+
+func renderData(rb *RenderBlock, ctx map[string]string, inPath string, lastJSON any) (map[string]any, error) {
+	var src any
+	switch {
+	case inPath != "":
+		b, err := os.ReadFile(inPath)
+		if err != nil {
+			return nil, fmt.Errorf("render: in read failed: %w", err)
+		}
+		src, err = parseJSONOrNDJSON(b, inPath)
+		if err != nil {
+			return nil, fmt.Errorf("render: %w", err)
+		}
+	case rb.Var != "":
+		raw, ok := ctx[rb.Var]
+		if !ok {
+			return nil, fmt.Errorf("render: undefined variable: %s", rb.Var)
+		}
+		v, ok := parseJSONOrNil([]byte(raw))
+		if !ok {
+			return nil, fmt.Errorf("render: variable %s is not JSON", rb.Var)
+		}
+		src = v
+	case rb.Last:
+		if lastJSON == nil {
+			return nil, fmt.Errorf("render: last requires JSON stdout, but LAST_JSON is nil")
+		}
+		src = lastJSON
+	}
+
+	data := make(map[string]any, len(ctx)+1)
+	for k, v := range ctx {
+		data[k] = v
+	}
+	if m, ok := src.(map[string]any); ok {
+		for k, v := range m {
+			data[k] = v
+		}
+	}
+	if src != nil {
+		data["data"] = src
+	}
+	return data, nil
+}
+
+// renderMarkerHead は marker 行（を含む）までの残す部分を返す。
+func renderMarkerHead(rb *RenderBlock, ctx map[string]string, outPath string) (string, error) {
+	cur, err := os.ReadFile(outPath)
+	if errors.Is(err, os.ErrNotExist) && rb.Base != "" {
+		basePath, _, e := renderTemplateString(rb.Base, ctx)
+		if e != nil {
+			return "", fmt.Errorf("render: base path: %w", e)
+		}
+		cur, err = os.ReadFile(basePath)
+		if err != nil {
+			return "", fmt.Errorf("render: base read failed: %w", err)
+		}
+	} else if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return "", fmt.Errorf("render: out read failed: %w", err)
+	}
+
+	return markerHead(string(cur), rb.Marker), nil
+}
+
+// markerHead は text の marker 行（を含む）までを返す。
+// marker が無ければ既存内容の末尾に marker 行を追加する。
+func markerHead(text, marker string) string {
+	pos := 0
+	for _, l := range strings.SplitAfter(text, "\n") {
+		pos += len(l)
+		if strings.TrimRight(l, "\r\n") == marker {
+			head := text[:pos]
+			if !strings.HasSuffix(head, "\n") {
+				head += "\n"
+			}
+			return head
+		}
+	}
+
+	head := strings.TrimRight(text, "\r\n")
+	if head != "" {
+		head += "\n\n"
+	}
+	return head + marker + "\n"
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestMarkerHead(t *testing.T) {
+	const m = ";; GENERATED"
+	tests := []struct {
+		name string
+		text string
+		want string
+	}{
+		{"marker in the middle", "[default]\n;; GENERATED\nold\n", "[default]\n;; GENERATED\n"},
+		{"marker on the last line", "[default]\n;; GENERATED", "[default]\n;; GENERATED\n"},
+		{"marker with CRLF", "[default]\r\n;; GENERATED\r\nold\r\n", "[default]\r\n;; GENERATED\r\n"},
+		{"first marker wins", ";; GENERATED\na\n;; GENERATED\nb\n", ";; GENERATED\n"},
+		{"indented line is not the marker", "  ;; GENERATED\n", "  ;; GENERATED\n\n;; GENERATED\n"},
+		{"marker missing", "[default]\nregion = x\n\n", "[default]\nregion = x\n\n;; GENERATED\n"},
+		{"empty text", "", ";; GENERATED\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := markerHead(tt.text, m); got != tt.want {
+				t.Errorf("markerHead = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRunRenderMarker(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, s string) string {
+		p := filepath.Join(dir, name)
+		if err := os.WriteFile(p, []byte(s), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+	tpl := write("profiles.tmpl", "{{ range .Accounts }}[profile {{ .Name }}]\n{{ end }}")
+	base := write("base.txt", "[default]\nregion = {{ not rendered }}\n;; GENERATED\nfrom base\n")
+	in := write("accounts.json", `{"Accounts": [{"Name": "COM_PRD"}, {"Name": "SND_DEV"}]}`)
+	existing := write("existing.txt", "# keep me\n;; GENERATED\n[profile OLD]\n")
+	noMarker := write("no-marker.txt", "# keep me too\n")
+
+	ctx := map[string]string{"DIR": dir}
+	body := "[profile COM_PRD]\n[profile SND_DEV]\n"
+
+	tests := []struct {
+		name    string
+		rb      RenderBlock
+		out     string
+		want    string
+		wantErr string
+	}{
+		{
+			name: "no marker replaces everything",
+			rb:   RenderBlock{Template: tpl},
+			out:  existing,
+			want: body,
+		},
+		{
+			name: "keeps text above the marker",
+			rb:   RenderBlock{Template: tpl, Marker: ";; GENERATED", Base: base},
+			out:  existing,
+			want: "# keep me\n;; GENERATED\n" + body,
+		},
+		{
+			name: "appends the marker when missing",
+			rb:   RenderBlock{Template: tpl, Marker: ";; GENERATED"},
+			out:  noMarker,
+			want: "# keep me too\n\n;; GENERATED\n" + body,
+		},
+		{
+			name: "uses base when out does not exist",
+			rb:   RenderBlock{Template: "{{ .DIR }}/profiles.tmpl", Marker: ";; GENERATED", Base: "{{ .DIR }}/base.txt"},
+			out:  filepath.Join(dir, "new.txt"),
+			want: "[default]\nregion = {{ not rendered }}\n;; GENERATED\n" + body,
+		},
+		{
+			name: "no out and no base starts with the marker",
+			rb:   RenderBlock{Template: tpl, Marker: ";; GENERATED"},
+			out:  filepath.Join(dir, "new2.txt"),
+			want: ";; GENERATED\n" + body,
+		},
+		{
+			name:    "missing base file",
+			rb:      RenderBlock{Template: tpl, Marker: ";; GENERATED", Base: filepath.Join(dir, "nope.txt")},
+			out:     filepath.Join(dir, "new3.txt"),
+			wantErr: "render: base read failed",
+		},
+		{
+			name:    "marker requires out",
+			rb:      RenderBlock{Template: tpl, Marker: ";; GENERATED"},
+			wantErr: "render: marker requires out",
+		},
+		{
+			name:    "missing template",
+			rb:      RenderBlock{Template: filepath.Join(dir, "nope.tmpl")},
+			wantErr: "render: template read failed",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := runRender(&tt.rb, ctx, in, tt.out, nil)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("render = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRenderData(t *testing.T) {
+	ctx := map[string]string{"ENV": "dev", "LIST": `["a","b"]`, "OBJ": `{"ENV": "from-json", "n": 1}`}
+	tests := []struct {
+		name    string
+		rb      RenderBlock
+		last    any
+		tpl     string
+		want    string
+		wantErr string
+	}{
+		{name: "ctx only", tpl: "{{ .ENV }}", want: "dev"},
+		{name: "object fields override ctx", rb: RenderBlock{Var: "OBJ"}, tpl: "{{ .ENV }} {{ .n }} {{ .data.ENV }}", want: "from-json 1 from-json"},
+		{name: "array as data", rb: RenderBlock{Var: "LIST"}, tpl: "{{ range .data }}{{ . }};{{ end }}", want: "a;b;"},
+		{name: "last", rb: RenderBlock{Last: true}, last: map[string]any{"Id": "x"}, tpl: "{{ .Id }}", want: "x"},
+		{name: "last is nil", rb: RenderBlock{Last: true}, wantErr: "LAST_JSON is nil"},
+		{name: "undefined var", rb: RenderBlock{Var: "NOPE"}, wantErr: "render: undefined variable: NOPE"},
+		{name: "var not JSON", rb: RenderBlock{Var: "ENV"}, wantErr: "render: variable ENV is not JSON"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, err := renderData(&tt.rb, ctx, "", tt.last)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := renderTemplateData(tt.tpl, data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("render = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
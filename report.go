@@ -0,0 +1,477 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+// summaryCell は profile × top-level cmd の実行結果。
+type summaryCell struct {
+	Status   string // ok / ng / skip(when) / skipped(未実行) / plan(dry-run) / -(対象外: scope の違い)
+	Branch   string // top-level if の分岐先: ok / ng、switch は switch:case:<key> / switch:default
+	Duration time.Duration
+	Error    string
+	Reason   string // skip の理由
+}
+
+// runSummary は実行終了時のサマリー表と --report 出力の元データ。
+type runSummary struct {
+	mu sync.Mutex
+
+	RunID    string
+	Config   string
+	DryRun   bool
+	Profiles []string // 行
+	Steps    []string // 列（top-level cmd 名）
+	Start    time.Time
+	End      time.Time
+	Status   string
+
+	cells    map[string][]summaryCell // profile -> step index
+	branches map[cellKey]string       // if / switch branch（record で cell に移す）
+	skips    map[cellKey]string       // when skip reason（同上）
+}
+
+// cellKey は summary のセル（同名のステップがあっても列の位置で区別する）。
+type cellKey struct {
+	profile string
+	step    int
+}
+
+// statusNA は scope が違うため実行対象でないセル（profile 行の global ステップ、(global) 行の profile ステップ）。
+const statusNA = "-"
+
+// global[i] が true のステップは (global) 行だけに結果を持つ（1つでもあれば (global) 行を追加）。
+func newRunSummary(runID, cfgPath string, profiles []string, steps []string, global []bool, dryRun bool, start time.Time) *runSummary {
+	rows := profiles
+	for _, g := range global {
+		if g {
+			rows = append(append([]string{}, profiles...), globalProfile)
+			break
+		}
+	}
+
+	cells := make(map[string][]summaryCell, len(rows))
+	for _, p := range rows {
+		row := make([]summaryCell, len(steps))
+		for i := range row {
+			row[i].Status = "skipped"
+			if i < len(global) && global[i] != (p == globalProfile) {
+				row[i].Status = statusNA
+			}
+		}
+		cells[p] = row
+	}
+	return &runSummary{
+		RunID:    runID,
+		Config:   cfgPath,
+		DryRun:   dryRun,
+		Profiles: rows,
+		Steps:    steps,
+		Start:    start,
+		cells:    cells,
+		branches: map[cellKey]string{},
+		skips:    map[cellKey]string{},
+	}
+}
+
+func (s *runSummary) record(profile string, step int, err error, d time.Duration) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := cellKey{profile, step}
+	c := &s.cells[profile][step]
+	c.Duration = d
+	c.Branch = s.branches[key]
+	delete(s.branches, key)
+	reason, skipped := s.skips[key]
+	delete(s.skips, key)
+
+	switch {
+	case err != nil:
+		c.Status = "ng"
+		c.Error = err.Error()
+	case skipped:
+		c.Status = "skip"
+		c.Reason = reason
+	case s.DryRun:
+		c.Status = "plan"
+	default:
+		c.Status = "ok"
+	}
+}
+
+// recordBranch は top-level cmd（列 step）の if / switch 分岐先を覚えておく。step < 0（ネストした if）は対象外。
+func (s *runSummary) recordBranch(profile string, step int, branch string) {
+	if s == nil || step < 0 {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.branches[cellKey{profile, step}] = branch
+}
+
+// recordSkip は top-level cmd（列 step）が when でスキップされたことを覚えておく。
+func (s *runSummary) recordSkip(profile string, step int, reason string) {
+	if s == nil || step < 0 {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.skips[cellKey{profile, step}] = reason
+}
+
+// counts はステータスごとのセル数。
+func (s *runSummary) counts() map[string]int {
+	n := map[string]int{}
+	for _, p := range s.Profiles {
+		for _, c := range s.cells[p] {
+			if c.Status != statusNA {
+				n[c.Status]++
+			}
+		}
+	}
+	return n
+}
+
+// countsText は "ok=3 ng=0 skip=1 ..." 形式（0件のものは省略、ok / ng は常に出す）。
+func countsText(n map[string]int) string {
+	parts := []string{fmt.Sprintf("ok=%d", n["ok"]), fmt.Sprintf("ng=%d", n["ng"])}
+	for _, st := range []string{"skip", "skipped", "plan"} {
+		if n[st] > 0 {
+			parts = append(parts, fmt.Sprintf("%s=%d", st, n[st]))
+		}
+	}
+	return strings.Join(parts, " ")
+}
+
+func (s *runSummary) finish(status string, end time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Status = status
+	s.End = end
+}
+
+func (c summaryCell) text() string {
+	t := c.Status
+	switch {
+	case strings.HasPrefix(c.Branch, "switch:"):
+		t += "(" + c.Branch + ")"
+	case c.Branch != "":
+		t += "(if:" + c.Branch + ")"
+	}
+	if c.Status == "skip" {
+		t += "(when)"
+	}
+	if c.Status == "ok" || c.Status == "ng" {
+		t += " " + c.Duration.Round(time.Millisecond).String()
+	}
+	return t
+}
+
+// printTable は profile を行、top-level cmd を列にした表を出す。
+func (s *runSummary) printTable(w io.Writer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	header := append([]string{"PROFILE"}, s.Steps...)
+	rows := [][]string{header}
+	for _, p := range s.Profiles {
+		row := []string{p}
+		for _, c := range s.cells[p] {
+			row = append(row, c.text())
+		}
+		rows = append(rows, row)
+	}
+
+	widths := make([]int, len(header))
+	for _, r := range rows {
+		for i, col := range r {
+			if n := displayWidth(col); n > widths[i] {
+				widths[i] = n
+			}
+		}
+	}
+
+	fmt.Fprintln(w, "\n==== SUMMARY ====")
+	for _, r := range rows {
+		cols := make([]string, len(r))
+		for i, col := range r {
+			cols[i] = col + strings.Repeat(" ", widths[i]-displayWidth(col))
+		}
+		fmt.Fprintln(w, strings.TrimRight(strings.Join(cols, " | "), " "))
+	}
+	fmt.Fprintf(w, "TOTAL | %s\n", countsText(s.counts()))
+}
+
+// displayWidth は端末での表示幅（全角・絵文字は2、結合文字・異体字セレクタ・ZWJ は0）。
+func displayWidth(s string) int {
+	n := 0
+	for _, r := range s {
+		switch {
+		case unicode.In(r, unicode.Mn, unicode.Me, unicode.Cf):
+		case isWideRune(r):
+			n += 2
+		default:
+			n++
+		}
+	}
+	return n
+}
+
+// wideRanges は East Asian Width が W / F の主な範囲（CJK・かな・ハングル・全角・絵文字）。
+var wideRanges = [][2]rune{
+	{0x1100, 0x115F}, {0x231A, 0x231B}, {0x23E9, 0x23EC}, {0x23F0, 0x23F0}, {0x23F3, 0x23F3},
+	{0x25FD, 0x25FE}, {0x2614, 0x2615}, {0x2648, 0x2653}, {0x267F, 0x267F}, {0x2693, 0x2693},
+	{0x26A1, 0x26A1}, {0x26AA, 0x26AB}, {0x26BD, 0x26BE}, {0x26C4, 0x26C5}, {0x26CE, 0x26CE},
+	{0x26D4, 0x26D4}, {0x26EA, 0x26EA}, {0x26F2, 0x26F3}, {0x26F5, 0x26F5}, {0x26FA, 0x26FA},
+	{0x26FD, 0x26FD}, {0x2705, 0x2705}, {0x270A, 0x270B}, {0x2728, 0x2728}, {0x274C, 0x274C},
+	{0x274E, 0x274E}, {0x2753, 0x2755}, {0x2757, 0x2757}, {0x2795, 0x2797}, {0x27B0, 0x27B0},
+	{0x27BF, 0x27BF}, {0x2B1B, 0x2B1C}, {0x2B50, 0x2B50}, {0x2B55, 0x2B55},
+	{0x2E80, 0x303E}, {0x3041, 0x33FF}, {0x3400, 0x4DBF}, {0x4E00, 0x9FFF}, {0xA000, 0xA4CF},
+	{0xAC00, 0xD7A3}, {0xF900, 0xFAFF}, {0xFE30, 0xFE4F}, {0xFF00, 0xFF60}, {0xFFE0, 0xFFE6},
+	{0x1F004, 0x1F004}, {0x1F0CF, 0x1F0CF}, {0x1F18E, 0x1F18E}, {0x1F191, 0x1F19A}, {0x1F200, 0x1F2FF},
+	{0x1F300, 0x1F64F}, {0x1F680, 0x1F6FF}, {0x1F7E0, 0x1F7EB}, {0x1F900, 0x1FAFF},
+	{0x20000, 0x3FFFD},
+}
+
+func isWideRune(r rune) bool {
+	for _, w := range wideRanges {
+		if r < w[0] {
+			return false
+		}
+		if r <= w[1] {
+			return true
+		}
+	}
+	return false
+}
+
+// ===============================
+// --report
+// ===============================
+
+func validateReportPath(path string) error {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json", ".md", ".xml":
+		return nil
+	default:
+		return fmt.Errorf("--report %s: unsupported format (use .json / .md / .xml(junit))", path)
+	}
+}
+
+func (s *runSummary) writeReport(path string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var data []byte
+	var err error
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		data, err = s.reportJSON()
+	case ".md":
+		data = s.reportMarkdown()
+	case ".xml":
+		data, err = s.reportJUnit()
+	default:
+		err = validateReportPath(path)
+	}
+	if err != nil {
+		return err
+	}
+
+	if dir := filepath.Dir(path); dir != "." && dir != "" {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+	}
+	return os.WriteFile(path, data, 0644)
+}
+
+func (s *runSummary) reportJSON() ([]byte, error) {
+	type result struct {
+		Profile    string `json:"profile"`
+		Step       string `json:"step"`
+		Status     string `json:"status"`
+		Branch     string `json:"branch,omitempty"`
+		DurationMs int64  `json:"duration_ms"`
+		Error      string `json:"error,omitempty"`
+		Reason     string `json:"reason,omitempty"`
+	}
+	out := struct {
+		RunID      string         `json:"run_id"`
+		Config     string         `json:"config"`
+		DryRun     bool           `json:"dry_run"`
+		Status     string         `json:"status"`
+		Start      string         `json:"start"`
+		End        string         `json:"end"`
+		DurationMs int64          `json:"duration_ms"`
+		Profiles   []string       `json:"profiles"`
+		Steps      []string       `json:"steps"`
+		Counts     map[string]int `json:"counts"`
+		Results    []result       `json:"results"`
+	}{
+		RunID:      s.RunID,
+		Config:     s.Config,
+		DryRun:     s.DryRun,
+		Status:     s.Status,
+		Start:      s.Start.Format(time.RFC3339),
+		End:        s.End.Format(time.RFC3339),
+		DurationMs: s.End.Sub(s.Start).Milliseconds(),
+		Profiles:   s.Profiles,
+		Steps:      s.Steps,
+		Counts:     s.counts(),
+		Results:    []result{},
+	}
+	for _, p := range s.Profiles {
+		for i, c := range s.cells[p] {
+			if c.Status == statusNA {
+				continue
+			}
+			out.Results = append(out.Results, result{
+				Profile:    p,
+				Step:       s.Steps[i],
+				Status:     c.Status,
+				Branch:     c.Branch,
+				DurationMs: c.Duration.Milliseconds(),
+				Error:      secretValues.mask(c.Error),
+				Reason:     secretValues.mask(c.Reason),
+			})
+		}
+	}
+	b, err := json.MarshalIndent(out, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(b, '\n'), nil
+}
+
+func (s *runSummary) reportMarkdown() []byte {
+	var b strings.Builder
+	fmt.Fprintf(&b, "# necro report\n\n")
+	fmt.Fprintf(&b, "- run_id: `%s`\n", s.RunID)
+	fmt.Fprintf(&b, "- config: `%s`\n", s.Config)
+	fmt.Fprintf(&b, "- status: **%s**\n", s.Status)
+	fmt.Fprintf(&b, "- duration: %s\n", s.End.Sub(s.Start).Round(time.Millisecond))
+	fmt.Fprintf(&b, "- total: %s\n", countsText(s.counts()))
+	if s.DryRun {
+		fmt.Fprintf(&b, "- dry-run\n")
+	}
+	b.WriteString("\n")
+
+	b.WriteString("| PROFILE |")
+	for _, st := range s.Steps {
+		fmt.Fprintf(&b, " %s |", mdEscape(st))
+	}
+	b.WriteString("\n|---|")
+	for range s.Steps {
+		b.WriteString("---|")
+	}
+	b.WriteString("\n")
+	for _, p := range s.Profiles {
+		fmt.Fprintf(&b, "| %s |", mdEscape(p))
+		for _, c := range s.cells[p] {
+			fmt.Fprintf(&b, " %s |", mdEscape(c.text()))
+		}
+		b.WriteString("\n")
+	}
+
+	var errs []string
+	for _, p := range s.Profiles {
+		for i, c := range s.cells[p] {
+			if c.Error != "" {
+				errs = append(errs, fmt.Sprintf("- %s / %s: `%s`", p, s.Steps[i], secretValues.mask(c.Error)))
+			}
+		}
+	}
+	if len(errs) > 0 {
+		b.WriteString("\n## Errors\n\n")
+		b.WriteString(strings.Join(errs, "\n"))
+		b.WriteString("\n")
+	}
+	return []byte(b.String())
+}
+
+func mdEscape(s string) string {
+	return strings.ReplaceAll(s, "|", `\|`)
+}
+
+// reportJUnit は profile を testsuite、profile×step を testcase にする。
+func (s *runSummary) reportJUnit() ([]byte, error) {
+	type message struct {
+		Message string `xml:"message,attr,omitempty"`
+		Text    string `xml:",chardata"`
+	}
+	type testcase struct {
+		Name      string   `xml:"name,attr"`
+		Classname string   `xml:"classname,attr"`
+		Time      string   `xml:"time,attr"`
+		Failure   *message `xml:"failure,omitempty"`
+		Skipped   *message `xml:"skipped,omitempty"`
+	}
+	type testsuite struct {
+		Name      string     `xml:"name,attr"`
+		Tests     int        `xml:"tests,attr"`
+		Failures  int        `xml:"failures,attr"`
+		Skipped   int        `xml:"skipped,attr"`
+		Time      string     `xml:"time,attr"`
+		Testcases []testcase `xml:"testcase"`
+	}
+	type testsuites struct {
+		XMLName xml.Name    `xml:"testsuites"`
+		Name    string      `xml:"name,attr"`
+		Tests   int         `xml:"tests,attr"`
+		Fails   int         `xml:"failures,attr"`
+		Time    string      `xml:"time,attr"`
+		Suites  []testsuite `xml:"testsuite"`
+	}
+
+	secs := func(d time.Duration) string { return fmt.Sprintf("%.3f", d.Seconds()) }
+
+	root := testsuites{Name: "necro " + s.RunID, Time: secs(s.End.Sub(s.Start))}
+	for _, p := range s.Profiles {
+		suite := testsuite{Name: p}
+		var total time.Duration
+		for i, c := range s.cells[p] {
+			if c.Status == statusNA {
+				continue
+			}
+			tc := testcase{Name: s.Steps[i], Classname: p, Time: secs(c.Duration)}
+			switch c.Status {
+			case "ng":
+				tc.Failure = &message{Message: "failed", Text: secretValues.mask(c.Error)}
+				suite.Failures++
+			case "skipped":
+				tc.Skipped = &message{Message: "not executed"}
+				suite.Skipped++
+			case "skip":
+				tc.Skipped = &message{Message: "skipped by when", Text: secretValues.mask(c.Reason)}
+				suite.Skipped++
+			}
+			total += c.Duration
+			suite.Testcases = append(suite.Testcases, tc)
+		}
+		suite.Tests = len(suite.Testcases)
+		suite.Time = secs(total)
+		root.Tests += suite.Tests
+		root.Fails += suite.Failures
+		root.Suites = append(root.Suites, suite)
+	}
+
+	b, err := xml.MarshalIndent(root, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(xml.Header), append(b, '\n')...), nil
+}
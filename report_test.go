@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDisplayWidth(t *testing.T) {
+	tests := []struct {
+		s    string
+		want int
+	}{
+		{"", 0},
+		{"ok 3ms", 6},
+		{"デプロイ", 8},
+		{"s3確認", 6},
+		{"✅", 2},
+		{"✔", 1},
+		{"⚠️", 1}, // U+26A0 + 異体字セレクタ
+		{"👍🏽", 4},
+		{"ｶﾀｶﾅ", 4}, // 半角カナ
+		{"ＡＢ", 4},
+	}
+	for _, tt := range tests {
+		if got := displayWidth(tt.s); got != tt.want {
+			t.Errorf("displayWidth(%q) = %d, want %d", tt.s, got, tt.want)
+		}
+	}
+}
+
+func TestSummaryDuplicateStepNames(t *testing.T) {
+	s := newRunSummary("run", "x.yml", []string{"COM_DEV"}, []string{"check", "check"}, nil, false, time.Now())
+
+	s.recordBranch("COM_DEV", 0, "ok")
+	s.recordSkip("COM_DEV", 1, "false")
+	s.recordBranch("COM_DEV", -1, "ng") // ネストした if は記録しない
+	s.record("COM_DEV", 0, nil, time.Millisecond)
+	s.record("COM_DEV", 1, nil, 0)
+
+	row := s.cells["COM_DEV"]
+	if row[0].Status != "ok" || row[0].Branch != "ok" {
+		t.Errorf("step 0 = %+v, want ok with branch ok", row[0])
+	}
+	if row[1].Status != "skip" || row[1].Branch != "" || row[1].Reason != "false" {
+		t.Errorf("step 1 = %+v, want skip without branch", row[1])
+	}
+}
+
+func TestPrintTableAlignsWideText(t *testing.T) {
+	s := newRunSummary("run", "x.yml", []string{"COM_DEV", "本番"}, []string{"確認"}, nil, true, time.Now())
+	s.record("COM_DEV", 0, nil, 0)
+	s.record("本番", 0, nil, 0)
+
+	var buf bytes.Buffer
+	s.printTable(&buf)
+
+	var bars []int
+	for _, l := range strings.Split(buf.String(), "\n") {
+		if i := strings.Index(l, " | "); i >= 0 && !strings.HasPrefix(l, "TOTAL") {
+			bars = append(bars, displayWidth(l[:i]))
+		}
+	}
+	if len(bars) != 3 {
+		t.Fatalf("rows = %d, want 3:\n%s", len(bars), buf.String())
+	}
+	for _, b := range bars[1:] {
+		if b != bars[0] {
+			t.Errorf("column not aligned (%v):\n%s", bars, buf.String())
+		}
+	}
+}
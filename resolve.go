@@ -0,0 +1,236 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"text/template/parse"
+)
+
+// resolveOrder returns ctx keys in dependency order (referenced keys first).
+// dynamic=true means at least one value references ctx in a way that cannot be
+// determined from the parse tree (e.g. `index . "KEY"`, range/with), so the
+// caller must fall back to iterative resolution.
+// literal keys (secrets) are never parsed as templates.
+func resolveOrder(ctx map[string]string, literal map[string]bool) (order []string, dynamic bool, err error) {
+	keys := make([]string, 0, len(ctx))
+	for k := range ctx {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	deps := make(map[string][]string, len(ctx))
+	for _, k := range keys {
+		v := ctx[k]
+		if literal[k] || !strings.Contains(v, "{{") {
+			continue
+		}
+		refs, dyn, e := templateDeps(v)
+		if e != nil {
+			return nil, false, fmt.Errorf("resolve ctx[%s] failed: %w", k, e)
+		}
+		if dyn {
+			dynamic = true
+		}
+
+		for _, r := range refs {
+			// 未定義キーは render 時に missingkey=error で報告される
+			if _, ok := ctx[r]; ok {
+				deps[k] = append(deps[k], r)
+			}
+		}
+	}
+
+	// DFS topological sort (stable by key name)
+	const (
+		unvisited = iota
+		visiting
+		done
+	)
+	state := make(map[string]int, len(ctx))
+	var stack []string
+
+	var visit func(k string) error
+	visit = func(k string) error {
+		switch state[k] {
+		case done:
+			return nil
+		case visiting:
+			// stack から循環部分を切り出す: A -> B -> A
+			start := 0
+			for i, s := range stack {
+				if s == k {
+					start = i
+					break
+				}
+			}
+			cycle := append(append([]string{}, stack[start:]...), k)
+			return fmt.Errorf("template resolve cycle: %s", strings.Join(cycle, " -> "))
+		}
+
+		state[k] = visiting
+		stack = append(stack, k)
+		for _, d := range deps[k] {
+			if err := visit(d); err != nil {
+				return err
+			}
+		}
+		stack = stack[:len(stack)-1]
+		state[k] = done
+		order = append(order, k)
+		return nil
+	}
+
+	for _, k := range keys {
+		if err := visit(k); err != nil {
+			return nil, false, err
+		}
+	}
+	return order, dynamic, nil
+}
+
+// templateDeps returns the ctx keys referenced by s (sorted).
+func templateDeps(s string) (refs []string, dynamic bool, err error) {
+	if !strings.Contains(s, "{{") {
+		return nil, false, nil
+	}
+	tpl, err := parseTemplate(s)
+	if err != nil {
+		return nil, false, err
+	}
+
+	set := map[string]struct{}{}
+	if tpl.Tree != nil {
+		dynamic = collectTemplateRefs(tpl.Tree.Root, set)
+	}
+	for r := range set {
+		refs = append(refs, r)
+	}
+	sort.Strings(refs)
+	return refs, dynamic, nil
+}
+
+// collectTemplateRefs collects top-level ctx keys referenced as .KEY / $.KEY.
+// It returns true when the template contains references that cannot be
+// resolved statically.
+func collectTemplateRefs(node parse.Node, refs map[string]struct{}) (dynamic bool) {
+	switch n := node.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return false
+		}
+		for _, c := range n.Nodes {
+			if collectTemplateRefs(c, refs) {
+				dynamic = true
+			}
+		}
+	case *parse.ActionNode:
+		return collectTemplateRefs(n.Pipe, refs)
+	case *parse.PipeNode:
+		if n == nil {
+			return false
+		}
+		for _, c := range n.Cmds {
+			if collectTemplateRefs(c, refs) {
+				dynamic = true
+			}
+		}
+	case *parse.CommandNode:
+		for _, a := range n.Args {
+			if collectTemplateRefs(a, refs) {
+				dynamic = true
+			}
+		}
+	case *parse.FieldNode:
+		refs[n.Ident[0]] = struct{}{}
+	case *parse.VariableNode:
+		if len(n.Ident) > 1 && n.Ident[0] == "$" {
+			refs[n.Ident[1]] = struct{}{}
+		}
+	case *parse.ChainNode:
+		return collectTemplateRefs(n.Node, refs)
+	case *parse.DotNode:
+		// `.` 自体を渡している（index . "KEY" など）
+		return true
+	case *parse.IfNode:
+		a := collectTemplateRefs(n.Pipe, refs)
+		b := collectTemplateRefs(n.List, refs)
+		c := collectTemplateRefs(n.ElseList, refs)
+		return a || b || c
+	case *parse.RangeNode:
+		// range/with の中では `.` が ctx ではなくなるので本体は静的に追わない
+		collectTemplateRefs(n.Pipe, refs)
+		return true
+	case *parse.WithNode:
+		collectTemplateRefs(n.Pipe, refs)
+		return true
+	case *parse.TemplateNode:
+		collectTemplateRefs(n.Pipe, refs)
+		return true
+	}
+	return dynamic
+}
+
+// collectTemplateFieldRefs collects ctx keys used as structured values:
+// fields are accessed (.KEY.field / $.KEY.field), ranged over (range .KEY) or
+// indexed (index .KEY "k").
+func collectTemplateFieldRefs(node parse.Node, refs map[string]struct{}) {
+	switch n := node.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return
+		}
+		for _, c := range n.Nodes {
+			collectTemplateFieldRefs(c, refs)
+		}
+	case *parse.ActionNode:
+		collectTemplateFieldRefs(n.Pipe, refs)
+	case *parse.PipeNode:
+		if n == nil {
+			return
+		}
+		for _, c := range n.Cmds {
+			collectTemplateFieldRefs(c, refs)
+		}
+	case *parse.CommandNode:
+		if len(n.Args) > 1 {
+			if id, ok := n.Args[0].(*parse.IdentifierNode); ok && id.Ident == "index" {
+				collectTemplateRefs(n.Args[1], refs)
+			}
+		}
+		for _, a := range n.Args {
+			collectTemplateFieldRefs(a, refs)
+		}
+	case *parse.FieldNode:
+		if len(n.Ident) > 1 {
+			refs[n.Ident[0]] = struct{}{}
+		}
+	case *parse.VariableNode:
+		if len(n.Ident) > 2 && n.Ident[0] == "$" {
+			refs[n.Ident[1]] = struct{}{}
+		}
+	case *parse.ChainNode:
+		collectTemplateFieldRefs(n.Node, refs)
+	case *parse.IfNode:
+		collectTemplateFieldRefs(n.Pipe, refs)
+		collectTemplateFieldRefs(n.List, refs)
+		collectTemplateFieldRefs(n.ElseList, refs)
+	case *parse.RangeNode:
+		collectTemplateRefs(n.Pipe, refs)
+		collectTemplateFieldRefs(n.List, refs)
+		collectTemplateFieldRefs(n.ElseList, refs)
+	case *parse.WithNode:
+		collectTemplateFieldRefs(n.Pipe, refs)
+		collectTemplateFieldRefs(n.List, refs)
+		collectTemplateFieldRefs(n.ElseList, refs)
+	}
+}
+
+func hasTemplateLeft(ctx map[string]string, literal map[string]bool) bool {
+	for k, v := range ctx {
+		if !literal[k] && strings.Contains(v, "{{") {
+			return true
+		}
+	}
+	return false
+}
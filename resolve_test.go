@@ -0,0 +1,110 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestResolveOrder(t *testing.T) {
+	tests := []struct {
+		name    string
+		ctx     map[string]string
+		before  [][2]string // [a, b]: a は b より前
+		dynamic bool
+		wantErr string
+	}{
+		{
+			name:   "chain",
+			ctx:    map[string]string{"C": "{{ .B }}-c", "B": "{{ .A }}-b", "A": "a"},
+			before: [][2]string{{"A", "B"}, {"B", "C"}},
+		},
+		{
+			name:   "dollar and field refs",
+			ctx:    map[string]string{"X": "{{ $.Y.name }}", "Y": `{"name":"y"}`},
+			before: [][2]string{{"Y", "X"}},
+		},
+		{
+			name:   "undefined key is not a dependency",
+			ctx:    map[string]string{"A": "{{ .NOPE }}"},
+			before: nil,
+		},
+		{
+			name:    "index dot is dynamic",
+			ctx:     map[string]string{"A": `{{ index . "B" }}`, "B": "b"},
+			dynamic: true,
+		},
+		{
+			name:    "range is dynamic",
+			ctx:     map[string]string{"A": `{{ range .L }}{{ . }}{{ end }}`, "L": "[]"},
+			dynamic: true,
+		},
+		{
+			name:    "self cycle",
+			ctx:     map[string]string{"A": "{{ .A }}"},
+			wantErr: "template resolve cycle: A -> A",
+		},
+		{
+			name:    "three key cycle",
+			ctx:     map[string]string{"A": "{{ .B }}", "B": "{{ .C }}", "C": "{{ .A }}"},
+			wantErr: "template resolve cycle: A -> B -> C -> A",
+		},
+		{
+			name:    "parse error",
+			ctx:     map[string]string{"A": "{{ .B "},
+			wantErr: "resolve ctx[A] failed",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			order, dynamic, err := resolveOrder(tt.ctx, nil)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if dynamic != tt.dynamic {
+				t.Errorf("dynamic = %v, want %v", dynamic, tt.dynamic)
+			}
+			if len(order) != len(tt.ctx) {
+				t.Fatalf("order = %v, want all %d keys", order, len(tt.ctx))
+			}
+			pos := map[string]int{}
+			for i, k := range order {
+				pos[k] = i
+			}
+			for _, b := range tt.before {
+				if pos[b[0]] > pos[b[1]] {
+					t.Errorf("order = %v, want %s before %s", order, b[0], b[1])
+				}
+			}
+		})
+	}
+}
+
+func TestResolveContextTemplates(t *testing.T) {
+	ctx := map[string]string{
+		"PROFILE": "COM_PRD",
+		"STACK":   "stack-{{ .ENV }}",
+		"ENV":     `{{ .PROFILE | lower | replace "com_" "" }}`,
+		"DYN":     `{{ index . "STACK" }}`,
+	}
+	if err := resolveContextTemplates(ctx, 10, nil); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"ENV": "prd", "STACK": "stack-prd", "DYN": "stack-prd"}
+	for k, v := range want {
+		if ctx[k] != v {
+			t.Errorf("ctx[%s] = %q, want %q", k, ctx[k], v)
+		}
+	}
+
+	err := resolveContextTemplates(map[string]string{"A": "{{ .B }}", "B": "{{ .A }}"}, 10, nil)
+	if err == nil || !strings.Contains(err.Error(), "cycle") {
+		t.Errorf("cycle: err = %v", err)
+	}
+}
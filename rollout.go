@@ -0,0 +1,261 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// RolloutBlock は profile を canary → waves の順に分けて実行する（段階的ロールアウト）。
+//
+//	rollout:
+//	  canary: [COM_DEV]           # 最初の wave
+//	  waves: [1, 5, 25%, rest]    # 残りの profile を順に（数 / 全体の % / rest）
+//	  pause_between: confirm      # wave の間（必須）: confirm（確認）/ 5m（待つ）/ none
+//	  max_failure_rate: 10%       # wave の失敗率がこれを超えたら停止（既定 0%）
+//
+// wave ごとに全 cmd を実行し、profile ごとの結果を表示してから次の wave に進む。
+// wave 内で失敗した profile は残りのステップを実行せず、他の profile は続ける。
+type RolloutBlock struct {
+	Canary         []string
+	Waves          []waveSize
+	Confirm        bool          // pause_between: confirm
+	Pause          time.Duration // pause_between: <duration>
+	MaxFailureRate float64       // %
+}
+
+// waveSize は waves の1要素（数 / % / rest）。
+type waveSize struct {
+	n    int
+	pct  float64
+	rest bool
+}
+
+func (w waveSize) String() string {
+	switch {
+	case w.rest:
+		return "rest"
+	case w.pct > 0:
+		return strconv.FormatFloat(w.pct, 'f', -1, 64) + "%"
+	default:
+		return strconv.Itoa(w.n)
+	}
+}
+
+func (r *RolloutBlock) UnmarshalYAML(n *yaml.Node) error {
+	var raw struct {
+		Canary         []string `yaml:"canary"`
+		Waves          []string `yaml:"waves"`
+		PauseBetween   string   `yaml:"pause_between"`
+		MaxFailureRate string   `yaml:"max_failure_rate"`
+	}
+	if err := n.Decode(&raw); err != nil {
+		return err
+	}
+	r.Canary = raw.Canary
+
+	for i, s := range raw.Waves {
+		s = strings.TrimSpace(s)
+		switch {
+		case s == "rest":
+			if i != len(raw.Waves)-1 {
+				return fmt.Errorf("line %d: rollout.waves: rest must be the last wave", n.Line)
+			}
+			r.Waves = append(r.Waves, waveSize{rest: true})
+		case strings.HasSuffix(s, "%"):
+			p, err := strconv.ParseFloat(strings.TrimSuffix(s, "%"), 64)
+			if err != nil || p <= 0 || p > 100 {
+				return fmt.Errorf("line %d: rollout.waves: invalid percentage %q (0%% < p <= 100%%)", n.Line, s)
+			}
+			r.Waves = append(r.Waves, waveSize{pct: p})
+		default:
+			c, err := strconv.Atoi(s)
+			if err != nil || c <= 0 {
+				return fmt.Errorf("line %d: rollout.waves: invalid size %q (count / N%% / rest)", n.Line, s)
+			}
+			r.Waves = append(r.Waves, waveSize{n: c})
+		}
+	}
+
+	// 既定を confirm にすると CI（stdin 無し）で止まり、none にすると wave の間で止まれないので必須にする
+	switch p := strings.TrimSpace(raw.PauseBetween); p {
+	case "":
+		return fmt.Errorf("line %d: rollout.pause_between is required (confirm / none / duration e.g. 5m)", n.Line)
+	case "confirm":
+		r.Confirm = true
+	case "none":
+	default:
+		d, err := time.ParseDuration(p)
+		if err != nil || d <= 0 {
+			return fmt.Errorf("line %d: rollout.pause_between: invalid value %q (confirm / none / duration e.g. 5m)", n.Line, p)
+		}
+		r.Pause = d
+	}
+
+	if s := strings.TrimSpace(raw.MaxFailureRate); s != "" {
+		p, err := strconv.ParseFloat(strings.TrimSuffix(s, "%"), 64)
+		if err != nil || p < 0 || p > 100 {
+			return fmt.Errorf("line %d: rollout.max_failure_rate: invalid value %q (0%% - 100%%)", n.Line, s)
+		}
+		r.MaxFailureRate = p
+	}
+	return nil
+}
+
+// pauseDesc は ROLLOUT の表示用。
+func (r *RolloutBlock) pauseDesc() string {
+	switch {
+	case r.Confirm:
+		return "confirm"
+	case r.Pause > 0:
+		return r.Pause.String()
+	default:
+		return "none"
+	}
+}
+
+type rolloutWave struct {
+	label    string // canary / 1 / 25% / rest
+	profiles []string
+}
+
+// plan は profiles を wave に分ける。canary は対象 profile でなければエラー。
+// waves で割り当てきれなかった profile は最後の wave（rest）にする。
+func (r *RolloutBlock) plan(profiles []string) ([]rolloutWave, error) {
+	canary := map[string]bool{}
+	for _, c := range r.Canary {
+		if !containsString(profiles, c) {
+			return nil, fmt.Errorf("rollout.canary: %s is not a target profile", c)
+		}
+		canary[c] = true
+	}
+
+	var waves []rolloutWave
+	var remaining []string
+	if len(canary) > 0 {
+		w := rolloutWave{label: "canary"}
+		for _, p := range profiles {
+			if canary[p] {
+				w.profiles = append(w.profiles, p)
+			} else {
+				remaining = append(remaining, p)
+			}
+		}
+		waves = append(waves, w)
+	} else {
+		remaining = append(remaining, profiles...)
+	}
+
+	for _, ws := range r.Waves {
+		if len(remaining) == 0 {
+			break
+		}
+		n := len(remaining)
+		switch {
+		case ws.rest:
+		case ws.pct > 0:
+			n = int(math.Ceil(float64(len(profiles)) * ws.pct / 100))
+		default:
+			n = ws.n
+		}
+		if n > len(remaining) {
+			n = len(remaining)
+		}
+		waves = append(waves, rolloutWave{label: ws.String(), profiles: remaining[:n]})
+		remaining = remaining[n:]
+	}
+	if len(remaining) > 0 {
+		waves = append(waves, rolloutWave{label: "rest", profiles: remaining})
+	}
+	return waves, nil
+}
+
+// runRollout は wave ごとに run を実行する。run は失敗した profile を failed に入れる。
+// wave の失敗率が max_failure_rate を超えたら、次の wave に進まずエラーを返す。
+// 最後まで進んでも失敗した profile があればエラー（最初の失敗）を返す。
+func runRollout(env *runEnv, r *RolloutBlock, waves []rolloutWave, run func(targets []string, failed map[string]error)) (string, error) {
+	mw := env.mw
+	failed := map[string]error{}
+	firstFailed := ""
+
+	for wi, w := range waves {
+		if wi > 0 && !env.dryRun {
+			if err := rolloutPause(env, r, wi, waves); err != nil {
+				return "", err
+			}
+		}
+
+		fmt.Fprintf(mw, "\n🌊 WAVE      | %d/%d | %s | profiles=%s\n", wi+1, len(waves), w.label, strings.Join(w.profiles, ","))
+		run(w.profiles, failed)
+
+		ng := 0
+		for _, p := range w.profiles {
+			if failed[p] != nil {
+				ng++
+				if firstFailed == "" {
+					firstFailed = p
+				}
+			}
+		}
+		rate := float64(ng) * 100 / float64(len(w.profiles))
+
+		status := "ok"
+		if ng > 0 {
+			status = "ng"
+		}
+		fmt.Fprintf(mw, "🌊 WAVE DONE | %d/%d | %s | ok=%d ng=%d | failure=%s%% (max %s%%)\n",
+			wi+1, len(waves), w.label, len(w.profiles)-ng, ng, formatRate(rate), formatRate(r.MaxFailureRate))
+		for _, p := range w.profiles {
+			if err := failed[p]; err != nil {
+				fmt.Fprintf(mw, "   ❌ %s | %v\n", p, err)
+			} else {
+				fmt.Fprintf(mw, "   ✅ %s\n", p)
+			}
+		}
+		env.events.emit(event{Event: "wave", Status: status, Wave: wi + 1, Profiles: w.profiles,
+			Reason: fmt.Sprintf("%s | failure=%s%% (max %s%%)", w.label, formatRate(rate), formatRate(r.MaxFailureRate))})
+
+		if ng > 0 && rate > r.MaxFailureRate {
+			fmt.Fprintf(mw, "⛔ ROLLOUT STOPPED | wave %d/%d failure rate %s%% exceeds max_failure_rate %s%%\n",
+				wi+1, len(waves), formatRate(rate), formatRate(r.MaxFailureRate))
+			return firstFailed, fmt.Errorf("rollout: stopped at wave %d/%d (failure rate %s%% > %s%%): %s: %w",
+				wi+1, len(waves), formatRate(rate), formatRate(r.MaxFailureRate), firstFailed, failed[firstFailed])
+		}
+	}
+
+	if firstFailed != "" {
+		return firstFailed, fmt.Errorf("rollout: %d profile(s) failed: %s: %w", len(failed), firstFailed, failed[firstFailed])
+	}
+	return "", nil
+}
+
+// rolloutPause は次の wave の前に確認する / 待つ。
+func rolloutPause(env *runEnv, r *RolloutBlock, wi int, waves []rolloutWave) error {
+	next := waves[wi]
+	switch {
+	case r.Confirm:
+		if f, ok := env.mw.(interface{ Flush() error }); ok {
+			_ = f.Flush()
+		}
+		if !confirmPrompt(fmt.Sprintf("Proceed to wave %d/%d (%s: %s)? (y/N): ", wi+1, len(waves), next.label, strings.Join(next.profiles, ","))) {
+			fmt.Fprintln(env.mw, "⛔ ROLLOUT STOPPED | cancelled")
+			return fmt.Errorf("rollout: cancelled before wave %d/%d", wi+1, len(waves))
+		}
+	case r.Pause > 0:
+		fmt.Fprintf(env.mw, "⏸  PAUSE     | %s before wave %d/%d (Ctrl-C to stop)\n", r.Pause, wi+1, len(waves))
+		select {
+		case <-time.After(r.Pause):
+		case <-interruptCh:
+			return errInterrupted
+		}
+	}
+	return env.checkInterrupted()
+}
+
+func formatRate(p float64) string {
+	return strconv.FormatFloat(math.Round(p*10)/10, 'f', -1, 64)
+}
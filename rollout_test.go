@@ -0,0 +1,233 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+func parseRollout(t *testing.T, yml string) (*RolloutBlock, error) {
+	t.Helper()
+	var r RolloutBlock
+	err := yaml.Unmarshal([]byte(yml), &r)
+	return &r, err
+}
+
+func TestRolloutUnmarshal(t *testing.T) {
+	tests := []struct {
+		name    string
+		yml     string
+		want    RolloutBlock
+		wantErr string
+	}{
+		{
+			name: "confirm",
+			yml:  `{ canary: [COM_DEV], waves: [1, 25%, rest], pause_between: confirm, max_failure_rate: 10% }`,
+			want: RolloutBlock{
+				Canary:         []string{"COM_DEV"},
+				Waves:          []waveSize{{n: 1}, {pct: 25}, {rest: true}},
+				Confirm:        true,
+				MaxFailureRate: 10,
+			},
+		},
+		{
+			name: "duration",
+			yml:  `{ waves: [2], pause_between: 5m }`,
+			want: RolloutBlock{Waves: []waveSize{{n: 2}}, Pause: 5 * time.Minute},
+		},
+		{
+			name: "none",
+			yml:  `{ waves: [50%], pause_between: none, max_failure_rate: "0" }`,
+			want: RolloutBlock{Waves: []waveSize{{pct: 50}}},
+		},
+		{name: "pause_between required", yml: `{ waves: [1] }`, wantErr: "rollout.pause_between is required (confirm / none / duration e.g. 5m)"},
+		{name: "bad pause_between", yml: `{ waves: [1], pause_between: -1m }`, wantErr: `rollout.pause_between: invalid value "-1m"`},
+		{name: "rest not last", yml: `{ waves: [rest, 1], pause_between: none }`, wantErr: "rest must be the last wave"},
+		{name: "zero percent", yml: `{ waves: [0%], pause_between: none }`, wantErr: `invalid percentage "0%"`},
+		{name: "over 100 percent", yml: `{ waves: [150%], pause_between: none }`, wantErr: `invalid percentage "150%"`},
+		{name: "zero size", yml: `{ waves: [0], pause_between: none }`, wantErr: `invalid size "0"`},
+		{name: "bad size", yml: `{ waves: [half], pause_between: none }`, wantErr: `invalid size "half"`},
+		{name: "bad max_failure_rate", yml: `{ waves: [1], pause_between: none, max_failure_rate: 120% }`, wantErr: `rollout.max_failure_rate: invalid value "120%"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := parseRollout(t, tt.yml)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(*r, tt.want) {
+				t.Errorf("rollout = %+v, want %+v", *r, tt.want)
+			}
+		})
+	}
+}
+
+func TestRolloutPlan(t *testing.T) {
+	ten := []string{"P0", "P1", "P2", "P3", "P4", "P5", "P6", "P7", "P8", "P9"}
+
+	tests := []struct {
+		name     string
+		yml      string
+		profiles []string
+		want     []rolloutWave
+		wantErr  string
+	}{
+		{
+			name:     "canary, count, percent, rest",
+			yml:      `{ canary: [P2], waves: [1, 25%, rest], pause_between: none }`,
+			profiles: ten,
+			want: []rolloutWave{
+				{label: "canary", profiles: []string{"P2"}},
+				{label: "1", profiles: []string{"P0"}},
+				{label: "25%", profiles: []string{"P1", "P3", "P4"}}, // 全 10 の 25% を切り上げ
+				{label: "rest", profiles: []string{"P5", "P6", "P7", "P8", "P9"}},
+			},
+		},
+		{
+			name:     "canary keeps target order",
+			yml:      `{ canary: [P1, P0], waves: [rest], pause_between: none }`,
+			profiles: []string{"P0", "P1", "P2"},
+			want: []rolloutWave{
+				{label: "canary", profiles: []string{"P0", "P1"}},
+				{label: "rest", profiles: []string{"P2"}},
+			},
+		},
+		{
+			name:     "leftovers become rest",
+			yml:      `{ waves: [2], pause_between: none }`,
+			profiles: []string{"P0", "P1", "P2", "P3"},
+			want: []rolloutWave{
+				{label: "2", profiles: []string{"P0", "P1"}},
+				{label: "rest", profiles: []string{"P2", "P3"}},
+			},
+		},
+		{
+			name:     "wave larger than remaining",
+			yml:      `{ waves: [5, 50%, 1], pause_between: none }`,
+			profiles: []string{"P0", "P1", "P2", "P3", "P4", "P5"},
+			want: []rolloutWave{
+				{label: "5", profiles: []string{"P0", "P1", "P2", "P3", "P4"}},
+				{label: "50%", profiles: []string{"P5"}},
+			},
+		},
+		{
+			name:     "canary only",
+			yml:      `{ canary: [P0], pause_between: none }`,
+			profiles: []string{"P0", "P1"},
+			want: []rolloutWave{
+				{label: "canary", profiles: []string{"P0"}},
+				{label: "rest", profiles: []string{"P1"}},
+			},
+		},
+		{
+			name:     "unknown canary",
+			yml:      `{ canary: [PRD], waves: [rest], pause_between: none }`,
+			profiles: []string{"P0"},
+			wantErr:  "rollout.canary: PRD is not a target profile",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := parseRollout(t, tt.yml)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := r.plan(tt.profiles)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("waves = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRunRolloutFailureRate(t *testing.T) {
+	waves := []rolloutWave{
+		{label: "canary", profiles: []string{"P0"}},
+		{label: "2", profiles: []string{"P1", "P2"}},
+		{label: "rest", profiles: []string{"P3", "P4"}},
+	}
+	stepErr := errors.New("exit status 3")
+
+	tests := []struct {
+		name        string
+		maxRate     float64
+		fail        map[string]bool
+		wantRan     []string
+		wantFailed  string
+		wantErr     string
+		wantStopped bool
+	}{
+		{
+			name:    "all ok",
+			wantRan: []string{"P0", "P1", "P2", "P3", "P4"},
+		},
+		{
+			name:        "stop at first failure by default",
+			fail:        map[string]bool{"P2": true},
+			wantRan:     []string{"P0", "P1", "P2"},
+			wantFailed:  "P2",
+			wantErr:     "rollout: stopped at wave 2/3 (failure rate 50% > 0%): P2: exit status 3",
+			wantStopped: true,
+		},
+		{
+			name:       "under max_failure_rate continues",
+			maxRate:    50,
+			fail:       map[string]bool{"P1": true, "P4": true},
+			wantRan:    []string{"P0", "P1", "P2", "P3", "P4"},
+			wantFailed: "P1",
+			wantErr:    "rollout: 2 profile(s) failed: P1: exit status 3",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out := &lockedBuffer{}
+			env := &runEnv{mw: out, step: -1}
+			r := &RolloutBlock{MaxFailureRate: tt.maxRate}
+
+			var ran []string
+			failedProfile, err := runRollout(env, r, waves, func(targets []string, failed map[string]error) {
+				for _, p := range targets {
+					ran = append(ran, p)
+					if tt.fail[p] {
+						failed[p] = stepErr
+					}
+				}
+			})
+			if !reflect.DeepEqual(ran, tt.wantRan) {
+				t.Errorf("ran = %v, want %v", ran, tt.wantRan)
+			}
+			if failedProfile != tt.wantFailed {
+				t.Errorf("failed profile = %q, want %q", failedProfile, tt.wantFailed)
+			}
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+			} else if err == nil || err.Error() != tt.wantErr || !errors.Is(err, stepErr) {
+				t.Fatalf("err = %v, want %q", err, tt.wantErr)
+			}
+			if got := strings.Contains(string(out.Bytes()), "⛔ ROLLOUT STOPPED"); got != tt.wantStopped {
+				t.Errorf("stopped = %v, want %v:\n%s", got, tt.wantStopped, out.Bytes())
+			}
+		})
+	}
+}
@@ -0,0 +1,307 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// SecretSource はシークレット変数の取得元（いずれか1つ）。
+//
+//	vars:
+//	  secrets:
+//	    API_TOKEN: { env: NECRO_API_TOKEN }
+//	    DB_PASSWORD: { file: ./tmp/secret/db.txt }
+//	    SLACK_WEBHOOK: { secretsmanager: /com/slack, json_key: webhook }
+//	    GITHUB_TOKEN: { ssm: /com/github/token }
+//
+// 値（パス/ID）は built-in 変数（PROFILE/REGION/ACCOUNT_ID/RUN_ID）でテンプレート展開される。
+type SecretSource struct {
+	Env            string `yaml:"env,omitempty"`
+	File           string `yaml:"file,omitempty"`
+	SecretsManager string `yaml:"secretsmanager,omitempty"` // secret-id (aws secretsmanager get-secret-value)
+	JSONKey        string `yaml:"json_key,omitempty"`       // SecretString が JSON のときに取り出すキー
+	SSM            string `yaml:"ssm,omitempty"`            // parameter name (aws ssm get-parameter --with-decryption)
+}
+
+// minSecretLen より短いシークレットは無関係な出力まで *** にしてしまうのでエラーにする。
+const minSecretLen = 4
+
+// checkSecretLen は前後の空白を除いた長さが minSecretLen 以上か確認する。
+func checkSecretLen(v string) error {
+	if n := len(strings.TrimSpace(v)); n < minSecretLen {
+		return fmt.Errorf("value is too short (%d chars without surrounding spaces, min %d): it would mask unrelated output", n, minSecretLen)
+	}
+	return nil
+}
+
+// secretValues は実行中に読み込んだシークレット値。
+// necro が出力する全行（console / log / 子プロセスの stdout/stderr）から *** に置換する。
+var secretValues = &secretSet{}
+
+type secretSet struct {
+	mu     sync.RWMutex
+	values []string // 長い順（部分一致で短い方が先に置換されないように）
+}
+
+func (s *secretSet) add(v string) {
+	if v == "" {
+		return
+	}
+	cands := []string{v}
+	// JSON 出力中ではエスケープされた形で現れる
+	if j, err := json.Marshal(v); err == nil {
+		if esc := string(j[1 : len(j)-1]); esc != v {
+			cands = append(cands, esc)
+		}
+	}
+	// maskWriter は行単位で置換するので、複数行の値（PEM など）は行ごとにも登録する
+	if strings.Contains(v, "\n") {
+		for _, l := range strings.Split(v, "\n") {
+			if l = strings.TrimRight(l, "\r"); len(strings.TrimSpace(l)) >= minSecretLen {
+				cands = append(cands, l)
+			}
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, c := range cands {
+		found := false
+		for _, e := range s.values {
+			if e == c {
+				found = true
+				break
+			}
+		}
+		if !found {
+			s.values = append(s.values, c)
+		}
+	}
+	sort.SliceStable(s.values, func(i, j int) bool { return len(s.values[i]) > len(s.values[j]) })
+}
+
+func (s *secretSet) mask(line string) string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, v := range s.values {
+		line = strings.ReplaceAll(line, v, "***")
+	}
+	return line
+}
+
+// maskWriter は行単位でバッファしてシークレットを置換してから下位の writer に流す。
+// 改行で終わらない出力は Flush で吐き出す。
+type maskWriter struct {
+	mu      sync.Mutex
+	w       io.Writer
+	secrets *secretSet
+	buf     []byte
+}
+
+func newMaskWriter(w io.Writer, secrets *secretSet) *maskWriter {
+	return &maskWriter{w: w, secrets: secrets}
+}
+
+func (m *maskWriter) Write(p []byte) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.buf = append(m.buf, p...)
+	for {
+		i := bytes.IndexByte(m.buf, '\n')
+		if i < 0 {
+			break
+		}
+		if _, err := io.WriteString(m.w, m.secrets.mask(string(m.buf[:i+1]))); err != nil {
+			return 0, err
+		}
+		m.buf = m.buf[i+1:]
+	}
+	return len(p), nil
+}
+
+func (m *maskWriter) Flush() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if len(m.buf) == 0 {
+		return nil
+	}
+	_, err := io.WriteString(m.w, m.secrets.mask(string(m.buf)))
+	m.buf = m.buf[:0]
+	return err
+}
+
+// flushWriter は子プロセス終了時など、行の途中で止まった出力を吐き出す。
+func flushWriter(w io.Writer) {
+	if f, ok := w.(interface{ Flush() error }); ok {
+		_ = f.Flush()
+	}
+}
+
+// secretNames は vars.secrets のキー（ctx の解決でテンプレートとして扱わない）。
+func secretNames(defs map[string]SecretSource) map[string]bool {
+	names := make(map[string]bool, len(defs))
+	for k := range defs {
+		names[k] = true
+	}
+	return names
+}
+
+// loadSecrets は profile ごとにシークレットを取得し、secretValues に登録する。
+func loadSecrets(mw io.Writer, profile, region string, ctx map[string]string, defs map[string]SecretSource) (map[string]string, error) {
+	names := make([]string, 0, len(defs))
+	for k := range defs {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	out := make(map[string]string, len(defs))
+	for _, name := range names {
+		if isBuiltInKey(name) {
+			return nil, fmt.Errorf("secret %s: built-in variable cannot be a secret", name)
+		}
+		src := defs[name]
+
+		v, kind, err := fetchSecret(profile, region, ctx, src)
+		if err != nil {
+			fmt.Fprintf(mw, "❌ SECRET NG | %s | profile=%s | source=%s\n", name, profile, kind)
+			return nil, fmt.Errorf("secret %s: %w", name, err)
+		}
+
+		if err := checkSecretLen(v); err != nil {
+			fmt.Fprintf(mw, "❌ SECRET NG | %s | profile=%s | source=%s\n", name, profile, kind)
+			return nil, fmt.Errorf("secret %s: %w", name, err)
+		}
+
+		secretValues.add(v)
+		out[name] = v
+		fmt.Fprintf(mw, "🔑 SECRET OK | %s | profile=%s | source=%s\n", name, profile, kind)
+	}
+	return out, nil
+}
+
+func fetchSecret(profile, region string, ctx map[string]string, src SecretSource) (value string, kind string, err error) {
+	render := func(s string) (string, error) {
+		r, _, e := renderTemplateString(s, ctx)
+		return r, e
+	}
+
+	switch {
+	case src.Env != "":
+		kind = "env"
+		name, e := render(src.Env)
+		if e != nil {
+			return "", kind, e
+		}
+		v, ok := os.LookupEnv(name)
+		if !ok {
+			return "", kind, fmt.Errorf("environment variable %s is not set", name)
+		}
+		return v, kind, nil
+
+	case src.File != "":
+		kind = "file"
+		path, e := render(src.File)
+		if e != nil {
+			return "", kind, e
+		}
+		b, e := os.ReadFile(path)
+		if e != nil {
+			return "", kind, fmt.Errorf("read failed: %w", e)
+		}
+		return strings.TrimRight(string(b), "\r\n"), kind, nil
+
+	case src.SecretsManager != "":
+		kind = "secretsmanager"
+		id, e := render(src.SecretsManager)
+		if e != nil {
+			return "", kind, e
+		}
+		b, errText, e := runAWSQuiet(profile, region, "secretsmanager", "get-secret-value", "--secret-id", id)
+		if e != nil {
+			return "", kind, awsQuietError(e, errText)
+		}
+		var data struct {
+			SecretString string `json:"SecretString"`
+		}
+		if e := json.Unmarshal(b, &data); e != nil {
+			return "", kind, fmt.Errorf("json parse failed: %w", e)
+		}
+		if src.JSONKey == "" {
+			return data.SecretString, kind, nil
+		}
+		var m map[string]any
+		if e := json.Unmarshal([]byte(data.SecretString), &m); e != nil {
+			return "", kind, fmt.Errorf("SecretString is not JSON object: %w", e)
+		}
+		v, ok := m[src.JSONKey]
+		if !ok {
+			return "", kind, fmt.Errorf("json_key %s not found", src.JSONKey)
+		}
+		return textValue(v), kind, nil
+
+	case src.SSM != "":
+		kind = "ssm"
+		name, e := render(src.SSM)
+		if e != nil {
+			return "", kind, e
+		}
+		b, errText, e := runAWSQuiet(profile, region, "ssm", "get-parameter", "--name", name, "--with-decryption")
+		if e != nil {
+			return "", kind, awsQuietError(e, errText)
+		}
+		var data struct {
+			Parameter struct {
+				Value string `json:"Value"`
+			} `json:"Parameter"`
+		}
+		if e := json.Unmarshal(b, &data); e != nil {
+			return "", kind, fmt.Errorf("json parse failed: %w", e)
+		}
+		return data.Parameter.Value, kind, nil
+	}
+
+	return "", "unknown", fmt.Errorf("no source (env/file/secretsmanager/ssm)")
+}
+
+// runAWSQuiet は stdout を console/log に流さずに aws を実行する（STS / secrets 用）。テストでは差し替える。
+var runAWSQuiet = func(profile, region string, args ...string) (stdout []byte, errText string, err error) {
+	full := append([]string{
+		"--no-cli-pager",
+		"--profile", profile,
+		"--region", region,
+		"--output", "json",
+	}, args...)
+	cmd := exec.Command("aws", full...)
+
+	var out bytes.Buffer
+	var stderr bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = &stderr
+
+	// suppress interactive behaviors (pager / auto prompt)
+	cmd.Env = append(os.Environ(),
+		"AWS_PAGER=",
+		"AWS_CLI_AUTO_PROMPT=off",
+	)
+
+	if e := cmd.Run(); e != nil {
+		return nil, strings.TrimSpace(stderr.String()), e
+	}
+	return out.Bytes(), "", nil
+}
+
+func awsQuietError(err error, errText string) error {
+	if errText != "" {
+		return fmt.Errorf("%w: %s", err, errText)
+	}
+	return err
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCheckSecretLen(t *testing.T) {
+	tests := []struct {
+		v       string
+		wantErr string
+	}{
+		{v: "abcd"},
+		{v: "  abcd  "},
+		{v: "", wantErr: "too short (0 chars"},
+		{v: "abc", wantErr: "too short (3 chars"},
+		{v: "  ab  ", wantErr: "too short (2 chars without surrounding spaces, min 4)"},
+	}
+	for _, tt := range tests {
+		err := checkSecretLen(tt.v)
+		if tt.wantErr == "" {
+			if err != nil {
+				t.Errorf("checkSecretLen(%q) = %v, want nil", tt.v, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("checkSecretLen(%q) = %v, want %q", tt.v, err, tt.wantErr)
+		}
+	}
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"runtime"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ShScript は sh: の値。文字列、または OS ごとの指定。
+//
+//	sh: "ls -la"
+//	sh:
+//	  linux: "ls -la"
+//	  darwin: "ls -la"
+//	  windows: "Get-ChildItem"
+//	  default: "ls"   # 該当 OS が無いとき（unix = linux/darwin 共通）
+type ShScript struct {
+	Script string
+	ByOS   map[string]string
+}
+
+func (s *ShScript) UnmarshalYAML(n *yaml.Node) error {
+	if n.Kind != yaml.MappingNode {
+		return n.Decode(&s.Script)
+	}
+	m := map[string]string{}
+	if err := n.Decode(&m); err != nil {
+		return err
+	}
+	for k := range m {
+		switch k {
+		case "linux", "darwin", "windows", "unix", "default":
+		default:
+			return fmt.Errorf("line %d: sh: unknown OS key %q (linux/darwin/windows/unix/default)", n.Line, k)
+		}
+	}
+	s.ByOS = m
+	return nil
+}
+
+// For は goos 向けのスクリプトを返す（無ければ空文字）。
+func (s ShScript) For(goos string) string {
+	if s.ByOS == nil {
+		return s.Script
+	}
+	if v, ok := s.ByOS[goos]; ok {
+		return v
+	}
+	if goos != "windows" {
+		if v, ok := s.ByOS["unix"]; ok {
+			return v
+		}
+	}
+	return s.ByOS["default"]
+}
+
+// IsZero は yaml の omitempty 用。
+func (s ShScript) IsZero() bool {
+	return s.Script == "" && len(s.ByOS) == 0
+}
+
+// hostOS は sh: の OS 別スクリプトと既定シェルを選ぶ OS（テストでは差し替える）。
+var hostOS = runtime.GOOS
+
+// shellInterpreters は shell: 名から実行する argv を作る。
+// テストや特殊環境ではここを差し替えてスタブのインタプリタを使える。
+var shellInterpreters = map[string]func(script string) ([]string, error){
+	"bash": func(script string) ([]string, error) {
+		return []string{"bash", "-lc", script}, nil
+	},
+	"sh": func(script string) ([]string, error) {
+		return []string{"sh", "-c", script}, nil
+	},
+	"pwsh": func(script string) ([]string, error) {
+		// PowerShell 7 が無ければ Windows PowerShell
+		bin := "pwsh"
+		if _, err := exec.LookPath(bin); err != nil && hostOS == "windows" {
+			bin = "powershell"
+		}
+		return []string{bin, "-NoProfile", "-NonInteractive", "-Command", script}, nil
+	},
+	"cmd": func(script string) ([]string, error) {
+		return []string{"cmd", "/d", "/s", "/c", script}, nil
+	},
+	"none": func(script string) ([]string, error) {
+		// シェルを介さず直接実行（パイプ/リダイレクト不可）
+		argv, err := splitCommandLine(script)
+		if err != nil {
+			return nil, err
+		}
+		if len(argv) == 0 {
+			return nil, fmt.Errorf("shell none: empty command")
+		}
+		return argv, nil
+	},
+}
+
+// defaultShell は OS ごとの既定のシェル。
+func defaultShell(goos string) string {
+	if goos == "windows" {
+		return "pwsh"
+	}
+	return "bash"
+}
+
+// resolveShell は cmd > 全体設定 > OS（goos）既定 の順でシェル名を決める。
+func resolveShell(cmdShell, globalShell, goos string) (string, error) {
+	name := strings.ToLower(strings.TrimSpace(cmdShell))
+	if name == "" {
+		name = strings.ToLower(strings.TrimSpace(globalShell))
+	}
+	if name == "" {
+		name = defaultShell(goos)
+	}
+	if _, ok := shellInterpreters[name]; !ok {
+		return "", fmt.Errorf("unsupported shell: %s (%s)", name, strings.Join(shellNames(), "/"))
+	}
+	return name, nil
+}
+
+func shellNames() []string {
+	names := make([]string, 0, len(shellInterpreters))
+	for k := range shellInterpreters {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// shellArgv は script を shell で実行するための argv を返す。
+func shellArgv(shell, script string) ([]string, error) {
+	f, ok := shellInterpreters[shell]
+	if !ok {
+		return nil, fmt.Errorf("unsupported shell: %s", shell)
+	}
+	return f(script)
+}
+
+// shellPreview は dry-run で表示する実行内容。in は stdin に渡すファイル（無ければ ""）。
+func shellPreview(shell, script, in string) string {
+	if in == "" {
+		return script
+	}
+	switch shell {
+	case "pwsh":
+		return fmt.Sprintf("Get-Content -Raw '%s' | %s", strings.ReplaceAll(in, "'", "''"), script)
+	case "cmd":
+		return fmt.Sprintf("type \"%s\" | %s", in, script)
+	case "none":
+		return fmt.Sprintf("%s < %s", script, in)
+	default:
+		return fmt.Sprintf("cat %s | %s", in, script)
+	}
+}
+
+// splitCommandLine は shell: none 用の簡易な引数分割（'...' / "..." / \ エスケープ対応）。
+// Windows ではパス区切りと衝突するため、引用符の外の \ はエスケープとして扱わない。
+func splitCommandLine(s string) ([]string, error) {
+	var args []string
+	var cur strings.Builder
+	inArg := false
+	var quote rune
+
+	runes := []rune(s)
+	for i := 0; i < len(runes); i++ {
+		r := runes[i]
+		switch {
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			} else if r == '\\' && quote == '"' && i+1 < len(runes) {
+				i++
+				cur.WriteRune(runes[i])
+			} else {
+				cur.WriteRune(r)
+			}
+		case r == '\'' || r == '"':
+			quote = r
+			inArg = true
+		case r == '\\' && i+1 < len(runes) && hostOS != "windows":
+			i++
+			cur.WriteRune(runes[i])
+			inArg = true
+		case r == ' ' || r == '\t' || r == '\n' || r == '\r':
+			if inArg {
+				args = append(args, cur.String())
+				cur.Reset()
+				inArg = false
+			}
+		default:
+			cur.WriteRune(r)
+			inArg = true
+		}
+	}
+	if quote != 0 {
+		return nil, fmt.Errorf("unterminated quote in %q", s)
+	}
+	if inArg {
+		args = append(args, cur.String())
+	}
+	return args, nil
+}
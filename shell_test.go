@@ -0,0 +1,142 @@
+package main
+
+import (
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestResolveShell(t *testing.T) {
+	tests := []struct {
+		name      string
+		cmdShell  string
+		global    string
+		goos      string
+		want      string
+		wantError bool
+	}{
+		{name: "linux default", goos: "linux", want: "bash"},
+		{name: "darwin default", goos: "darwin", want: "bash"},
+		{name: "windows default", goos: "windows", want: "pwsh"},
+		{name: "global cmd on windows", global: "cmd", goos: "windows", want: "cmd"},
+		{name: "cmd overrides global", cmdShell: "sh", global: "pwsh", goos: "linux", want: "sh"},
+		{name: "case and space", cmdShell: " PWSH ", goos: "linux", want: "pwsh"},
+		{name: "none", cmdShell: "none", goos: "windows", want: "none"},
+		{name: "unsupported", cmdShell: "zsh", goos: "linux", wantError: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := resolveShell(tt.cmdShell, tt.global, tt.goos)
+			if tt.wantError {
+				if err == nil {
+					t.Fatalf("got %q, want error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("resolveShell = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestShScriptFor(t *testing.T) {
+	byOS := ShScript{ByOS: map[string]string{"linux": "ls -la", "unix": "ls", "windows": "Get-ChildItem", "default": "dir"}}
+	unixOnly := ShScript{ByOS: map[string]string{"unix": "ls"}}
+	defaultOnly := ShScript{ByOS: map[string]string{"default": "echo any"}}
+
+	tests := []struct {
+		name string
+		sh   ShScript
+		goos string
+		want string
+	}{
+		{"plain string", ShScript{Script: "echo hi"}, "windows", "echo hi"},
+		{"exact os", byOS, "linux", "ls -la"},
+		{"unix for darwin", byOS, "darwin", "ls"},
+		{"windows", byOS, "windows", "Get-ChildItem"},
+		{"unix is not windows", unixOnly, "windows", ""},
+		{"default", defaultOnly, "freebsd", "echo any"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.sh.For(tt.goos); got != tt.want {
+				t.Errorf("For(%s) = %q, want %q", tt.goos, got, tt.want)
+			}
+		})
+	}
+}
+
+// stubInterpreters は shell 名ごとに「名前と受け取ったスクリプト」を出力するスタブに差し替える。
+func stubInterpreters(t *testing.T) {
+	t.Helper()
+	orig := shellInterpreters
+	t.Cleanup(func() { shellInterpreters = orig })
+
+	stubs := map[string]func(string) ([]string, error){}
+	for name, f := range orig {
+		stubs[name] = func(script string) ([]string, error) {
+			if _, err := f(script); err != nil {
+				return nil, err
+			}
+			return []string{"sh", "-c", `printf '%s:%s' "$0" "$1"`, name, script}, nil
+		}
+	}
+	shellInterpreters = stubs
+}
+
+func TestShellRunsPerOSVariantWithStub(t *testing.T) {
+	stubInterpreters(t)
+	sh := ShScript{ByOS: map[string]string{"unix": "ls", "windows": "Get-ChildItem"}}
+
+	tests := []struct {
+		goos string
+		want string
+	}{
+		{"linux", "bash:ls"},
+		{"darwin", "bash:ls"},
+		{"windows", "pwsh:Get-ChildItem"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.goos, func(t *testing.T) {
+			shell, err := resolveShell("", "", tt.goos)
+			if err != nil {
+				t.Fatal(err)
+			}
+			out, err := runShellAndCapture(shell, sh.For(tt.goos), nil, io.Discard)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(out) != tt.want {
+				t.Errorf("out = %q, want %q", out, tt.want)
+			}
+		})
+	}
+
+	if _, err := runShellAndCapture("none", `echo "unterminated`, nil, io.Discard); err == nil || !strings.Contains(err.Error(), "unterminated quote") {
+		t.Errorf("none: err = %v, want unterminated quote", err)
+	}
+}
+
+func TestShellPreview(t *testing.T) {
+	tests := []struct {
+		shell string
+		in    string
+		want  string
+	}{
+		{"bash", "", "jq ."},
+		{"bash", "./in.json", "cat ./in.json | jq ."},
+		{"sh", "./in.json", "cat ./in.json | jq ."},
+		{"pwsh", `C:\it's.json`, `Get-Content -Raw 'C:\it''s.json' | jq .`},
+		{"cmd", `C:\in.json`, `type "C:\in.json" | jq .`},
+		{"none", "./in.json", "jq . < ./in.json"},
+	}
+	for _, tt := range tests {
+		if got := shellPreview(tt.shell, "jq .", tt.in); got != tt.want {
+			t.Errorf("shellPreview(%s, %q) = %q, want %q", tt.shell, tt.in, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	gojmespath "github.com/jmespath/go-jmespath"
+	"gopkg.in/yaml.v3"
+)
+
+// SwitchBlock は JMESPath（または ctx 変数）の値で分岐する。
+//
+//	cmd:
+//	  - name: stack-status
+//	    aws: ["cloudformation", "describe-stacks", "--stack-name", "{{ .STACK_NAME }}"]
+//	    switch:
+//	      expr: "Stacks[0].StackStatus"
+//	      cases:
+//	        CREATE_COMPLETE|UPDATE_COMPLETE:
+//	          - { name: done, sh: "echo done" }
+//	        "*_ROLLBACK_COMPLETE":
+//	          - { name: rollback, sh: "echo rollback" }
+//	      default:
+//	        - { name: unknown, sh: "echo unknown" }
+//
+// case のキー: 値そのもの、| 区切りの候補、* / ? を含むパターン（glob）。
+// 完全一致を優先し、次に書いた順でパターンを照合、どれにも当たらなければ default。
+type SwitchBlock struct {
+	Expr    string
+	Var     string
+	Cases   []SwitchCase
+	Default []Cmd
+}
+
+type SwitchCase struct {
+	Match string
+	Steps []Cmd
+}
+
+func (sb *SwitchBlock) UnmarshalYAML(n *yaml.Node) error {
+	if n.Kind != yaml.MappingNode {
+		return fmt.Errorf("line %d: switch must be a mapping (expr / var / cases / default)", n.Line)
+	}
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		k, v := n.Content[i], n.Content[i+1]
+		switch k.Value {
+		case "expr":
+			if err := v.Decode(&sb.Expr); err != nil {
+				return err
+			}
+		case "var":
+			if err := v.Decode(&sb.Var); err != nil {
+				return err
+			}
+		case "default":
+			if err := v.Decode(&sb.Default); err != nil {
+				return err
+			}
+		case "cases":
+			if v.Kind != yaml.MappingNode {
+				return fmt.Errorf("line %d: switch cases must be a mapping (value: [steps])", v.Line)
+			}
+			for j := 0; j+1 < len(v.Content); j += 2 {
+				sc := SwitchCase{Match: v.Content[j].Value}
+				if err := v.Content[j+1].Decode(&sc.Steps); err != nil {
+					return err
+				}
+				sb.Cases = append(sb.Cases, sc)
+			}
+		default:
+			return fmt.Errorf("line %d: switch: unknown key %q (expr / var / cases / default)", k.Line, k.Value)
+		}
+	}
+	if (sb.Expr == "") == (sb.Var == "") {
+		return fmt.Errorf("line %d: switch requires exactly one of expr / var", n.Line)
+	}
+	if len(sb.Cases) == 0 && len(sb.Default) == 0 {
+		return fmt.Errorf("line %d: switch requires cases or default", n.Line)
+	}
+	return nil
+}
+
+// subject は表示用の分岐対象。
+func (sb *SwitchBlock) subject() string {
+	if sb.Var != "" {
+		return "var=" + sb.Var
+	}
+	return "expr=" + sb.Expr
+}
+
+// value は分岐対象の値（文字列化）を返す。未定義の var は default ではなくエラー。
+func (sb *SwitchBlock) value(ctx map[string]string, last any) (string, error) {
+	if sb.Var != "" {
+		v, ok := ctx[sb.Var]
+		if !ok {
+			return "", fmt.Errorf("switch: undefined variable: %s", sb.Var)
+		}
+		return v, nil
+	}
+	if last == nil {
+		return "", fmt.Errorf("switch requires JSON stdout, but LAST_JSON is nil")
+	}
+	got, err := gojmespath.Search(sb.Expr, last)
+	if err != nil {
+		return "", fmt.Errorf("switch: invalid expr %q: %w", sb.Expr, err)
+	}
+	return textValue(got), nil
+}
+
+// match は value に当たる case の index を返す（無ければ -1 = default）。
+func (sb *SwitchBlock) match(value string) (int, error) {
+	for i, c := range sb.Cases {
+		for _, alt := range strings.Split(c.Match, "|") {
+			if strings.TrimSpace(alt) == value {
+				return i, nil
+			}
+		}
+	}
+	for i, c := range sb.Cases {
+		for _, alt := range strings.Split(c.Match, "|") {
+			alt = strings.TrimSpace(alt)
+			if !strings.ContainsAny(alt, "*?[") {
+				continue
+			}
+			ok, err := path.Match(alt, value)
+			if err != nil {
+				return -1, fmt.Errorf("switch: invalid pattern %q: %w", alt, err)
+			}
+			if ok {
+				return i, nil
+			}
+		}
+	}
+	return -1, nil
+}
+
+// branchLabel は summary / JSONL 用の分岐名。
+func (sb *SwitchBlock) branchLabel(i int) string {
+	if i < 0 {
+		return "default"
+	}
+	return "case:" + sb.Cases[i].Match
+}
+
+// steps は分岐先のステップ列。
+func (sb *SwitchBlock) steps(i int) []Cmd {
+	if i < 0 {
+		return sb.Default
+	}
+	return sb.Cases[i].Steps
+}
+
+// mapSteps は各 case / default のステップ列に f を適用した複製を返す（import / use 展開用）。
+func (sb *SwitchBlock) mapSteps(f func([]Cmd) ([]Cmd, error)) (*SwitchBlock, error) {
+	out := &SwitchBlock{Expr: sb.Expr, Var: sb.Var}
+	for _, c := range sb.Cases {
+		steps, err := f(c.Steps)
+		if err != nil {
+			return nil, err
+		}
+		out.Cases = append(out.Cases, SwitchCase{Match: c.Match, Steps: steps})
+	}
+	if sb.Default != nil {
+		steps, err := f(sb.Default)
+		if err != nil {
+			return nil, err
+		}
+		out.Default = steps
+	}
+	return out, nil
+}
+
+// runSwitch は分岐を評価して該当する case（無ければ default）を実行する。
+// dry-run ではすべての case を PLAN として表示する。
+func runSwitch(env *runEnv, profile, stepPathStr string, ctx map[string]string, c Cmd, last any) error {
+	sb := c.Switch
+	mw := env.mw
+
+	if env.dryRun {
+		fmt.Fprintf(mw, "🧪 SWITCH PLAN | %s | profile=%s | %s\n", c.Name, profile, sb.subject())
+		// cases を書いた順に、default を最後に
+		for i := 0; i <= len(sb.Cases); i++ {
+			idx := i
+			if i == len(sb.Cases) {
+				if len(sb.Default) == 0 {
+					break
+				}
+				idx = -1
+			}
+			label := sb.branchLabel(idx)
+			fmt.Fprintf(mw, "🧪 CASE PLAN | %s | profile=%s | %s\n", c.Name, profile, label)
+			for _, child := range sb.steps(idx) {
+				if err := runCmdTreeForProfile(env, profile, stepPath(stepPathStr, label, child.Name), ctx, child); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+
+	value, err := sb.value(ctx, last)
+	if err != nil {
+		fmt.Fprintf(mw, "❌ SWITCH NG | %s | profile=%s\n", c.Name, profile)
+		return err
+	}
+	idx, err := sb.match(value)
+	if err != nil {
+		fmt.Fprintf(mw, "❌ SWITCH NG | %s | profile=%s\n", c.Name, profile)
+		return err
+	}
+	label := sb.branchLabel(idx)
+
+	fmt.Fprintf(mw, "🔀 SWITCH    | %s | profile=%s | %s | value=%q -> %s\n", c.Name, profile, sb.subject(), value, label)
+	env.events.emit(event{Event: "switch", Profile: profile, Step: stepPathStr, Status: "ok", Case: label})
+	env.summary.recordBranch(profile, env.summaryStep(stepPathStr), "switch:"+label)
+
+	for _, child := range sb.steps(idx) {
+		if err := runCmdTreeForProfile(env, profile, stepPath(stepPathStr, label, child.Name), ctx, child); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+func TestSwitchValueAndMatch(t *testing.T) {
+	var sb SwitchBlock
+	err := yaml.Unmarshal([]byte(`
+var: STATUS
+cases:
+  CREATE_COMPLETE|UPDATE_COMPLETE: [{ name: done, sh: echo done }]
+  "*_ROLLBACK_COMPLETE": [{ name: rollback, sh: echo rollback }]
+  UPDATE_ROLLBACK_COMPLETE: [{ name: exact, sh: echo exact }]
+default: [{ name: unknown, sh: echo unknown }]
+`), &sb)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		ctx     map[string]string
+		want    string
+		wantErr string
+	}{
+		{name: "alternative", ctx: map[string]string{"STATUS": "UPDATE_COMPLETE"}, want: "case:CREATE_COMPLETE|UPDATE_COMPLETE"},
+		{name: "exact before pattern", ctx: map[string]string{"STATUS": "UPDATE_ROLLBACK_COMPLETE"}, want: "case:UPDATE_ROLLBACK_COMPLETE"},
+		{name: "pattern", ctx: map[string]string{"STATUS": "CREATE_ROLLBACK_COMPLETE"}, want: "case:*_ROLLBACK_COMPLETE"},
+		{name: "default", ctx: map[string]string{"STATUS": "DELETE_COMPLETE"}, want: "default"},
+		{name: "empty value is default", ctx: map[string]string{"STATUS": ""}, want: "default"},
+		{name: "undefined variable", ctx: map[string]string{}, wantErr: "switch: undefined variable: STATUS"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v, err := sb.value(tt.ctx, nil)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			idx, err := sb.match(v)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := sb.branchLabel(idx); got != tt.want {
+				t.Errorf("branch = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
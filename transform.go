@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+
+	gojmespath "github.com/jmespath/go-jmespath"
+)
+
+// TransformBlock は jq の代わりに necro 内で JSON を加工するステップ。
+//
+//	cmd:
+//	  - name: accounts-ndjson
+//	    transform:
+//	      expr: "Accounts[]"
+//	      template: '{{ toJson (dict "profile" .Name "system" (splitList "_" .Name | first | lower)) }}'
+//	      format: ndjson
+//	    in: "./tmp/out/{{ .PROFILE }}/org-accounts.json"
+//	    out: "./tmp/out/accounts.jsonl"
+//
+// 入力: in（ファイル） > var（ctx変数のJSON） > 直前ステップの JSON 出力（LAST_JSON）
+type TransformBlock struct {
+	Var      string `yaml:"var,omitempty"`      // 入力にする ctx 変数（JSON文字列）
+	Expr     string `yaml:"expr,omitempty"`     // JMESPath。結果が配列なら要素ごとに template を適用
+	Template string `yaml:"template,omitempty"` // 要素ごとの Go template（.フィールド / ctx変数 / .item / .index）
+	Format   string `yaml:"format,omitempty"`   // json(default) / ndjson / text
+}
+
+func transformFormat(tb *TransformBlock) (string, error) {
+	f := strings.ToLower(strings.TrimSpace(tb.Format))
+	switch f {
+	case "":
+		return "json", nil
+	case "json", "ndjson", "text":
+		return f, nil
+	default:
+		return "", fmt.Errorf("transform: unsupported format: %s", tb.Format)
+	}
+}
+
+// transformInputDesc は dry-run / ログ用の入力元の表示。
+func transformInputDesc(tb *TransformBlock, inPath string) string {
+	switch {
+	case inPath != "":
+		return "in=" + inPath
+	case tb.Var != "":
+		return "var=" + tb.Var
+	default:
+		return "LAST_JSON"
+	}
+}
+
+// runTransform は入力 JSON に expr / template を適用し、format に整形した出力と、
+// capture / if 用の結果（LAST_JSON）を返す。
+func runTransform(tb *TransformBlock, ctx map[string]string, inPath string, lastJSON any) (stdout []byte, result any, err error) {
+	format, err := transformFormat(tb)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	input, err := transformInput(tb, ctx, inPath, lastJSON)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// expr
+	val := input
+	if strings.TrimSpace(tb.Expr) != "" {
+		val, err = gojmespath.Search(tb.Expr, input)
+		if err != nil {
+			return nil, nil, fmt.Errorf("transform: invalid expr %q: %w", tb.Expr, err)
+		}
+	}
+
+	// 配列なら要素ごと、それ以外は1要素として扱う
+	items, isArray := val.([]any)
+	if !isArray {
+		items = []any{val}
+	}
+
+	// template（要素ごと）
+	if strings.TrimSpace(tb.Template) != "" {
+		rendered := make([]any, 0, len(items))
+		for i, it := range items {
+			s, e := renderTemplateData(tb.Template, transformItemData(ctx, it, i))
+			if e != nil {
+				return nil, nil, fmt.Errorf("transform: item[%d]: %w", i, e)
+			}
+			if format == "text" {
+				rendered = append(rendered, s)
+				continue
+			}
+			v, ok := parseJSONOrNil([]byte(s))
+			if !ok {
+				return nil, nil, fmt.Errorf("transform: item[%d]: template output is not JSON (use format: text): %q", i, s)
+			}
+			rendered = append(rendered, v)
+		}
+		items = rendered
+	}
+
+	if isArray {
+		result = items
+	} else {
+		result = items[0]
+	}
+
+	stdout, err = formatTransformOutput(format, result, items)
+	if err != nil {
+		return nil, nil, err
+	}
+	return stdout, result, nil
+}
+
+func transformInput(tb *TransformBlock, ctx map[string]string, inPath string, lastJSON any) (any, error) {
+	switch {
+	case inPath != "":
+		b, err := os.ReadFile(inPath)
+		if err != nil {
+			return nil, fmt.Errorf("transform: in read failed: %w", err)
+		}
+		return parseJSONOrNDJSON(b, inPath)
+
+	case tb.Var != "":
+		raw, ok := ctx[tb.Var]
+		if !ok {
+			return nil, fmt.Errorf("transform: undefined variable: %s", tb.Var)
+		}
+		v, ok := parseJSONOrNil([]byte(raw))
+		if !ok {
+			return nil, fmt.Errorf("transform: variable %s is not JSON", tb.Var)
+		}
+		return v, nil
+
+	default:
+		if lastJSON == nil {
+			return nil, fmt.Errorf("transform requires JSON input (in / var), but LAST_JSON is nil")
+		}
+		return lastJSON, nil
+	}
+}
+
+// parseJSONOrNDJSON は JSON、または1行1JSON（NDJSON）を配列として読む。
+func parseJSONOrNDJSON(b []byte, name string) (any, error) {
+	if v, ok := parseJSONOrNil(b); ok {
+		return v, nil
+	}
+
+	var arr []any
+	for i, line := range strings.Split(string(b), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		var v any
+		if err := json.Unmarshal([]byte(line), &v); err != nil {
+			return nil, fmt.Errorf("%s:%d: not JSON / NDJSON: %w", name, i+1, err)
+		}
+		arr = append(arr, v)
+	}
+	if arr == nil {
+		return nil, fmt.Errorf("%s: empty input", name)
+	}
+	return arr, nil
+}
+
+// transformItemData は要素ごとのテンプレートデータ。
+// ctx 変数 + 要素がオブジェクトならそのフィールド（同名は要素が優先）+ .item / .index
+func transformItemData(ctx map[string]string, item any, index int) map[string]any {
+	data := make(map[string]any, len(ctx)+4)
+	for k, v := range ctx {
+		data[k] = v
+	}
+	if m, ok := item.(map[string]any); ok {
+		for k, v := range m {
+			data[k] = v
+		}
+	}
+	data["item"] = item
+	data["index"] = index
+	return data
+}
+
+func formatTransformOutput(format string, result any, items []any) ([]byte, error) {
+	var buf bytes.Buffer
+	switch format {
+	case "json":
+		b, err := json.MarshalIndent(result, "", "  ")
+		if err != nil {
+			return nil, fmt.Errorf("transform: json marshal failed: %w", err)
+		}
+		buf.Write(b)
+		buf.WriteByte('\n')
+
+	case "ndjson":
+		for _, it := range items {
+			b, err := json.Marshal(it)
+			if err != nil {
+				return nil, fmt.Errorf("transform: json marshal failed: %w", err)
+			}
+			buf.Write(b)
+			buf.WriteByte('\n')
+		}
+
+	case "text":
+		for _, it := range items {
+			buf.WriteString(textValue(it))
+			buf.WriteByte('\n')
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+// textValue は scalar はそのまま、array/object は JSON 文字列にする（capture と同じ規則）。
+func textValue(v any) string {
+	switch t := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return t
+	case bool:
+		return fmt.Sprint(t)
+	case float64:
+		// 整数は指数表記にしない（1.23456789012e+11 ではなく 123456789012）
+		if t == math.Trunc(t) && !math.IsInf(t, 0) {
+			return strconv.FormatFloat(t, 'f', -1, 64)
+		}
+		return fmt.Sprint(t)
+	default:
+		b, err := json.Marshal(t)
+		if err != nil {
+			return fmt.Sprint(t)
+		}
+		return string(b)
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestTextValue(t *testing.T) {
+	tests := []struct {
+		v    any
+		want string
+	}{
+		{nil, ""},
+		{"abc", "abc"},
+		{true, "true"},
+		{float64(7), "7"},
+		{float64(-3), "-3"},
+		{float64(123456789012), "123456789012"},
+		{float64(1000000), "1000000"},
+		{1.5, "1.5"},
+		{0.000001, "1e-06"},
+		{42, "42"},
+		{[]any{"a", float64(1)}, `["a",1]`},
+		{map[string]any{"k": "v"}, `{"k":"v"}`},
+	}
+	for _, tt := range tests {
+		if got := textValue(tt.v); got != tt.want {
+			t.Errorf("textValue(%#v) = %q, want %q", tt.v, got, tt.want)
+		}
+	}
+}
+
+func TestRunTransform(t *testing.T) {
+	dir := t.TempDir()
+	in := filepath.Join(dir, "acc.jsonl")
+	if err := os.WriteFile(in, []byte("{\"Id\": 111111111111, \"Name\": \"COM_PRD\"}\n{\"Id\": 222222222222, \"Name\": \"SND_DEV\"}\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := map[string]string{
+		"ENV":      "dev",
+		"ACCOUNTS": `{"Accounts": [{"Id": "1", "Name": "COM_PRD"}, {"Id": "2", "Name": "SND_DEV"}]}`,
+		"TEXT":     "not json",
+	}
+	last := map[string]any{"Stacks": []any{map[string]any{"StackName": "a"}, map[string]any{"StackName": "b"}}}
+
+	tests := []struct {
+		name       string
+		tb         TransformBlock
+		in         string
+		last       any
+		wantOut    string
+		wantResult any
+		wantErr    string
+	}{
+		{
+			name:       "json from LAST_JSON",
+			tb:         TransformBlock{Expr: "Stacks[].StackName"},
+			last:       last,
+			wantOut:    "[\n  \"a\",\n  \"b\"\n]\n",
+			wantResult: []any{"a", "b"},
+		},
+		{
+			name:       "scalar result",
+			tb:         TransformBlock{Expr: "length(Stacks)"},
+			last:       last,
+			wantOut:    "2\n",
+			wantResult: float64(2),
+		},
+		{
+			name:    "ndjson with template from var",
+			tb:      TransformBlock{Var: "ACCOUNTS", Expr: "Accounts[]", Template: `{{ toJson (dict "profile" .Name "env" .ENV "i" .index) }}`, Format: "ndjson"},
+			wantOut: "{\"env\":\"dev\",\"i\":0,\"profile\":\"COM_PRD\"}\n{\"env\":\"dev\",\"i\":1,\"profile\":\"SND_DEV\"}\n",
+			wantResult: []any{
+				map[string]any{"env": "dev", "i": float64(0), "profile": "COM_PRD"},
+				map[string]any{"env": "dev", "i": float64(1), "profile": "SND_DEV"},
+			},
+		},
+		{
+			name:       "text from NDJSON file keeps large ids",
+			tb:         TransformBlock{Expr: "[].Id", Format: "text"},
+			in:         in,
+			wantOut:    "111111111111\n222222222222\n",
+			wantResult: []any{float64(111111111111), float64(222222222222)},
+		},
+		{
+			name:       "text template",
+			tb:         TransformBlock{Var: "ACCOUNTS", Expr: "Accounts[]", Template: "{{ .Name | lower }}", Format: "TEXT"},
+			wantOut:    "com_prd\nsnd_dev\n",
+			wantResult: []any{"com_prd", "snd_dev"},
+		},
+		{
+			name:    "unsupported format",
+			tb:      TransformBlock{Format: "yaml"},
+			last:    last,
+			wantErr: "transform: unsupported format: yaml",
+		},
+		{
+			name:    "template output is not JSON",
+			tb:      TransformBlock{Expr: "Stacks[]", Template: "{{ .StackName }}"},
+			last:    last,
+			wantErr: `transform: item[0]: template output is not JSON (use format: text): "a"`,
+		},
+		{
+			name:    "undefined var",
+			tb:      TransformBlock{Var: "NOPE"},
+			wantErr: "transform: undefined variable: NOPE",
+		},
+		{
+			name:    "var not JSON",
+			tb:      TransformBlock{Var: "TEXT"},
+			wantErr: "transform: variable TEXT is not JSON",
+		},
+		{
+			name:    "no input",
+			tb:      TransformBlock{Expr: "a"},
+			wantErr: "LAST_JSON is nil",
+		},
+		{
+			name:    "invalid expr",
+			tb:      TransformBlock{Expr: "Stacks[0"},
+			last:    last,
+			wantErr: `transform: invalid expr "Stacks[0"`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, result, err := runTransform(&tt.tb, ctx, tt.in, tt.last)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(out) != tt.wantOut {
+				t.Errorf("out = %q, want %q", out, tt.wantOut)
+			}
+			if !reflect.DeepEqual(result, tt.wantResult) {
+				t.Errorf("result = %#v, want %#v", result, tt.wantResult)
+			}
+		})
+	}
+}
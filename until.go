@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	gojmespath "github.com/jmespath/go-jmespath"
+	"gopkg.in/yaml.v3"
+)
+
+// UntilBlock はステップを条件が成り立つまで繰り返す（ポーリング）。
+//
+//	cmd:
+//	  - name: ssm-command-wait
+//	    aws: ["ssm", "get-command-invocation", "--command-id", "{{ .COMMAND_ID }}", "--instance-id", "{{ .INSTANCE_ID }}"]
+//	    until:
+//	      expr: Status
+//	      op: eq
+//	      value: Success
+//	      interval: 10s
+//	      max_wait: 15m
+//	      fail_if: { expr: Status, op: in, value: [Failed, Cancelled, TimedOut] }
+//	      retry_on_error: true     # 終了コードが 0 以外でも「まだ」として続ける（既定 false: 即失敗）
+//	    capture:
+//	      OUTPUT: StandardOutputContent
+//
+// 条件は if と同じ書式（all / any / not も可）。capture / if / out は最後の応答に対して行う。
+// ctx はポーリング中に変わらないので、条件には expr（毎回の応答）が必要（var だけの条件は読み込み時にエラー）。
+// retry_on_error のときは fail_if か max_wait でだけ止まる（作成直後でまだ参照できない API など）。
+type UntilBlock struct {
+	Cond         Condition
+	Interval     time.Duration
+	MaxWait      time.Duration
+	FailIf       *Condition
+	RetryOnError bool
+}
+
+const (
+	defaultUntilInterval = 10 * time.Second
+	defaultUntilMaxWait  = 10 * time.Minute
+)
+
+func (u *UntilBlock) UnmarshalYAML(n *yaml.Node) error {
+	if n.Kind != yaml.MappingNode {
+		return fmt.Errorf("line %d: until must be a mapping (condition + interval / max_wait / fail_if / retry_on_error)", n.Line)
+	}
+	u.Interval = defaultUntilInterval
+	u.MaxWait = defaultUntilMaxWait
+
+	// interval / max_wait / fail_if / retry_on_error 以外のキーを条件として読む
+	cond := *n
+	cond.Content = nil
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		k, v := n.Content[i], n.Content[i+1]
+		switch k.Value {
+		case "interval", "max_wait":
+			var s string
+			if err := v.Decode(&s); err != nil {
+				return err
+			}
+			d, err := time.ParseDuration(s)
+			if err != nil || d <= 0 {
+				return fmt.Errorf("line %d: until %s: invalid duration %q (e.g. 10s, 5m)", v.Line, k.Value, s)
+			}
+			if k.Value == "interval" {
+				u.Interval = d
+			} else {
+				u.MaxWait = d
+			}
+		case "fail_if":
+			u.FailIf = &Condition{}
+			if err := v.Decode(u.FailIf); err != nil {
+				return err
+			}
+		case "retry_on_error":
+			if err := v.Decode(&u.RetryOnError); err != nil {
+				return fmt.Errorf("line %d: until retry_on_error: %w", v.Line, err)
+			}
+		default:
+			cond.Content = append(cond.Content, k, v)
+		}
+	}
+	if err := cond.Decode(&u.Cond); err != nil {
+		return err
+	}
+	if !u.Cond.usesExpr() {
+		return fmt.Errorf("line %d: until: condition must use expr (var is not updated between polls, so it would never change)", n.Line)
+	}
+	return nil
+}
+
+// desc は UNTIL PLAN の表示。
+func (u *UntilBlock) desc() string {
+	s := fmt.Sprintf("until %s | interval=%s | max_wait=%s", u.Cond.String(), u.Interval, u.MaxWait)
+	if u.FailIf != nil {
+		s += " | fail_if " + u.FailIf.String()
+	}
+	if u.RetryOnError {
+		s += " | retry_on_error"
+	}
+	return s
+}
+
+// stepExec はステップを1回実行する（出力は w へ）。
+type stepExec func(w io.Writer) (stdout []byte, last any, err error)
+
+// runUntil は条件が成り立つまで exec を繰り返し、最後の応答を返す。
+// 途中の応答は表示せず、1回ごとに1行の POLL ログを出す。最後の応答だけ mw に出す。
+func runUntil(env *runEnv, profile, path string, c Cmd, ctx map[string]string, exec stepExec) ([]byte, any, error) {
+	u := c.Until
+	mw := env.mw
+	start := time.Now()
+
+	for n := 1; ; n++ {
+		var buf lockedBuffer
+		stdout, last, execErr := exec(&buf)
+		if execErr != nil && !u.RetryOnError {
+			_, _ = mw.Write(buf.Bytes())
+			return stdout, last, execErr
+		}
+
+		// 失敗した応答は「まだ」として扱う（fail_if は応答が JSON なら評価する）
+		done := false
+		if execErr == nil {
+			var err error
+			done, err = evalCondition("until", &u.Cond, ctx, last)
+			if err != nil {
+				_, _ = mw.Write(buf.Bytes())
+				return stdout, last, err
+			}
+		}
+		elapsed := time.Since(start).Round(time.Second)
+		if done {
+			_, _ = mw.Write(buf.Bytes())
+			fmt.Fprintf(mw, "✅ UNTIL OK  | %s | profile=%s | polls=%d | elapsed=%s\n", c.Name, profile, n, elapsed)
+			env.events.emit(event{Event: "poll", Profile: profile, Step: path, Status: "ok", Poll: n, DurationMs: durationMs(time.Since(start))})
+			return stdout, last, nil
+		}
+
+		if u.FailIf != nil && (execErr == nil || last != nil) {
+			failed, err := evalCondition("until fail_if", u.FailIf, ctx, last)
+			if err != nil {
+				_, _ = mw.Write(buf.Bytes())
+				return stdout, last, err
+			}
+			if failed {
+				_, _ = mw.Write(buf.Bytes())
+				return stdout, last, fmt.Errorf("until: fail_if matched after %d polls: %s", n, u.FailIf.String())
+			}
+		}
+
+		if time.Since(start)+u.Interval > u.MaxWait {
+			_, _ = mw.Write(buf.Bytes())
+			if execErr != nil {
+				return stdout, last, fmt.Errorf("until: timed out after %s (%d polls): %s: last error: %w", elapsed, n, u.Cond.String(), execErr)
+			}
+			return stdout, last, fmt.Errorf("until: timed out after %s (%d polls): %s", elapsed, n, u.Cond.String())
+		}
+
+		if execErr != nil {
+			fmt.Fprintf(mw, "⏳ POLL      | %s | profile=%s | #%d | elapsed=%s | error=%v | next in %s\n",
+				c.Name, profile, n, elapsed, execErr, u.Interval)
+		} else {
+			fmt.Fprintf(mw, "⏳ POLL      | %s | profile=%s | #%d | elapsed=%s%s | next in %s\n",
+				c.Name, profile, n, elapsed, conditionValueDesc(&u.Cond, ctx, last), u.Interval)
+		}
+		env.events.emit(event{Event: "poll", Profile: profile, Step: path, Status: "wait", Poll: n, DurationMs: durationMs(time.Since(start)), Error: errString(execErr)})
+		select {
+		case <-time.After(u.Interval):
+		case <-interruptCh:
+			if err := env.checkInterrupted(); err != nil {
+				return stdout, last, err
+			}
+			time.Sleep(u.Interval) // hook 内の until は中断しない
+		}
+	}
+}
+
+// lockedBuffer は子プロセスの stdout / stderr を同時に受ける（コピーが別 goroutine のため）。
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) Bytes() []byte {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Bytes()
+}
+
+// conditionValueDesc は葉1つだけの条件なら " | Status=\"InProgress\"" のように現在値を返す。
+func conditionValueDesc(c *Condition, ctx map[string]string, last any) string {
+	switch {
+	case c.Var != "":
+		return fmt.Sprintf(" | %s=%q", c.Var, ctx[c.Var])
+	case c.Expr != "" && last != nil:
+		v, err := gojmespath.Search(c.Expr, last)
+		if err != nil {
+			return ""
+		}
+		return fmt.Sprintf(" | %s=%q", c.Expr, textValue(v))
+	default:
+		return ""
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// stubPoll は n 回目の呼び出しで statuses[n-1] を返す exec（範囲外は最後の値）。空文字は終了コード 0 以外として扱う。
+func stubPoll(statuses ...string) (stepExec, *int) {
+	calls := 0
+	return func(w io.Writer) ([]byte, any, error) {
+		calls++
+		s := statuses[len(statuses)-1]
+		if calls <= len(statuses) {
+			s = statuses[calls-1]
+		}
+		if s == "" {
+			_, _ = io.WriteString(w, "InvocationDoesNotExist\n")
+			return nil, nil, errors.New("exit status 254")
+		}
+		out := `{"Status": "` + s + `"}`
+		_, _ = io.WriteString(w, out+"\n")
+		return []byte(out), map[string]any{"Status": s}, nil
+	}, &calls
+}
+
+func TestRunUntil(t *testing.T) {
+	tests := []struct {
+		name      string
+		until     string
+		statuses  []string
+		wantCalls int
+		wantErr   string
+		wantOut   []string
+	}{
+		{
+			name:      "succeeds on the 3rd poll",
+			until:     `{ expr: Status, value: Success, interval: 1ms, max_wait: 1m }`,
+			statuses:  []string{"Pending", "InProgress", "Success"},
+			wantCalls: 3,
+			wantOut:   []string{`#1 | elapsed=0s | Status="Pending" | next in 1ms`, `#2 | elapsed=0s | Status="InProgress"`, "UNTIL OK  | wait | profile=COM_DEV | polls=3", `"Status": "Success"`},
+		},
+		{
+			name:      "first poll",
+			until:     `{ expr: Status, op: in, value: [Success, Skipped] }`,
+			statuses:  []string{"Skipped"},
+			wantCalls: 1,
+			wantOut:   []string{"polls=1"},
+		},
+		{
+			name:      "max_wait",
+			until:     `{ expr: Status, value: Success, interval: 30ms, max_wait: 50ms }`,
+			statuses:  []string{"InProgress"},
+			wantCalls: 2,
+			wantErr:   `until: timed out after 0s (2 polls): expr Status eq "Success"`,
+			wantOut:   []string{"#1 |", `"Status": "InProgress"`},
+		},
+		{
+			name:      "fail_if",
+			until:     `{ expr: Status, value: Success, interval: 1ms, fail_if: { expr: Status, op: in, value: [Failed, Cancelled] } }`,
+			statuses:  []string{"InProgress", "Cancelled", "Success"},
+			wantCalls: 2,
+			wantErr:   `until: fail_if matched after 2 polls: expr Status in ["Failed","Cancelled"]`,
+			wantOut:   []string{`"Status": "Cancelled"`},
+		},
+		{
+			name:      "command error without retry_on_error",
+			until:     `{ expr: Status, value: Success, interval: 1ms }`,
+			statuses:  []string{"", "Success"},
+			wantCalls: 1,
+			wantErr:   "exit status 254",
+			wantOut:   []string{"InvocationDoesNotExist"},
+		},
+		{
+			name:      "retry_on_error",
+			until:     `{ expr: Status, value: Success, interval: 1ms, retry_on_error: true }`,
+			statuses:  []string{"", "", "InProgress", "Success"},
+			wantCalls: 4,
+			wantOut:   []string{"#1 | elapsed=0s | error=exit status 254 | next in 1ms", "#2 |", `#3 | elapsed=0s | Status="InProgress"`, "polls=4"},
+		},
+		{
+			name:      "retry_on_error until max_wait",
+			until:     `{ expr: Status, value: Success, interval: 30ms, max_wait: 50ms, retry_on_error: true }`,
+			statuses:  []string{""},
+			wantCalls: 2,
+			wantErr:   "until: timed out after 0s (2 polls): expr Status eq \"Success\": last error: exit status 254",
+		},
+		{
+			name:      "condition error stops polling",
+			until:     `{ expr: Status, op: gt, value: 1, interval: 1ms }`,
+			statuses:  []string{"InProgress"},
+			wantCalls: 1,
+			wantErr:   "until gt: not a number",
+		},
+		{
+			name:      "var combined with expr",
+			until:     `{ all: [ { var: ENV, value: dev }, { expr: Status, value: Success } ], interval: 1ms }`,
+			statuses:  []string{"InProgress", "Success"},
+			wantCalls: 2,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var u UntilBlock
+			if err := yaml.Unmarshal([]byte(tt.until), &u); err != nil {
+				t.Fatal(err)
+			}
+			out := &lockedBuffer{}
+			env := &runEnv{mw: out, limit: 10, shell: "sh", step: -1}
+			exec, calls := stubPoll(tt.statuses...)
+
+			_, last, err := runUntil(env, "COM_DEV", "wait", Cmd{Name: "wait", Until: &u}, map[string]string{"ENV": "dev"}, exec)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want %q", err, tt.wantErr)
+				}
+			} else if err != nil {
+				t.Fatalf("%v\n%s", err, out.Bytes())
+			} else if s, _ := last.(map[string]any)["Status"].(string); s != tt.statuses[len(tt.statuses)-1] {
+				t.Errorf("last = %v", last)
+			}
+			if *calls != tt.wantCalls {
+				t.Errorf("calls = %d, want %d\n%s", *calls, tt.wantCalls, out.Bytes())
+			}
+			for _, w := range tt.wantOut {
+				if !strings.Contains(string(out.Bytes()), w) {
+					t.Errorf("output does not contain %q:\n%s", w, out.Bytes())
+				}
+			}
+			// 途中の応答は表示しない（最後の1回だけ）
+			if n := strings.Count(string(out.Bytes()), `{"Status"`); err == nil && n != 1 {
+				t.Errorf("responses shown %d times, want 1:\n%s", n, out.Bytes())
+			}
+		})
+	}
+}
+
+func TestUntilUnmarshal(t *testing.T) {
+	var u UntilBlock
+	if err := yaml.Unmarshal([]byte(`{ expr: Status, value: Success }`), &u); err != nil {
+		t.Fatal(err)
+	}
+	if u.Interval != defaultUntilInterval || u.MaxWait != defaultUntilMaxWait || u.FailIf != nil || u.RetryOnError {
+		t.Errorf("defaults = %+v", u)
+	}
+	if got := u.desc(); got != `until expr Status eq "Success" | interval=10s | max_wait=10m0s` {
+		t.Errorf("desc = %q", got)
+	}
+
+	var u2 UntilBlock
+	if err := yaml.Unmarshal([]byte(`{ any: [ { expr: Status, value: A }, { var: X, op: exists } ], interval: 1m30s }`), &u2); err != nil || u2.Interval != 90*time.Second {
+		t.Errorf("interval = %s, err = %v", u2.Interval, err)
+	}
+
+	tests := []struct {
+		yml     string
+		wantErr string
+	}{
+		{`until`, "until must be a mapping"},
+		{`{ expr: Status, interval: 0s }`, `until interval: invalid duration "0s"`},
+		{`{ expr: Status, max_wait: soon }`, `until max_wait: invalid duration "soon"`},
+		{`{ expr: Status, retry_on_error: maybe }`, "until retry_on_error:"},
+		{`{ interval: 1s }`, "condition must have exactly one of"},
+		// var は待っている間に変わらない
+		{`{ var: STATUS, value: Success }`, "until: condition must use expr"},
+		{`{ all: [ { var: A }, { not: { var: B } } ] }`, "until: condition must use expr"},
+	}
+	for _, tt := range tests {
+		var u UntilBlock
+		err := yaml.Unmarshal([]byte(tt.yml), &u)
+		if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("%s: err = %v, want %q", tt.yml, err, tt.wantErr)
+		}
+	}
+}
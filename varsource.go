@@ -0,0 +1,345 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+
+	"gopkg.in/yaml.v3"
+)
+
+// VarValue は vars.defaults / vars.profiles の値。
+// 文字列（テンプレート）か、外部参照（ssm / cfn_output）のどちらか。
+//
+//	vars:
+//	  defaults:
+//	    STACK_NAME: stack-necro
+//	    BUCKET: { ssm: /com/bucket }
+//	    ROLE_ARN: { cfn_output: { stack: '{{ .STACK_NAME }}', key: RoleArn } }
+type VarValue struct {
+	Value  string
+	Source *VarSource
+}
+
+type VarSource struct {
+	SSM       string           `yaml:"ssm,omitempty"`        // aws ssm get-parameter --name --with-decryption
+	CfnOutput *CfnOutputSource `yaml:"cfn_output,omitempty"` // aws cloudformation describe-stacks
+}
+
+type CfnOutputSource struct {
+	Stack string `yaml:"stack"`
+	Key   string `yaml:"key"` // OutputKey
+}
+
+func (v *VarValue) UnmarshalYAML(n *yaml.Node) error {
+	if n.Kind != yaml.MappingNode {
+		return n.Decode(&v.Value)
+	}
+
+	var src VarSource
+	if err := n.Decode(&src); err != nil {
+		return err
+	}
+	if (src.SSM == "") == (src.CfnOutput == nil) {
+		return fmt.Errorf("line %d: var source must have exactly one of ssm / cfn_output", n.Line)
+	}
+	if src.CfnOutput != nil && (src.CfnOutput.Stack == "" || src.CfnOutput.Key == "") {
+		return fmt.Errorf("line %d: cfn_output requires stack and key", n.Line)
+	}
+	v.Source = &src
+	return nil
+}
+
+// splitVars は VarValue を固定値（テンプレート）と外部参照に分ける。
+func splitVars(m map[string]VarValue) (static map[string]string, sources map[string]*VarSource) {
+	static = make(map[string]string, len(m))
+	sources = make(map[string]*VarSource)
+	for k, v := range m {
+		if v.Source != nil {
+			sources[k] = v.Source
+		} else {
+			static[k] = v.Value
+		}
+	}
+	return static, sources
+}
+
+// mergeVarValues は defaults に profile 固有値を上書きする（固定値/外部参照の種類は問わない）。
+func mergeVarValues(defaults, profile map[string]VarValue) map[string]VarValue {
+	out := make(map[string]VarValue, len(defaults)+len(profile))
+	for k, v := range defaults {
+		out[k] = v
+	}
+	for k, v := range profile {
+		out[k] = v
+	}
+	return out
+}
+
+// varSourceCache は実行中の外部参照結果を保持する（同じ stack の describe-stacks は1回）。
+type varSourceCache struct {
+	mu     sync.Mutex
+	ssm    map[string]ssmParam
+	stacks map[string]map[string]string // profile|region|stack -> OutputKey -> OutputValue
+}
+
+type ssmParam struct {
+	value  string
+	secure bool // SecureString（復号した値はシークレットとして扱う）
+}
+
+func newVarSourceCache() *varSourceCache {
+	return &varSourceCache{
+		ssm:    map[string]ssmParam{},
+		stacks: map[string]map[string]string{},
+	}
+}
+
+// resolveVarSources は ctx を使って外部参照のパラメータを展開し、値を ctx に入れる。
+// パラメータが他の外部参照の値に依存する場合は、依存先から順に解決する。
+// secure は SecureString だった変数。呼び出し側で vars.secrets と同じく（テンプレートとして解決しない・PROFILES に出さない）扱う。
+func resolveVarSources(mw io.Writer, cache *varSourceCache, profile, region string, limit int, literal, setupVars map[string]bool, ctx map[string]string, sources map[string]*VarSource) (secure []string, err error) {
+	lit := make(map[string]bool, len(literal))
+	for k := range literal {
+		lit[k] = true
+	}
+
+	pending := make(map[string]*VarSource, len(sources))
+	for k, v := range sources {
+		// secrets は defaults / profiles より優先（外部参照でも上書きしない）
+		// literal には別の profile の SecureString も入るので、この profile の ctx に値がある時だけ
+		if _, ok := ctx[k]; isReadOnlyKey(setupVars, k) || (literal[k] && ok) {
+			continue
+		}
+		pending[k] = v
+	}
+
+	for len(pending) > 0 {
+		// pending を（推移的に）参照しない ctx だけを解決して、パラメータ展開に使う
+		sub, err := resolvableSubset(ctx, pending, limit, lit)
+		if err != nil {
+			return nil, err
+		}
+
+		names := make([]string, 0, len(pending))
+		for k := range pending {
+			names = append(names, k)
+		}
+		sort.Strings(names)
+
+		progress := false
+		for _, name := range names {
+			src := pending[name]
+			if !sourceReady(src, sub, pending) {
+				continue
+			}
+
+			v, desc, isSecure, err := cache.lookup(profile, region, sub, src)
+			if err != nil {
+				fmt.Fprintf(mw, "❌ VAR NG    | %s | profile=%s | %s\n", name, profile, desc)
+				return nil, fmt.Errorf("var %s: %w", name, err)
+			}
+			if isSecure {
+				fmt.Fprintf(mw, "🔎 VAR OK    | %s | profile=%s | %s => (SecureString)\n", name, profile, desc)
+				lit[name] = true
+				secure = append(secure, name)
+			} else {
+				fmt.Fprintf(mw, "🔎 VAR OK    | %s | profile=%s | %s => %s\n", name, profile, desc, v)
+			}
+
+			ctx[name] = v
+			delete(pending, name)
+			progress = true
+		}
+
+		if !progress {
+			return nil, fmt.Errorf("var sources cannot be resolved (cycle or undefined reference): %s", strings.Join(names, ", "))
+		}
+	}
+	return secure, nil
+}
+
+func sourceReady(src *VarSource, sub map[string]string, pending map[string]*VarSource) bool {
+	for _, p := range sourceParams(src) {
+		refs, dynamic, err := templateDeps(p)
+		if err != nil {
+			// render 時にエラーとして報告させる
+			return true
+		}
+		if dynamic {
+			return len(pending) == 1
+		}
+		for _, r := range refs {
+			if _, ok := pending[r]; ok {
+				return false
+			}
+			if _, ok := sub[r]; !ok {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func sourceParams(src *VarSource) []string {
+	if src.CfnOutput != nil {
+		return []string{src.CfnOutput.Stack, src.CfnOutput.Key}
+	}
+	return []string{src.SSM}
+}
+
+// resolvableSubset は pending を参照しない ctx のキーだけをコピーして解決する。
+func resolvableSubset(ctx map[string]string, pending map[string]*VarSource, limit int, literal map[string]bool) (map[string]string, error) {
+	tainted := make(map[string]bool)
+	for k := range pending {
+		tainted[k] = true
+	}
+
+	deps := make(map[string][]string, len(ctx))
+	for k, v := range ctx {
+		if literal[k] {
+			continue
+		}
+		refs, dynamic, err := templateDeps(v)
+		if err != nil {
+			return nil, fmt.Errorf("resolve ctx[%s] failed: %w", k, err)
+		}
+		if dynamic {
+			tainted[k] = true
+		}
+		deps[k] = refs
+	}
+
+	for changed := true; changed; {
+		changed = false
+		for k, refs := range deps {
+			if tainted[k] {
+				continue
+			}
+			for _, r := range refs {
+				if tainted[r] {
+					tainted[k] = true
+					changed = true
+					break
+				}
+			}
+		}
+	}
+
+	sub := make(map[string]string, len(ctx))
+	for k, v := range ctx {
+		if !tainted[k] {
+			sub[k] = v
+		}
+	}
+	if err := resolveContextTemplates(sub, limit, literal); err != nil {
+		return nil, err
+	}
+	return sub, nil
+}
+
+// lookup は外部参照の値を返す。secure は SecureString を復号した値（表示しない）。
+func (c *varSourceCache) lookup(profile, region string, ctx map[string]string, src *VarSource) (value string, desc string, secure bool, err error) {
+	render := func(s string) (string, error) {
+		r, _, e := renderTemplateString(s, ctx)
+		return r, e
+	}
+
+	if src.CfnOutput != nil {
+		stack, e := render(src.CfnOutput.Stack)
+		if e != nil {
+			return "", "cfn_output", false, e
+		}
+		key, e := render(src.CfnOutput.Key)
+		if e != nil {
+			return "", "cfn_output", false, e
+		}
+		desc = fmt.Sprintf("cfn_output=%s.%s", stack, key)
+
+		outputs, e := c.stackOutputs(profile, region, stack)
+		if e != nil {
+			return "", desc, false, e
+		}
+		v, ok := outputs[key]
+		if !ok {
+			return "", desc, false, fmt.Errorf("stack %s has no output %s", stack, key)
+		}
+		return v, desc, false, nil
+	}
+
+	name, e := render(src.SSM)
+	if e != nil {
+		return "", "ssm", false, e
+	}
+	desc = "ssm=" + name
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	ck := profile + "|" + region + "|" + name
+	if p, ok := c.ssm[ck]; ok {
+		return p.value, desc, p.secure, nil
+	}
+	b, errText, e := runAWSQuiet(profile, region, "ssm", "get-parameter", "--name", name, "--with-decryption")
+	if e != nil {
+		return "", desc, false, awsQuietError(e, errText)
+	}
+	var data struct {
+		Parameter struct {
+			Type  string `json:"Type"`
+			Value string `json:"Value"`
+		} `json:"Parameter"`
+	}
+	if e := json.Unmarshal(b, &data); e != nil {
+		return "", desc, false, fmt.Errorf("json parse failed: %w", e)
+	}
+	p := ssmParam{value: data.Parameter.Value, secure: data.Parameter.Type == "SecureString"}
+	if p.secure {
+		// vars.secrets と同じく、短い値は無関係な出力まで *** にするのでキャッシュする前にエラーにする
+		if e := checkSecretLen(p.value); e != nil {
+			return "", desc, false, fmt.Errorf("SecureString %w", e)
+		}
+		secretValues.add(p.value)
+	}
+	c.ssm[ck] = p
+	return p.value, desc, p.secure, nil
+}
+
+func (c *varSourceCache) stackOutputs(profile, region, stack string) (map[string]string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	ck := profile + "|" + region + "|" + stack
+	if m, ok := c.stacks[ck]; ok {
+		return m, nil
+	}
+
+	b, errText, e := runAWSQuiet(profile, region, "cloudformation", "describe-stacks", "--stack-name", stack)
+	if e != nil {
+		return nil, awsQuietError(e, errText)
+	}
+	var data struct {
+		Stacks []struct {
+			Outputs []struct {
+				OutputKey   string `json:"OutputKey"`
+				OutputValue string `json:"OutputValue"`
+			} `json:"Outputs"`
+		} `json:"Stacks"`
+	}
+	if e := json.Unmarshal(b, &data); e != nil {
+		return nil, fmt.Errorf("json parse failed: %w", e)
+	}
+	if len(data.Stacks) == 0 {
+		return nil, fmt.Errorf("stack %s not found", stack)
+	}
+
+	m := make(map[string]string, len(data.Stacks[0].Outputs))
+	for _, o := range data.Stacks[0].Outputs {
+		m[o.OutputKey] = o.OutputValue
+	}
+	c.stacks[ck] = m
+	return m, nil
+}
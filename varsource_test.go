@@ -0,0 +1,238 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+// stubAWSQuiet は runAWSQuiet を差し替え、ssm の値（Type 付き）と CFN の Outputs を返す。呼び出したコマンドを返す。
+func stubAWSQuiet(t *testing.T, ssm map[string][2]string, stacks map[string]map[string]string) *[]string {
+	t.Helper()
+	orig := runAWSQuiet
+	origSecrets := secretValues
+	t.Cleanup(func() {
+		runAWSQuiet = orig
+		secretValues = origSecrets
+	})
+	secretValues = &secretSet{}
+
+	var mu sync.Mutex
+	calls := []string{}
+	runAWSQuiet = func(profile, region string, args ...string) ([]byte, string, error) {
+		mu.Lock()
+		calls = append(calls, strings.Join(args, " "))
+		mu.Unlock()
+
+		switch {
+		case len(args) >= 4 && args[0] == "ssm":
+			p, ok := ssm[args[3]]
+			if !ok {
+				return nil, "ParameterNotFound", errors.New("exit status 254")
+			}
+			return []byte(fmt.Sprintf(`{"Parameter": {"Type": %q, "Value": %q}}`, p[0], p[1])), "", nil
+		case len(args) >= 4 && args[0] == "cloudformation":
+			outs, ok := stacks[args[3]]
+			if !ok {
+				return nil, "Stack does not exist", errors.New("exit status 254")
+			}
+			var list []string
+			for k, v := range outs {
+				list = append(list, fmt.Sprintf(`{"OutputKey": %q, "OutputValue": %q}`, k, v))
+			}
+			return []byte(`{"Stacks": [{"Outputs": [` + strings.Join(list, ",") + `]}]}`), "", nil
+		}
+		return nil, "", fmt.Errorf("unexpected aws call: %v", args)
+	}
+	return &calls
+}
+
+func parseVars(t *testing.T, yml string) map[string]VarValue {
+	t.Helper()
+	var m map[string]VarValue
+	if err := yaml.Unmarshal([]byte(yml), &m); err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func TestResolveVarSourcesOrder(t *testing.T) {
+	calls := stubAWSQuiet(t,
+		map[string][2]string{
+			"/dev/stack-name": {"String", "stack-a"},
+			"/dev/bucket":     {"String", "bucket-a"},
+		},
+		map[string]map[string]string{"stack-a": {"RoleArn": "arn:aws:iam::123456789012:role/a"}},
+	)
+
+	static, sources := splitVars(parseVars(t, `
+ENV: dev
+PREFIX: "/{{ .ENV }}"
+ROLE: { cfn_output: { stack: "{{ .STACK }}", key: RoleArn } }
+STACK: { ssm: "{{ .PREFIX }}/stack-name" }
+BUCKET: { ssm: "{{ .PREFIX }}/bucket" }
+BUCKET2: { ssm: "/dev/bucket" }
+`))
+	ctx := map[string]string{"PROFILE": "COM_DEV"}
+	mergeVarsNoOverride(ctx, static, nil)
+
+	out := &lockedBuffer{}
+	secure, err := resolveVarSources(out, newVarSourceCache(), "COM_DEV", "ap-northeast-1", 10, nil, nil, ctx, sources)
+	if err != nil {
+		t.Fatalf("%v\n%s", err, out.Bytes())
+	}
+	if len(secure) != 0 {
+		t.Errorf("secure = %v, want none", secure)
+	}
+
+	want := map[string]string{
+		"STACK":   "stack-a",
+		"ROLE":    "arn:aws:iam::123456789012:role/a",
+		"BUCKET":  "bucket-a",
+		"BUCKET2": "bucket-a",
+	}
+	for k, v := range want {
+		if ctx[k] != v {
+			t.Errorf("ctx[%s] = %q, want %q", k, ctx[k], v)
+		}
+	}
+
+	// 依存先（STACK）から順に、同じパラメータは1回だけ取得する
+	wantCalls := []string{
+		"ssm get-parameter --name /dev/bucket --with-decryption",
+		"ssm get-parameter --name /dev/stack-name --with-decryption",
+		"cloudformation describe-stacks --stack-name stack-a",
+	}
+	if !reflect.DeepEqual(*calls, wantCalls) {
+		t.Errorf("calls = %q, want %q", *calls, wantCalls)
+	}
+}
+
+func TestResolveVarSourcesErrors(t *testing.T) {
+	stubAWSQuiet(t, map[string][2]string{"/a": {"String", "x"}}, nil)
+
+	tests := []struct {
+		name    string
+		yml     string
+		wantErr string
+	}{
+		{
+			name: "cycle",
+			yml: `
+A: { ssm: "/{{ .B }}" }
+B: { ssm: "/{{ .A }}" }
+`,
+			wantErr: "var sources cannot be resolved (cycle or undefined reference): A, B",
+		},
+		{
+			name:    "not found",
+			yml:     `A: { ssm: /missing }`,
+			wantErr: "var A: exit status 254: ParameterNotFound",
+		},
+		{
+			name:    "missing output",
+			yml:     `A: { cfn_output: { stack: nope, key: K } }`,
+			wantErr: "var A: exit status 254: Stack does not exist",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, sources := splitVars(parseVars(t, tt.yml))
+			_, err := resolveVarSources(&lockedBuffer{}, newVarSourceCache(), "COM_DEV", "ap-northeast-1", 10, nil, nil, map[string]string{}, sources)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("err = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestResolveVarSourcesSecureString(t *testing.T) {
+	calls := stubAWSQuiet(t, map[string][2]string{
+		"/db/password": {"SecureString", "p@ss{{ .word }}"},
+		"/db/pin":      {"SecureString", "123"},
+		"/db/user":     {"String", "admin"},
+	}, nil)
+
+	static, sources := splitVars(parseVars(t, `
+DB_PASS: { ssm: /db/password }
+DB_USER: { ssm: /db/user }
+DSN: "{{ .DB_USER }}@db"
+API_KEY: { ssm: /db/user }
+`))
+	ctx := map[string]string{"PROFILE": "COM_DEV"}
+	mergeVarsNoOverride(ctx, static, nil)
+
+	// vars.secrets のキーは外部参照で上書きしない
+	literal := map[string]bool{"API_KEY": true}
+	ctx["API_KEY"] = "from-secrets"
+
+	out := &lockedBuffer{}
+	secure, err := resolveVarSources(out, newVarSourceCache(), "COM_DEV", "ap-northeast-1", 10, literal, nil, ctx, sources)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(secure, []string{"DB_PASS"}) {
+		t.Errorf("secure = %v, want [DB_PASS]", secure)
+	}
+	if strings.Contains(string(out.Bytes()), "p@ss") || !strings.Contains(string(out.Bytes()), "ssm=/db/password => (SecureString)") {
+		t.Errorf("SecureString value is shown:\n%s", out.Bytes())
+	}
+	if got := secretValues.mask("pw=p@ss{{ .word }}"); got != "pw=***" {
+		t.Errorf("mask = %q", got)
+	}
+	if ctx["API_KEY"] != "from-secrets" {
+		t.Errorf("API_KEY = %q, want from-secrets", ctx["API_KEY"])
+	}
+
+	// 呼び出し側で literal にすると、復号した値の {{ はテンプレートとして評価しない
+	literal["DB_PASS"] = true
+	if err := resolveContextTemplates(ctx, 10, literal); err != nil {
+		t.Fatal(err)
+	}
+	if ctx["DB_PASS"] != "p@ss{{ .word }}" || ctx["DSN"] != "admin@db" {
+		t.Errorf("DB_PASS = %q, DSN = %q", ctx["DB_PASS"], ctx["DSN"])
+	}
+	pj, err := profilesJSON([]string{"COM_DEV"}, map[string]map[string]string{"COM_DEV": ctx}, literal, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(pj, "DB_PASS") {
+		t.Errorf("PROFILES has SecureString var: %s", pj)
+	}
+
+	// 別の profile では（前の profile で literal にしたキーでも）取得する
+	ctx2 := map[string]string{"PROFILE": "SND_DEV"}
+	if _, err := resolveVarSources(&lockedBuffer{}, newVarSourceCache(), "SND_DEV", "ap-northeast-1", 10, literal, nil, ctx2, sources); err != nil {
+		t.Fatal(err)
+	}
+	if ctx2["DB_PASS"] != "p@ss{{ .word }}" {
+		t.Errorf("SND_DEV DB_PASS = %q", ctx2["DB_PASS"])
+	}
+
+	// 短い SecureString はエラーにし、キャッシュもしない
+	cache := newVarSourceCache()
+	_, pin := splitVars(parseVars(t, `PIN: { ssm: /db/pin }`))
+	for i := 0; i < 2; i++ {
+		_, err := resolveVarSources(&lockedBuffer{}, cache, "COM_DEV", "ap-northeast-1", 10, nil, nil, map[string]string{}, pin)
+		if err == nil || !strings.Contains(err.Error(), "var PIN: SecureString value is too short (3 chars") {
+			t.Fatalf("err = %v, want too short", err)
+		}
+	}
+	n := 0
+	for _, c := range *calls {
+		if strings.Contains(c, "/db/pin") {
+			n++
+		}
+	}
+	if n != 2 {
+		t.Errorf("/db/pin fetched %d times, want 2 (not cached)", n)
+	}
+	if got := secretValues.mask("pin 123"); got != "pin 123" {
+		t.Errorf("short value is masked: %q", got)
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// WhenBlock はステップを実行する前の条件（false ならスキップ）。
+//
+//	cmd:
+//	  - name: s3-upload
+//	    when: '{{ eq .ENV "prd" }}'                 # テンプレート: true / false
+//	  - name: bucket-check
+//	    when: { var: BUCKET_NAME, op: exists }      # 条件（Condition と同じ書式）
+//
+// 条件の expr は直前ステップの JSON 出力（LAST_JSON）に対して評価する。
+type WhenBlock struct {
+	Template string
+	Cond     *Condition
+}
+
+func (w *WhenBlock) UnmarshalYAML(n *yaml.Node) error {
+	if n.Kind == yaml.ScalarNode {
+		return n.Decode(&w.Template)
+	}
+	w.Cond = &Condition{}
+	return n.Decode(w.Cond)
+}
+
+// evalWhen は条件を評価し、結果と SKIP 表示用の理由を返す。
+func evalWhen(w *WhenBlock, ctx map[string]string, last any) (bool, string, error) {
+	if w == nil {
+		return true, "", nil
+	}
+
+	if w.Cond != nil {
+		pass, err := evalCondition("when", w.Cond, ctx, last)
+		if err != nil || pass {
+			return pass, "", err
+		}
+		return false, "when " + w.Cond.String() + conditionGot(w.Cond, ctx), nil
+	}
+
+	s, _, err := renderTemplateString(w.Template, ctx)
+	if err != nil {
+		return false, "", fmt.Errorf("when: %w", err)
+	}
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "true", "yes", "1":
+		return true, "", nil
+	case "false", "no", "0", "":
+		return false, fmt.Sprintf("when %s -> %q", w.Template, strings.TrimSpace(s)), nil
+	default:
+		return false, "", fmt.Errorf("when: template must evaluate to true/false, got %q (in %q)", s, w.Template)
+	}
+}
+
+// conditionGot は var の葉1つだけの条件なら、実際の値を理由に添える。
+func conditionGot(c *Condition, ctx map[string]string) string {
+	if c.Var == "" {
+		return ""
+	}
+	if v, ok := ctx[c.Var]; ok {
+		return fmt.Sprintf(" (got %q)", v)
+	}
+	return " (undefined)"
+}